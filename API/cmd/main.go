@@ -1,21 +1,60 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 
+	"github.com/flotio-dev/api/pkg/account"
 	router "github.com/flotio-dev/api/pkg/api/v1/router"
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/buildlog"
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/invitations"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/flotio-dev/api/pkg/storage"
+	"github.com/flotio-dev/api/pkg/utils"
 )
 
 func main() {
 	godotenv.Load()
 
 	db.InitDB()
+	storage.InitStore()
+	buildlog.InitRules()
+	secrets.InitKeyring()
+	if err := db.RunDataMigration(db.DB, "encrypt-envs", secrets.EncryptStoredEnvs); err != nil {
+		log.Fatalf("Failed to encrypt stored envs: %v", err)
+	}
+	// Encrypts the GitHub tokens stored before they were encrypted, or with
+	// a previous primary key
+	if n, err := secrets.EncryptStoredGithubTokens(db.DB); err != nil {
+		log.Printf("Failed to encrypt GitHub tokens: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted the GitHub tokens of %d users", n)
+	}
+	auth.InitVerifier()
+	keycloak.InitAdmin()
+	mailer.InitMailer()
+	invitations.InitSigningKey()
+	utils.InitTrustedProxies()
+
+	// Archive finished build logs and apply retention, and purge the
+	// accounts whose deletion grace period is over, in the background
+	go buildlog.RunRetention(context.Background(), time.Hour)
+	go account.RunDeletions(context.Background(), time.Hour)
+
+	// Ingest the logs of the running builds no API instance is watching,
+	// such as the ones started before a restart
+	go buildlog.WatchRunning(context.Background(), kubernetes.StreamPodLogs, time.Minute)
 
 	log.Println("Starting Flotio API server")
 	r := router.Router()
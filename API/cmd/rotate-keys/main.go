@@ -0,0 +1,29 @@
+// Command rotate-keys re-encrypts every project env, organization env and
+// secret file with a new data key wrapped by the primary key of the keyring,
+// and the GitHub tokens of users with the primary key itself.
+// Run it after adding a new primary key; the previous keys can be dropped
+// from the keyring afterwards.
+package main
+
+import (
+	"log"
+
+	"github.com/joho/godotenv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/secrets"
+)
+
+func main() {
+	godotenv.Load()
+
+	db.InitDB()
+	secrets.InitKeyring()
+
+	stats, err := secrets.Rotate()
+	if err != nil {
+		log.Fatalf("Key rotation failed: %v", err)
+	}
+
+	log.Printf("Re-encrypted %d envs and %d files in %d projects and %d organizations, and the GitHub tokens of %d users with key %q", stats.Envs, stats.Files, stats.Projects, stats.Organizations, stats.Users, secrets.KEKs.Primary())
+}
@@ -0,0 +1,155 @@
+// Package account issues the single-use tokens emailed to users to reset
+// their password or verify their email address, and sends those emails.
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// Purpose of an emailed token
+type Purpose string
+
+const (
+	PasswordReset     Purpose = "password_reset"
+	EmailVerification Purpose = "email_verification"
+)
+
+// lifetimes is how long the tokens of each purpose stay valid
+var lifetimes = map[Purpose]time.Duration{
+	PasswordReset:     time.Hour,
+	EmailVerification: 48 * time.Hour,
+}
+
+// resendInterval is the minimum time between two tokens of the same purpose
+// for a user, so the endpoints cannot be used to flood an inbox
+const resendInterval = time.Minute
+
+var (
+	// ErrInvalidToken is returned for unknown, already used or replaced
+	// tokens, and tokens sent to an email the user no longer has
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpired      = errors.New("token expired")
+	// ErrTooSoon is returned when a token of the same purpose was sent less
+	// than a minute ago
+	ErrTooSoon = errors.New("a token was sent recently")
+)
+
+// Issue creates a token for the user's current email address, the unused
+// tokens of the same purpose stop working
+func Issue(tx *gorm.DB, user db.User, purpose Purpose) (string, error) {
+	var recent int64
+	err := tx.Model(&db.EmailToken{}).
+		Where("user_id = ? AND purpose = ? AND email = ? AND used_at IS NULL AND created_at > ?", user.ID, purpose, user.Email, time.Now().Add(-resendInterval)).
+		Count(&recent).Error
+	if err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", ErrTooSoon
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).Delete(&db.EmailToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.EmailToken{
+			UserID:    user.ID,
+			Purpose:   string(purpose),
+			Email:     user.Email,
+			TokenHash: hash(token),
+			ExpiresAt: time.Now().Add(lifetimes[purpose]),
+		}).Error
+	})
+	return token, err
+}
+
+// Consume marks the token used and returns it with its user. Run it in the
+// transaction of the change it allows, so a failed change keeps the token
+// usable.
+func Consume(tx *gorm.DB, token string, purpose Purpose) (db.EmailToken, error) {
+	var emailToken db.EmailToken
+	err := tx.Preload("User").Where("token_hash = ? AND purpose = ?", hash(token), purpose).Limit(1).Find(&emailToken).Error
+	if err != nil {
+		return emailToken, err
+	}
+	if emailToken.ID == 0 || emailToken.UsedAt != nil || emailToken.User == nil ||
+		!strings.EqualFold(emailToken.User.Email, emailToken.Email) {
+		return emailToken, ErrInvalidToken
+	}
+	now := time.Now()
+	if now.After(emailToken.ExpiresAt) {
+		return emailToken, ErrExpired
+	}
+
+	result := tx.Model(&db.EmailToken{}).Where("id = ? AND used_at IS NULL", emailToken.ID).Update("used_at", now)
+	if result.Error != nil {
+		return emailToken, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return emailToken, ErrInvalidToken
+	}
+	emailToken.UsedAt = &now
+	return emailToken, nil
+}
+
+// SendPasswordReset emails the link to choose a new password
+func SendPasswordReset(ctx context.Context, m mailer.Mailer, user db.User, token string) error {
+	link := utils.FrontendURL() + "/auth/reset-password?token=" + url.QueryEscape(token)
+	text := fmt.Sprintf(`Hello %s,
+
+Someone asked to reset the password of your Flotio account. If it was you,
+choose a new password within an hour:
+
+%s
+
+Otherwise you can ignore this email, your password stays the same.
+`, user.Username, link)
+
+	return m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Flotio password",
+		Text:    text,
+	})
+}
+
+// SendEmailVerification emails the link confirming the user's address
+func SendEmailVerification(ctx context.Context, m mailer.Mailer, user db.User, token string) error {
+	link := utils.FrontendURL() + "/auth/verify-email?token=" + url.QueryEscape(token)
+	text := fmt.Sprintf(`Hello %s,
+
+Confirm the email address of your Flotio account within 48 hours:
+
+%s
+`, user.Username, link)
+
+	return m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Text:    text,
+	})
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
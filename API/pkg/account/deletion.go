@@ -0,0 +1,395 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/githubauth"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/storage"
+	"github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// defaultGraceDays is how long a scheduled deletion can be cancelled when
+// ACCOUNT_DELETION_GRACE_DAYS is not set
+const defaultGraceDays = 14
+
+// ErrDeletionScheduled is returned when the account already has a pending
+// deletion
+var ErrDeletionScheduled = errors.New("account deletion already scheduled")
+
+// GracePeriod returns how long a scheduled deletion can be cancelled,
+// ACCOUNT_DELETION_GRACE_DAYS
+func GracePeriod() time.Duration {
+	days := defaultGraceDays
+	if d, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS")); err == nil && d >= 0 {
+		days = d
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// pendingDeletions keeps the deletions neither cancelled nor completed
+func pendingDeletions(tx *gorm.DB) *gorm.DB {
+	return tx.Where("cancelled_at IS NULL AND completed_at IS NULL")
+}
+
+// PendingDeletion returns the pending deletion of the user,
+// gorm.ErrRecordNotFound when there is none
+func PendingDeletion(tx *gorm.DB, userID uint) (db.AccountDeletion, error) {
+	var deletion db.AccountDeletion
+	err := tx.Scopes(pendingDeletions).Where("user_id = ?", userID).First(&deletion).Error
+	return deletion, err
+}
+
+// ScheduleDeletion schedules the deletion of the user's account at the end
+// of the grace period
+func ScheduleDeletion(tx *gorm.DB, user db.User) (db.AccountDeletion, error) {
+	if _, err := PendingDeletion(tx, user.ID); err == nil {
+		return db.AccountDeletion{}, ErrDeletionScheduled
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return db.AccountDeletion{}, err
+	}
+
+	deletion := db.AccountDeletion{
+		UserID:       user.ID,
+		KeycloakID:   user.KeycloakID,
+		ScheduledFor: time.Now().Add(GracePeriod()),
+		Steps:        []string{},
+	}
+	return deletion, tx.Create(&deletion).Error
+}
+
+// CancelDeletion cancels the pending deletion of the user
+func CancelDeletion(tx *gorm.DB, userID uint) (db.AccountDeletion, error) {
+	deletion, err := PendingDeletion(tx, userID)
+	if err != nil {
+		return deletion, err
+	}
+	now := time.Now()
+	deletion.CancelledAt = &now
+	return deletion, tx.Model(&deletion).Update("cancelled_at", now).Error
+}
+
+// SoleOwnerOrganizations returns the organizations the user is the only
+// owner of while other members remain. Ownership must be handed over before
+// deleting the account.
+func SoleOwnerOrganizations(tx *gorm.DB, userID uint) ([]db.Organization, error) {
+	var organizations []db.Organization
+	err := tx.Where(`id IN (SELECT organization_id FROM organization_members WHERE user_id = ? AND role = 'owner')
+		AND NOT EXISTS (SELECT 1 FROM organization_members m WHERE m.organization_id = organizations.id AND m.user_id <> ? AND m.role = 'owner')
+		AND EXISTS (SELECT 1 FROM organization_members m WHERE m.organization_id = organizations.id AND m.user_id <> ?)`,
+		userID, userID, userID).Order("name").Find(&organizations).Error
+	return organizations, err
+}
+
+// Purge deletes the account of a due deletion: the Keycloak user, the
+// GitHub authorization, the personal projects with their builds, logs, envs, files and build pods, the
+// organizations the user was the last member of, and the user's own records.
+// Every step can run again, a failed purge is retried by RunDeletions.
+func Purge(ctx context.Context, deletion *db.AccountDeletion) error {
+	var user db.User
+	if err := db.DB.Unscoped().Where("id = ?", deletion.UserID).Limit(1).Find(&user).Error; err != nil {
+		return err
+	}
+
+	steps := []string{}
+	record := func(format string, args ...interface{}) {
+		steps = append(steps, fmt.Sprintf(format, args...))
+	}
+	err := purge(ctx, deletion, user, record)
+
+	deletion.Steps = append(deletion.Steps, steps...)
+	if err != nil {
+		deletion.LastError = err.Error()
+	} else {
+		now := time.Now()
+		deletion.CompletedAt = &now
+		deletion.LastError = ""
+	}
+	// Struct update so the steps go through their JSON serializer
+	saveErr := db.DB.Model(deletion).Select("steps", "last_error", "completed_at").Updates(deletion).Error
+	if saveErr != nil {
+		log.Printf("Failed to record account deletion %d: %v", deletion.ID, saveErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Email != "" {
+		if err := SendDeletionCompleted(ctx, mailer.Default, user); err != nil {
+			log.Printf("Failed to email the completion of account deletion %d: %v", deletion.ID, err)
+		}
+	}
+	return nil
+}
+
+func purge(ctx context.Context, deletion *db.AccountDeletion, user db.User, record func(string, ...interface{})) error {
+	// Nobody can sign in or refresh a session from here on
+	if deletion.KeycloakID != "" {
+		if err := keycloak.Default.DeleteUser(ctx, deletion.KeycloakID); err != nil {
+			return fmt.Errorf("failed to delete Keycloak user: %v", err)
+		}
+		record("deleted Keycloak user %s", deletion.KeycloakID)
+	}
+	if user.ID == 0 {
+		return nil
+	}
+
+	if user.GithubAccessToken != "" {
+		err := githubauth.Disconnect(ctx, &user)
+		if err != nil && !errors.Is(err, githubauth.ErrNotConfigured) {
+			return fmt.Errorf("failed to revoke GitHub authorization: %v", err)
+		}
+		record("revoked GitHub authorization")
+	}
+
+	var memberships []db.OrganizationMember
+	if err := db.DB.Preload("Organization").Where("user_id = ?", user.ID).Find(&memberships).Error; err != nil {
+		return err
+	}
+	var lastMemberOf []db.Organization
+	for _, membership := range memberships {
+		if membership.Organization == nil {
+			continue
+		}
+		last, err := handOver(membership, record)
+		if err != nil {
+			return err
+		}
+		if last {
+			lastMemberOf = append(lastMemberOf, *membership.Organization)
+		}
+	}
+
+	projects := db.DB.Unscoped().Where("user_id = ? AND organization_id IS NULL", user.ID)
+	if len(lastMemberOf) > 0 {
+		ids := make([]uint, 0, len(lastMemberOf))
+		for _, organization := range lastMemberOf {
+			ids = append(ids, organization.ID)
+		}
+		projects = projects.Or("organization_id IN ?", ids)
+	}
+	var list []db.Project
+	if err := projects.Find(&list).Error; err != nil {
+		return err
+	}
+	for _, project := range list {
+		if err := purgeProject(ctx, project); err != nil {
+			return fmt.Errorf("failed to delete project %d: %v", project.ID, err)
+		}
+		record("deleted project %d", project.ID)
+	}
+
+	for _, organization := range lastMemberOf {
+		if err := purgeOrganization(ctx, organization); err != nil {
+			return fmt.Errorf("failed to delete organization %d: %v", organization.ID, err)
+		}
+		record("deleted organization %d", organization.ID)
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		deletes := []struct {
+			model interface{}
+			query string
+			arg   interface{}
+		}{
+			{&db.AccessToken{}, "user_id = ?", user.ID},
+			{&db.EmailToken{}, "user_id = ?", user.ID},
+			{&db.LoginSession{}, "keycloak_id = ?", user.KeycloakID},
+			{&db.OrganizationMember{}, "user_id = ?", user.ID},
+			{&db.GithubInstallation{}, "user_id = ?", user.ID},
+			{&db.Invitation{}, "email = ? AND accepted_at IS NULL", user.Email},
+		}
+		for _, d := range deletes {
+			if err := tx.Unscoped().Where(d.query, d.arg).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		// Organization projects the user created stay with the
+		// organization. Records of the user's changes in them are kept,
+		// detached from the user.
+		if err := tx.Unscoped().Model(&db.Project{}).Where("user_id = ?", user.ID).Update("user_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	record("deleted user %d", user.ID)
+	return nil
+}
+
+// handOver makes sure the organization keeps an owner once the member is
+// gone, promoting the most privileged remaining member. It reports whether
+// the member is the last one, the organization is then deleted.
+func handOver(membership db.OrganizationMember, record func(string, ...interface{})) (bool, error) {
+	var others []db.OrganizationMember
+	err := db.DB.Where("organization_id = ? AND user_id <> ?", membership.OrganizationID, membership.UserID).
+		Order(`CASE role WHEN 'owner' THEN 4 WHEN 'admin' THEN 3 WHEN 'developer' THEN 2 ELSE 1 END DESC, created_at ASC`).
+		Find(&others).Error
+	if err != nil {
+		return false, err
+	}
+	if len(others) == 0 {
+		return true, nil
+	}
+	if membership.Role != "owner" || others[0].Role == "owner" {
+		return false, nil
+	}
+
+	if err := db.DB.Model(&others[0]).Update("role", "owner").Error; err != nil {
+		return false, err
+	}
+	record("made user %d owner of organization %d", others[0].UserID, membership.OrganizationID)
+	return false, nil
+}
+
+// purgeProject deletes a project and everything that belongs to it
+func purgeProject(ctx context.Context, project db.Project) error {
+	if err := kubernetes.DeleteProjectPods(project.ID); err != nil && !errors.Is(err, kubernetes.ErrNotConfigured) {
+		return err
+	}
+
+	var archives, artifacts []string
+	err := db.DB.Unscoped().Model(&db.Build{}).Where("project_id = ? AND log_archive_key <> ''", project.ID).Pluck("log_archive_key", &archives).Error
+	if err != nil {
+		return err
+	}
+	err = db.DB.Unscoped().Model(&db.Build{}).Where("project_id = ? AND artifact_key <> ''", project.ID).Pluck("artifact_key", &artifacts).Error
+	if err != nil {
+		return err
+	}
+	for _, key := range append(archives, artifacts...) {
+		if err := storage.Artifacts.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		builds := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&db.Build{}).Select("id").Where("project_id = ?", project.ID)
+		envs := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&db.Env{}).Select("id").Where("project_id = ?", project.ID)
+		revisions := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&db.EnvRevision{}).Select("id").Where("project_id = ?", project.ID)
+		files := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&db.SecretFile{}).Select("id").Where("project_id = ?", project.ID)
+
+		steps := []*gorm.DB{
+			tx.Unscoped().Where("build_id IN (?)", builds).Delete(&db.Log{}),
+			tx.Unscoped().Where("build_id IN (?)", builds).Delete(&db.BuildStep{}),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.Build{}),
+			tx.Exec("DELETE FROM env_environments WHERE env_id IN (?)", envs),
+			tx.Unscoped().Where("revision_id IN (?)", revisions).Delete(&db.EnvChange{}),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.EnvRevision{}),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.Env{}),
+			tx.Exec("DELETE FROM secret_file_environments WHERE secret_file_id IN (?)", files),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.SecretFile{}),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.Environment{}),
+			tx.Unscoped().Where("project_id = ?", project.ID).Delete(&db.DataKey{}),
+			tx.Unscoped().Delete(&project),
+		}
+		for _, step := range steps {
+			if step.Error != nil {
+				return step.Error
+			}
+		}
+		return nil
+	})
+}
+
+// purgeOrganization deletes an organization whose projects are gone
+func purgeOrganization(ctx context.Context, organization db.Organization) error {
+	if keycloak.OrganizationsEnabled() && organization.KeycloakOrganizationID != nil {
+		if err := keycloak.Default.DeleteOrganization(ctx, *organization.KeycloakOrganizationID); err != nil {
+			return err
+		}
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		steps := []*gorm.DB{
+			tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.OrganizationEnv{}),
+			tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.DataKey{}),
+			tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.Invitation{}),
+			tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.OrganizationMember{}),
+			tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.GithubInstallation{}),
+			tx.Unscoped().Delete(&organization),
+		}
+		for _, step := range steps {
+			if step.Error != nil {
+				return step.Error
+			}
+		}
+		return nil
+	})
+}
+
+// RunDeletions purges the accounts whose grace period is over every
+// interval until ctx is cancelled
+func RunDeletions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purgeDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeDue(ctx context.Context) {
+	var due []db.AccountDeletion
+	if err := db.DB.Scopes(pendingDeletions).Where("scheduled_for <= ?", time.Now()).Find(&due).Error; err != nil {
+		log.Printf("Failed to fetch due account deletions: %v", err)
+		return
+	}
+
+	for i := range due {
+		if err := Purge(ctx, &due[i]); err != nil {
+			log.Printf("Failed to delete account of user %d: %v", due[i].UserID, err)
+			continue
+		}
+		log.Printf("Deleted account of user %d", due[i].UserID)
+	}
+}
+
+// SendDeletionScheduled tells the user when their account will be deleted
+func SendDeletionScheduled(ctx context.Context, m mailer.Mailer, user db.User, deletion db.AccountDeletion) error {
+	text := fmt.Sprintf(`Hello %s,
+
+Your Flotio account and its personal projects will be deleted on %s.
+
+Changed your mind? Cancel the deletion from your account settings before
+then: %s/settings/account
+`, user.Username, deletion.ScheduledFor.UTC().Format("January 2, 2006 15:04 MST"), utils.FrontendURL())
+
+	return m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your Flotio account will be deleted",
+		Text:    text,
+	})
+}
+
+// SendDeletionCompleted confirms the deletion to the former user
+func SendDeletionCompleted(ctx context.Context, m mailer.Mailer, user db.User) error {
+	text := fmt.Sprintf(`Hello %s,
+
+Your Flotio account and its data have been deleted.
+`, user.Username)
+
+	return m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your Flotio account was deleted",
+		Text:    text,
+	})
+}
@@ -0,0 +1,244 @@
+package account
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/flotio-dev/api/pkg/buildlog"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/flotio-dev/api/pkg/secrets"
+)
+
+// exportedProfile is the profile of the user in an export. Tokens are left
+// out, only whether GitHub is connected is kept.
+type exportedProfile struct {
+	ID              uint      `json:"id"`
+	KeycloakID      string    `json:"keycloak_id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	EmailVerified   bool      `json:"email_verified"`
+	FirstName       string    `json:"first_name,omitempty"`
+	LastName        string    `json:"last_name,omitempty"`
+	GithubConnected bool      `json:"github_connected"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type exportedMembership struct {
+	OrganizationID uint      `json:"organization_id"`
+	Organization   string    `json:"organization"`
+	Role           string    `json:"role"`
+	JoinedAt       time.Time `json:"joined_at"`
+}
+
+// exportedEnv holds the value of non-secret envs, secrets only their preview
+type exportedEnv struct {
+	Key          string   `json:"key"`
+	Value        string   `json:"value,omitempty"`
+	IsSecret     bool     `json:"is_secret"`
+	ValuePreview string   `json:"value_preview,omitempty"`
+	Environments []string `json:"environments"`
+}
+
+// exportedFile is the metadata of a secret file, its content is write-only
+type exportedFile struct {
+	Path         string    `json:"path"`
+	Size         int       `json:"size"`
+	Environments []string  `json:"environments"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type exportedBuild struct {
+	ID          uint      `json:"id"`
+	Status      string    `json:"status"`
+	Platform    string    `json:"platform"`
+	Environment string    `json:"environment"`
+	Duration    int64     `json:"duration"`
+	LogsPurged  bool      `json:"logs_purged"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Export writes a zip archive of the personal data of the user: profile,
+// memberships, access tokens, sessions, invitations and personal projects
+// with their envs, files and builds
+func Export(ctx context.Context, w io.Writer, user db.User) error {
+	zw := zip.NewWriter(w)
+
+	profile := exportedProfile{
+		ID:              user.ID,
+		KeycloakID:      user.KeycloakID,
+		Username:        user.Username,
+		Email:           user.Email,
+		EmailVerified:   user.EmailVerified,
+		GithubConnected: user.GithubAccessToken != "",
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	}
+	kcUser, err := keycloak.Default.User(ctx, user.KeycloakID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Keycloak profile: %v", err)
+	}
+	profile.FirstName = gocloak.PString(kcUser.FirstName)
+	profile.LastName = gocloak.PString(kcUser.LastName)
+	if err := writeJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	var memberships []db.OrganizationMember
+	if err := db.DB.Preload("Organization").Where("user_id = ?", user.ID).Find(&memberships).Error; err != nil {
+		return err
+	}
+	organizations := make([]exportedMembership, 0, len(memberships))
+	for _, membership := range memberships {
+		m := exportedMembership{OrganizationID: membership.OrganizationID, Role: membership.Role, JoinedAt: membership.CreatedAt}
+		if membership.Organization != nil {
+			m.Organization = membership.Organization.Name
+		}
+		organizations = append(organizations, m)
+	}
+	if err := writeJSON(zw, "organizations.json", organizations); err != nil {
+		return err
+	}
+
+	var tokens []db.AccessToken
+	if err := db.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&tokens).Error; err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "access_tokens.json", tokens); err != nil {
+		return err
+	}
+
+	var sessions []db.LoginSession
+	if err := db.DB.Where("keycloak_id = ?", user.KeycloakID).Order("created_at").Find(&sessions).Error; err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "sessions.json", sessions); err != nil {
+		return err
+	}
+
+	var invitations []db.Invitation
+	if err := db.DB.Where("email = ? OR invited_by_id = ? OR accepted_by_id = ?", user.Email, user.ID, user.ID).Order("created_at").Find(&invitations).Error; err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "invitations.json", invitations); err != nil {
+		return err
+	}
+
+	var projects []db.Project
+	if err := db.DB.Where("user_id = ? AND organization_id IS NULL", user.ID).Order("id").Find(&projects).Error; err != nil {
+		return err
+	}
+	for _, project := range projects {
+		if err := exportProject(ctx, zw, project); err != nil {
+			return fmt.Errorf("failed to export project %d: %v", project.ID, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+func exportProject(ctx context.Context, zw *zip.Writer, project db.Project) error {
+	dir := fmt.Sprintf("projects/%d/", project.ID)
+	if err := writeJSON(zw, dir+"project.json", project); err != nil {
+		return err
+	}
+
+	var envs []db.Env
+	if err := db.DB.Preload("Environments").Where("project_id = ?", project.ID).Order("key").Find(&envs).Error; err != nil {
+		return err
+	}
+	exportedEnvs := make([]exportedEnv, 0, len(envs))
+	for _, env := range envs {
+		e := exportedEnv{Key: env.Key, IsSecret: env.IsSecret, Environments: environmentNames(env.Environments)}
+		if env.IsSecret {
+			e.ValuePreview = env.ValuePreview
+		} else {
+			value, err := secrets.DecryptEnv(db.DB, env)
+			if err != nil {
+				return err
+			}
+			e.Value = value
+		}
+		exportedEnvs = append(exportedEnvs, e)
+	}
+	if err := writeJSON(zw, dir+"envs.json", exportedEnvs); err != nil {
+		return err
+	}
+
+	var files []db.SecretFile
+	if err := db.DB.Preload("Environments").Where("project_id = ?", project.ID).Order("path").Find(&files).Error; err != nil {
+		return err
+	}
+	exportedFiles := make([]exportedFile, 0, len(files))
+	for _, file := range files {
+		exportedFiles = append(exportedFiles, exportedFile{
+			Path:         file.Path,
+			Size:         file.Size,
+			Environments: environmentNames(file.Environments),
+			UpdatedAt:    file.UpdatedAt,
+		})
+	}
+	if err := writeJSON(zw, dir+"files.json", exportedFiles); err != nil {
+		return err
+	}
+
+	var builds []db.Build
+	if err := db.DB.Where("project_id = ?", project.ID).Order("id").Find(&builds).Error; err != nil {
+		return err
+	}
+	exportedBuilds := make([]exportedBuild, 0, len(builds))
+	for _, build := range builds {
+		exportedBuilds = append(exportedBuilds, exportedBuild{
+			ID:          build.ID,
+			Status:      build.Status,
+			Platform:    build.Platform,
+			Environment: build.Environment,
+			Duration:    build.Duration,
+			LogsPurged:  build.LogsPurged,
+			CreatedAt:   build.CreatedAt,
+		})
+
+		lines, err := buildlog.Lines(ctx, build)
+		if errors.Is(err, buildlog.ErrLogsPurged) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create(fmt.Sprintf("%sbuilds/%d.log", dir, build.ID))
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if _, err := io.WriteString(f, line); err != nil {
+				return err
+			}
+		}
+	}
+	return writeJSON(zw, dir+"builds.json", exportedBuilds)
+}
+
+func environmentNames(environments []db.Environment) []string {
+	names := make([]string, 0, len(environments))
+	for _, environment := range environments {
+		names = append(names, environment.Name)
+	}
+	return names
+}
+
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
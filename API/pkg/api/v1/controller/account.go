@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/flotio-dev/api/pkg/account"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Password and email verification handlers
+
+// PasswordForgotHandler emails a password reset link. The response is the
+// same whether the email belongs to an account or not.
+func PasswordForgotHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var user db.User
+	if err := db.DB.Where("LOWER(email) = ?", strings.ToLower(strings.TrimSpace(body.Email))).Limit(1).Find(&user).Error; err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if user.ID != 0 {
+		token, err := account.Issue(db.DB, user, account.PasswordReset)
+		switch {
+		case errors.Is(err, account.ErrTooSoon):
+		case err != nil:
+			log.Printf("Failed to issue password reset token for user %d: %v", user.ID, err)
+		default:
+			if err := account.SendPasswordReset(r.Context(), mailer.Default, user, token); err != nil {
+				log.Printf("Failed to email password reset to user %d: %v", user.ID, err)
+			}
+		}
+	}
+
+	utils.WriteJSON(w, map[string]string{
+		"status":  "sent",
+		"message": "If an account uses this email, a password reset link was sent to it.",
+	})
+}
+
+// PasswordResetHandler sets a new password with the token of a reset link.
+// Every session of the user ends.
+func PasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if body.Token == "" || body.Password == "" {
+		http.Error(w, "Token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var user db.User
+	verified := false
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		emailToken, err := account.Consume(tx, body.Token, account.PasswordReset)
+		if err != nil {
+			return err
+		}
+		user = *emailToken.User
+		if err := keycloak.Default.SetPassword(ctx, user.KeycloakID, body.Password, false); err != nil {
+			return err
+		}
+
+		// Receiving the link proves the address belongs to the user
+		if !user.EmailVerified {
+			if err := tx.Model(&user).Update("email_verified", true).Error; err != nil {
+				return err
+			}
+			user.EmailVerified, verified = true, true
+			return keycloak.Default.UpdateUser(ctx, gocloak.User{ID: &user.KeycloakID, EmailVerified: gocloak.BoolP(true)})
+		}
+		return nil
+	})
+	if err != nil {
+		writeAccountTokenError(w, err, "Failed to reset password")
+		return
+	}
+	if verified {
+		AcceptPendingInvitations(ctx, user)
+	}
+
+	if err := keycloak.Default.LogoutUser(ctx, user.KeycloakID); err != nil {
+		log.Printf("Failed to end the sessions of user %d after a password reset: %v", user.ID, err)
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "reset"})
+}
+
+// PasswordChangeHandler changes the password of the caller, who must give
+// their current one
+func PasswordChangeHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if body.CurrentPassword == "" || body.NewPassword == "" {
+		http.Error(w, "Current and new passwords are required", http.StatusBadRequest)
+		return
+	}
+
+	client := utils.GetKeycloakClient()
+	ctx := context.Background()
+	realm := os.Getenv("KEYCLOAK_REALM")
+	clientID := os.Getenv("KEYCLOAK_CLIENT_ID")
+	clientSecret := os.Getenv("KEYCLOAK_CLIENT_SECRET")
+
+	// Checking the current password opens a session, closed right away
+	token, err := client.Login(ctx, clientID, clientSecret, realm, principal.Username, body.CurrentPassword)
+	if err != nil {
+		http.Error(w, "Current password is incorrect", http.StatusBadRequest)
+		return
+	}
+	if err := client.Logout(ctx, clientID, clientSecret, realm, token.RefreshToken); err != nil {
+		log.Printf("Failed to close the password check session of %s: %v", principal.Username, err)
+	}
+
+	if err := keycloak.Default.SetPassword(ctx, principal.KeycloakID, body.NewPassword, false); err != nil {
+		writeAccountTokenError(w, err, "Failed to change password")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "changed"})
+}
+
+// EmailVerifyHandler confirms an email address with the token of a
+// verification link
+func EmailVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var user db.User
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		emailToken, err := account.Consume(tx, body.Token, account.EmailVerification)
+		if err != nil {
+			return err
+		}
+		user = *emailToken.User
+		if err := tx.Model(&user).Update("email_verified", true).Error; err != nil {
+			return err
+		}
+		user.EmailVerified = true
+		return keycloak.Default.UpdateUser(ctx, gocloak.User{ID: &user.KeycloakID, EmailVerified: gocloak.BoolP(true)})
+	})
+	if err != nil {
+		writeAccountTokenError(w, err, "Failed to verify email")
+		return
+	}
+
+	// Join the organizations that invited this email address
+	AcceptPendingInvitations(ctx, user)
+
+	utils.WriteJSON(w, map[string]string{"status": "verified"})
+}
+
+// EmailVerificationPostHandler sends the verification link of the caller's
+// email again
+func EmailVerificationPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var user db.User
+	if err := db.DB.First(&user, principal.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendEmailVerification(r.Context(), user); err != nil {
+		if errors.Is(err, account.ErrTooSoon) {
+			http.Error(w, "A verification email was sent less than a minute ago", http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "Failed to send the verification email", http.StatusBadGateway)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "sent"})
+}
+
+// sendEmailVerification emails a verification link to the user's address
+func sendEmailVerification(ctx context.Context, user db.User) error {
+	token, err := account.Issue(db.DB, user, account.EmailVerification)
+	if err != nil {
+		return err
+	}
+	if err := account.SendEmailVerification(ctx, mailer.Default, user, token); err != nil {
+		log.Printf("Failed to email verification link to user %d: %v", user.ID, err)
+		return err
+	}
+	return nil
+}
+
+// emailVerificationRequired reports whether users must verify their email
+// before starting builds, REQUIRE_EMAIL_VERIFICATION=true
+func emailVerificationRequired() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+func writeAccountTokenError(w http.ResponseWriter, err error, message string) {
+	var policyErr *keycloak.PasswordPolicyError
+	switch {
+	case errors.Is(err, account.ErrInvalidToken):
+		http.Error(w, "Invalid or already used link", http.StatusBadRequest)
+	case errors.Is(err, account.ErrExpired):
+		http.Error(w, "The link has expired", http.StatusGone)
+	case errors.As(err, &policyErr):
+		http.Error(w, policyErr.Message, http.StatusBadRequest)
+	default:
+		log.Printf("%s: %v", message, err)
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
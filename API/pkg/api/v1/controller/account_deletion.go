@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/account"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Personal data export and account deletion handlers
+
+// MeExportHandler downloads a zip archive of the caller's personal data
+func MeExportHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var user db.User
+	if err := db.DB.First(&user, principal.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Buffered so a failure halfway still gets an error status
+	var buf bytes.Buffer
+	if err := account.Export(r.Context(), &buf, user); err != nil {
+		log.Printf("Failed to export the data of user %d: %v", user.ID, err)
+		http.Error(w, "Failed to export account data", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("flotio-%s-%s.zip", user.Username, time.Now().UTC().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
+
+// MeDeleteHandler schedules the deletion of the caller's account. It can be
+// cancelled until the grace period is over.
+func MeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var user db.User
+	if err := db.DB.First(&user, principal.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var deletion db.AccountDeletion
+	var owned []db.Organization
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		owned, err = account.SoleOwnerOrganizations(tx, user.ID)
+		if err != nil || len(owned) > 0 {
+			return err
+		}
+		deletion, err = account.ScheduleDeletion(tx, user)
+		return err
+	})
+	switch {
+	case errors.Is(err, account.ErrDeletionScheduled):
+		http.Error(w, "Account deletion already scheduled", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to schedule the deletion of user %d: %v", user.ID, err)
+		http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+		return
+	case len(owned) > 0:
+		names := make([]string, 0, len(owned))
+		for _, organization := range owned {
+			names = append(names, organization.Name)
+		}
+		http.Error(w, "Transfer the ownership of these organizations first: "+strings.Join(names, ", "), http.StatusConflict)
+		return
+	}
+
+	if err := account.SendDeletionScheduled(r.Context(), mailer.Default, user, deletion); err != nil {
+		log.Printf("Failed to email the deletion schedule to user %d: %v", user.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	utils.WriteJSON(w, deletion)
+}
+
+// MeDeletionGetHandler returns the pending deletion of the caller's account
+func MeDeletionGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	deletion, err := account.PendingDeletion(db.DB, principal.UserID)
+	if err != nil {
+		writeDeletionError(w, err, "Failed to fetch account deletion")
+		return
+	}
+
+	utils.WriteJSON(w, deletion)
+}
+
+// MeDeletionDeleteHandler cancels the pending deletion of the caller's
+// account
+func MeDeletionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	deletion, err := account.CancelDeletion(db.DB, principal.UserID)
+	if err != nil {
+		writeDeletionError(w, err, "Failed to cancel account deletion")
+		return
+	}
+
+	utils.WriteJSON(w, deletion)
+}
+
+func writeDeletionError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "No account deletion scheduled", http.StatusNotFound)
+		return
+	}
+	log.Printf("%s: %v", message, err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
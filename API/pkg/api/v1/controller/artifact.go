@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/storage"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+)
+
+// Build artifacts: the build pod uploads its output at the end of the
+// build, users download it afterwards
+
+// maxArtifactSize bounds the uploaded build outputs
+const maxArtifactSize = 1 << 30
+
+// generateUploadToken returns the token given to a build pod to upload its
+// artifact, and the hash stored on the build
+func generateUploadToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashUploadToken(token), nil
+}
+
+// hashUploadToken returns the stored form of an upload token
+func hashUploadToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func artifactKey(buildID uint, platform string) string {
+	return "artifacts/" + kubernetes.ArtifactFilename(buildID, platform)
+}
+
+// BuildArtifactUploadHandler stores the output of a running build. It is
+// called by the build pod with the upload token of the build, which can only
+// be used once.
+func BuildArtifactUploadHandler(w http.ResponseWriter, r *http.Request) {
+	buildID, err := strconv.Atoi(mux.Vars(r)["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "Missing upload token", http.StatusUnauthorized)
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.First(&build, buildID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Invalid upload token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+	hash := hashUploadToken(token)
+	if build.UploadTokenHash == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(build.UploadTokenHash)) != 1 {
+		http.Error(w, "Invalid upload token", http.StatusUnauthorized)
+		return
+	}
+	if build.Status != "running" {
+		http.Error(w, "Build is not running", http.StatusConflict)
+		return
+	}
+
+	if r.ContentLength > maxArtifactSize {
+		http.Error(w, "Artifact too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key := artifactKey(build.ID, build.Platform)
+	body := http.MaxBytesReader(w, r.Body, maxArtifactSize)
+	if err := storage.Artifacts.Put(r.Context(), key, body); err != nil {
+		log.Printf("Failed to store the artifact of build %d: %v", build.ID, err)
+		http.Error(w, "Failed to store artifact", http.StatusInternalServerError)
+		return
+	}
+
+	res := db.DB.Model(&db.Build{}).Where("id = ? AND upload_token_hash = ?", build.ID, hash).
+		Updates(map[string]interface{}{"artifact_key": key, "upload_token_hash": ""})
+	if res.Error != nil {
+		http.Error(w, "Failed to update build", http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		http.Error(w, "Invalid upload token", http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BuildDownloadHandler downloads the artifact uploaded by a build
+func BuildDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildRead)
+	if !ok {
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.Where("id = ? AND project_id = ?", buildID, project.ID).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+	if build.ArtifactKey == "" {
+		http.Error(w, "Build has no artifact", http.StatusNotFound)
+		return
+	}
+
+	obj, err := storage.Artifacts.Get(r.Context(), build.ArtifactKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Build has no artifact", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	filename := kubernetes.ArtifactFilename(build.ID, build.Platform)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	io.Copy(w, obj)
+}
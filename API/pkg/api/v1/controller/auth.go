@@ -3,83 +3,96 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/Nerzal/gocloak/v13"
 	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/githubauth"
+	"github.com/flotio-dev/api/pkg/keycloak"
 	utils "github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
 )
 
-func getAdminToken(ctx context.Context, client *gocloak.GoCloak) (*gocloak.JWT, error) {
-	return client.LoginAdmin(ctx, "admin", "admin", "master")
-}
-
-// seededRand is a package-level RNG seeded once
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
-
-// genRandomName returns a realistic-looking first and last name.
-// It picks randomly from small predefined lists; this keeps tests stable
-// and avoids adding external resources.
-func genRandomName() (first, last string) {
-	firstNames := []string{
-		"Alice", "Bob", "Caroline", "David", "Emma", "Frank", "Grace", "Hugo", "Iris", "Julien",
-		"Lucas", "Maya", "Noah", "Olivia", "Paul", "Quentin", "Romain", "Sophie", "Thomas", "Victor",
-	}
-	lastNames := []string{
-		"Martin", "Bernard", "Dubois", "Leroy", "Moreau", "Faure", "Rousseau", "Garnier", "Laurent", "Petit",
-		"Lambert", "Dupont", "Simon", "Michel", "Garcia", "David", "Bertrand", "Morel", "Robin", "Leclerc",
-	}
-
-	first = firstNames[seededRand.Intn(len(firstNames))]
-	last = lastNames[seededRand.Intn(len(lastNames))]
-	return
-}
-
 // Auth handlers
+
+// RegisterHandler creates the account in Keycloak and in the database. Each
+// step undoes the previous ones when it fails, so a failed registration
+// leaves no orphan Keycloak user and can be retried.
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var userData struct {
-		Username string `json:"username"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Username  string `json:"username"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	userData.Username = strings.ToLower(strings.TrimSpace(userData.Username))
+	userData.FirstName = strings.TrimSpace(userData.FirstName)
+	userData.LastName = strings.TrimSpace(userData.LastName)
+	if userData.Username == "" || userData.Password == "" {
+		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(userData.Email))
+	if err != nil || address.Name != "" {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	userData.Email = strings.ToLower(address.Address)
+	if userData.FirstName == "" || userData.LastName == "" {
+		http.Error(w, "First and last name are required", http.StatusBadRequest)
+		return
+	}
 
-	client := utils.GetKeycloakClient()
 	ctx := context.Background()
-	token, err := getAdminToken(ctx, client)
+
+	// Reject known duplicates before touching Keycloak
+	var existing db.User
+	err = db.DB.Where("LOWER(email) = ? OR LOWER(username) = ?", userData.Email, userData.Username).Limit(1).Find(&existing).Error
 	if err != nil {
-		http.Error(w, "Failed to authenticate with Keycloak", http.StatusInternalServerError)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if existing.ID != 0 {
+		if strings.EqualFold(existing.Email, userData.Email) {
+			http.Error(w, "Email already registered", http.StatusConflict)
+		} else {
+			http.Error(w, "Username already taken", http.StatusConflict)
+		}
 		return
 	}
-
-	realm := os.Getenv("KEYCLOAK_REALM")
 
 	// Create user
 	// Ensure required actions are empty so the account is considered fully set up
 	// (avoids Keycloak returning "Account is not fully set up" on direct grant)
 	requiredActions := []string{}
-	firstName, lastName := genRandomName()
 	user := &gocloak.User{
 		Username:        &userData.Username,
 		Email:           &userData.Email,
-		FirstName:       gocloak.StringP(firstName),
-		LastName:        gocloak.StringP(lastName),
+		FirstName:       &userData.FirstName,
+		LastName:        &userData.LastName,
 		Enabled:         gocloak.BoolP(true),
-		EmailVerified:   gocloak.BoolP(true),
+		EmailVerified:   gocloak.BoolP(false),
 		RequiredActions: &requiredActions,
 	}
-	userID, err := client.CreateUser(ctx, token.AccessToken, realm, *user)
+	userID, err := keycloak.Default.CreateUser(ctx, *user)
 	if err != nil {
+		if errors.Is(err, keycloak.ErrConflict) {
+			http.Error(w, "Username or email already registered", http.StatusConflict)
+			return
+		}
 		log.Printf("CreateUser failed for %s: %v", userData.Username, err)
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
@@ -87,8 +100,15 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Created Keycloak user: %s (username=%s)", userID, userData.Username)
 
 	// Set password
-	err = client.SetPassword(ctx, token.AccessToken, userID, realm, userData.Password, false)
+	err = keycloak.Default.SetPassword(ctx, userID, userData.Password, false)
 	if err != nil {
+		deleteKeycloakUser(userID)
+		var policyErr *keycloak.PasswordPolicyError
+		if errors.As(err, &policyErr) {
+			http.Error(w, policyErr.Message, http.StatusBadRequest)
+			return
+		}
+		log.Printf("SetPassword failed for %s: %v", userData.Username, err)
 		http.Error(w, "Failed to set password", http.StatusInternalServerError)
 		return
 	}
@@ -100,11 +120,22 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		Username:   userData.Username,
 	}
 	if err := db.DB.Create(&dbUser).Error; err != nil {
+		deleteKeycloakUser(userID)
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			http.Error(w, "Email already registered", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Failed to create user in database", http.StatusInternalServerError)
 		return
 	}
 
+	// The user can ask for the link again if it fails. Verifying the
+	// address joins the organizations that invited it.
+	sendEmailVerification(ctx, dbUser)
+
 	// After successful registration, perform a direct login to return the same response as LoginHandler
+	client := utils.GetKeycloakClient()
+	realm := os.Getenv("KEYCLOAK_REALM")
 	clientID := os.Getenv("KEYCLOAK_CLIENT_ID")
 	clientSecret := os.Getenv("KEYCLOAK_CLIENT_SECRET")
 
@@ -115,6 +146,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		utils.WriteJSON(w, map[string]string{"status": "registered", "message": "User registered successfully. Please login."})
 		return
 	}
+	recordLoginSession(r, tokenResp)
 
 	utils.WriteJSON(w, map[string]string{
 		"access_token":  tokenResp.AccessToken,
@@ -123,6 +155,14 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// deleteKeycloakUser compensates a registration step that failed after the
+// Keycloak user was created
+func deleteKeycloakUser(userID string) {
+	if err := keycloak.Default.DeleteUser(context.Background(), userID); err != nil {
+		log.Printf("Failed to delete Keycloak user %s after a failed registration: %v", userID, err)
+	}
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds struct {
 		Username string `json:"username"`
@@ -147,6 +187,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	recordLoginSession(r, token)
 
 	utils.WriteJSON(w, map[string]string{
 		"access_token":  token.AccessToken,
@@ -184,76 +225,184 @@ func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// MeGetHandler returns the profile of the caller: Keycloak and local
+// account, preferences, GitHub link, organizations and usage
 func MeGetHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	principal := middleware.GetPrincipal(r.Context())
+
+	profile, err := buildProfile(r.Context(), principal)
+	if err != nil {
+		log.Printf("Failed to build the profile of user %d: %v", principal.UserID, err)
+		http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
 		return
 	}
 
-	utils.WriteJSON(w, userInfo)
+	utils.WriteJSON(w, profile)
 }
 
+// MePutHandler updates the fields of the caller's profile present in the
+// body. Names, username and email are changed in Keycloak first, the
+// avatar and preferences are only stored locally.
 func MePutHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	var updateData struct {
-		Email    *string `json:"email,omitempty"`
-		Username *string `json:"username,omitempty"`
+		Email       *string `json:"email,omitempty"`
+		Username    *string `json:"username,omitempty"`
+		FirstName   *string `json:"first_name,omitempty"`
+		LastName    *string `json:"last_name,omitempty"`
+		AvatarURL   *string `json:"avatar_url,omitempty"`
+		Preferences *struct {
+			Locale        *string `json:"locale,omitempty"`
+			Notifications *struct {
+				BuildFailed    *bool `json:"build_failed,omitempty"`
+				BuildSucceeded *bool `json:"build_succeeded,omitempty"`
+				ProductUpdates *bool `json:"product_updates,omitempty"`
+			} `json:"notifications,omitempty"`
+		} `json:"preferences,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	client := utils.GetKeycloakClient()
-	ctx := context.Background()
-	realm := os.Getenv("KEYCLOAK_REALM")
-
-	adminToken, err := getAdminToken(ctx, client)
-	if err != nil {
-		http.Error(w, "Failed to authenticate with Keycloak", http.StatusInternalServerError)
+	var dbUser db.User
+	if err := db.DB.First(&dbUser, principal.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	// Update user
-	userUpdate := &gocloak.User{
-		ID:       userInfo.Sub,
-		Email:    updateData.Email,
-		Username: updateData.Username,
+	// Same normalization as registration
+	if updateData.Email != nil {
+		address, err := mail.ParseAddress(strings.TrimSpace(*updateData.Email))
+		if err != nil || address.Name != "" {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		email := strings.ToLower(address.Address)
+		updateData.Email = &email
 	}
-	err = client.UpdateUser(ctx, adminToken.AccessToken, realm, *userUpdate)
-	if err != nil {
-		http.Error(w, "Failed to update user", http.StatusInternalServerError)
-		return
+	if updateData.Username != nil {
+		username := strings.ToLower(strings.TrimSpace(*updateData.Username))
+		if username == "" {
+			http.Error(w, "Username cannot be empty", http.StatusBadRequest)
+			return
+		}
+		updateData.Username = &username
+	}
+	for _, name := range []*string{updateData.FirstName, updateData.LastName} {
+		if name == nil {
+			continue
+		}
+		*name = strings.TrimSpace(*name)
+		if *name == "" {
+			http.Error(w, "First and last name cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+	if updateData.AvatarURL != nil {
+		*updateData.AvatarURL = strings.TrimSpace(*updateData.AvatarURL)
+		if !validAvatarURL(*updateData.AvatarURL) {
+			http.Error(w, "Avatar must be an http(s) URL", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Persist changes to local DB as well (e.g., email)
-	var dbUser db.User
-	if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&dbUser).Error; err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	// Columns of the local user to save
+	var changes []string
+	if updateData.AvatarURL != nil {
+		dbUser.AvatarURL = *updateData.AvatarURL
+		changes = append(changes, "avatar_url")
+	}
+	if p := updateData.Preferences; p != nil {
+		preferences := dbUser.EffectivePreferences()
+		if p.Locale != nil {
+			if !localePattern.MatchString(*p.Locale) {
+				http.Error(w, "Invalid locale", http.StatusBadRequest)
+				return
+			}
+			preferences.Locale = *p.Locale
+		}
+		if n := p.Notifications; n != nil {
+			if n.BuildFailed != nil {
+				preferences.Notifications.BuildFailed = *n.BuildFailed
+			}
+			if n.BuildSucceeded != nil {
+				preferences.Notifications.BuildSucceeded = *n.BuildSucceeded
+			}
+			if n.ProductUpdates != nil {
+				preferences.Notifications.ProductUpdates = *n.ProductUpdates
+			}
+		}
+		dbUser.Preferences = &preferences
+		changes = append(changes, "preferences")
+	}
+
+	ctx := context.Background()
+
+	// A new email must be verified again
+	emailChanged := updateData.Email != nil && *updateData.Email != strings.ToLower(dbUser.Email)
+
+	if updateData.Email != nil || updateData.Username != nil || updateData.FirstName != nil || updateData.LastName != nil {
+		userUpdate := gocloak.User{
+			ID:        &principal.KeycloakID,
+			Email:     updateData.Email,
+			Username:  updateData.Username,
+			FirstName: updateData.FirstName,
+			LastName:  updateData.LastName,
+		}
+		if emailChanged {
+			userUpdate.EmailVerified = gocloak.BoolP(false)
+		}
+		if err := keycloak.Default.UpdateUser(ctx, userUpdate); err != nil {
+			if errors.Is(err, keycloak.ErrConflict) {
+				http.Error(w, "Email or username already used by another account", http.StatusConflict)
+				return
+			}
+			log.Printf("Failed to update Keycloak user %s: %v", principal.KeycloakID, err)
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	if updateData.Email != nil {
 		dbUser.Email = *updateData.Email
+		changes = append(changes, "email")
+	}
+	if emailChanged {
+		dbUser.EmailVerified = false
+		changes = append(changes, "email_verified")
 	}
-	// Note: first/last name are stored in Keycloak; update local username only if desired.
 	if updateData.Username != nil {
-		// Optionally update username from first name if the app uses it; keep current username by default.
 		dbUser.Username = *updateData.Username
+		changes = append(changes, "username")
 	}
 
-	if err := db.DB.Save(&dbUser).Error; err != nil {
-		http.Error(w, "Failed to update user in database", http.StatusInternalServerError)
+	if len(changes) > 0 {
+		// Struct update so the preferences go through their JSON serializer
+		if err := db.DB.Model(&dbUser).Select(changes).Updates(&dbUser).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				http.Error(w, "Email already registered", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to update user in database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if emailChanged {
+		// The user can ask for the link again if it fails
+		sendEmailVerification(ctx, dbUser)
+	}
+
+	profile, err := buildProfile(r.Context(), principal)
+	if err != nil {
+		log.Printf("Failed to build the profile of user %d: %v", principal.UserID, err)
+		http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
 		return
 	}
 
-	utils.WriteJSON(w, map[string]string{"status": "updated"})
+	utils.WriteJSON(w, profile)
 }
 
 func GithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
@@ -271,11 +420,7 @@ func GithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GithubHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	action := r.URL.Query().Get("action")
 	switch action {
@@ -300,48 +445,28 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Exchange code for tokens
-		clientID := os.Getenv("GITHUB_CLIENT_ID")
-		clientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
-		if clientID == "" || clientSecret == "" {
+		token, err := githubauth.Exchange(r.Context(), code)
+		switch {
+		case errors.Is(err, githubauth.ErrNotConfigured):
 			http.Error(w, "GitHub client not configured", http.StatusInternalServerError)
 			return
-		}
-
-		// Make request to GitHub to exchange code for tokens
-		tokenURL := "https://github.com/login/oauth/access_token"
-		data := url.Values{}
-		data.Set("client_id", clientID)
-		data.Set("client_secret", clientSecret)
-		data.Set("code", code)
-
-		resp, err := http.PostForm(tokenURL, data)
-		if err != nil {
-			http.Error(w, "Failed to exchange code", http.StatusInternalServerError)
+		case errors.Is(err, githubauth.ErrReconnect):
+			http.Error(w, "Invalid or expired code", http.StatusBadRequest)
 			return
-		}
-		defer resp.Body.Close()
-
-		var tokenResp struct {
-			AccessToken  string `json:"access_token"`
-			TokenType    string `json:"token_type"`
-			Scope        string `json:"scope"`
-			RefreshToken string `json:"refresh_token,omitempty"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-			http.Error(w, "Failed to parse token response", http.StatusInternalServerError)
+		case err != nil:
+			log.Printf("Failed to exchange GitHub code: %v", err)
+			http.Error(w, "Failed to exchange code", http.StatusBadGateway)
 			return
 		}
 
-		// Store tokens in DB
+		// Store tokens in DB, encrypted
 		var user db.User
-		if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&user).Error; err != nil {
+		if err := db.DB.First(&user, principal.UserID).Error; err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
-
-		user.GithubAccessToken = tokenResp.AccessToken
-		user.GithubRefreshToken = tokenResp.RefreshToken
-		if err := db.DB.Save(&user).Error; err != nil {
+		if err := githubauth.Store(db.DB, &user, token); err != nil {
+			log.Printf("Failed to save the GitHub tokens of user %d: %v", user.ID, err)
 			http.Error(w, "Failed to save tokens", http.StatusInternalServerError)
 			return
 		}
@@ -350,14 +475,8 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 
 	case "list-repo":
 		// Get user's GitHub repos using stored token
-		var user db.User
-		if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&user).Error; err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-
-		if user.GithubAccessToken == "" {
-			http.Error(w, "GitHub not connected", http.StatusUnauthorized)
+		accessToken, ok := githubAccessToken(w, r, principal.UserID)
+		if !ok {
 			return
 		}
 
@@ -367,7 +486,7 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
-		req.Header.Set("Authorization", "token "+user.GithubAccessToken)
+		req.Header.Set("Authorization", "token "+accessToken)
 		req.Header.Set("Accept", "application/vnd.github.v3+json")
 
 		client := &http.Client{}
@@ -394,14 +513,8 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Get user's GitHub token
-		var user db.User
-		if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&user).Error; err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-
-		if user.GithubAccessToken == "" {
-			http.Error(w, "GitHub not connected", http.StatusUnauthorized)
+		accessToken, ok := githubAccessToken(w, r, principal.UserID)
+		if !ok {
 			return
 		}
 
@@ -412,7 +525,7 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
-		req.Header.Set("Authorization", "token "+user.GithubAccessToken)
+		req.Header.Set("Authorization", "token "+accessToken)
 		req.Header.Set("Accept", "application/vnd.github.v3+json")
 
 		client := &http.Client{}
@@ -445,3 +558,51 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid action", http.StatusBadRequest)
 	}
 }
+
+// GithubDeleteHandler disconnects GitHub: the grant of the app is revoked at
+// GitHub and the caller's tokens are deleted
+func GithubDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var user db.User
+	if err := db.DB.First(&user, principal.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.GithubAccessToken == "" {
+		http.Error(w, "GitHub not connected", http.StatusNotFound)
+		return
+	}
+
+	if err := githubauth.Disconnect(r.Context(), &user); err != nil {
+		if errors.Is(err, githubauth.ErrNotConfigured) {
+			http.Error(w, "GitHub client not configured", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Failed to disconnect GitHub for user %d: %v", user.ID, err)
+		http.Error(w, "Failed to revoke the GitHub authorization", http.StatusBadGateway)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "disconnected"})
+}
+
+// githubAccessToken returns the caller's GitHub access token, refreshed when
+// it expires soon, or writes the error response
+func githubAccessToken(w http.ResponseWriter, r *http.Request, userID uint) (string, bool) {
+	accessToken, err := githubauth.AccessToken(r.Context(), userID)
+	switch {
+	case errors.Is(err, githubauth.ErrNotConnected):
+		http.Error(w, "GitHub not connected", http.StatusUnauthorized)
+	case errors.Is(err, githubauth.ErrReconnect):
+		http.Error(w, "GitHub authorization expired, connect GitHub again", http.StatusUnauthorized)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case err != nil:
+		log.Printf("Failed to get the GitHub token of user %d: %v", userID, err)
+		http.Error(w, "Failed to get GitHub token", http.StatusInternalServerError)
+	default:
+		return accessToken, true
+	}
+	return "", false
+}
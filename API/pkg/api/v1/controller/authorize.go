@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/policy"
+)
+
+// authorizeProject loads the project if the principal may perform action on
+// it, writing the error response otherwise
+func authorizeProject(w http.ResponseWriter, principal *auth.Principal, projectID int, action policy.Action) (db.Project, bool) {
+	project, err := policy.Project(db.DB, principal.UserID, uint(projectID), action)
+	if err != nil {
+		writePolicyError(w, err, "Project")
+		return project, false
+	}
+	return project, true
+}
+
+// authorizeOrganization loads the organization if the principal may perform
+// action on it, writing the error response otherwise
+func authorizeOrganization(w http.ResponseWriter, principal *auth.Principal, organizationID int, action policy.Action) (db.Organization, bool) {
+	organization, err := policy.Organization(db.DB, principal.UserID, uint(organizationID), action)
+	if err != nil {
+		writePolicyError(w, err, "Organization")
+		return organization, false
+	}
+	return organization, true
+}
+
+func writePolicyError(w http.ResponseWriter, err error, resource string) {
+	switch {
+	case errors.Is(err, policy.ErrNotFound):
+		http.Error(w, resource+" not found", http.StatusNotFound)
+	case errors.Is(err, policy.ErrForbidden):
+		http.Error(w, "Your role does not allow this action", http.StatusForbidden)
+	default:
+		http.Error(w, "Failed to fetch "+strings.ToLower(resource), http.StatusInternalServerError)
+	}
+}
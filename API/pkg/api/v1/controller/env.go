@@ -1,10 +1,15 @@
 package controller
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/envfile"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/secrets"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 
@@ -14,11 +19,7 @@ import (
 
 // Env handlers
 func EnvGetHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -27,20 +28,49 @@ func EnvGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvRead)
+	if !ok {
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		exportEnvs(w, r, project, format)
+		return
+	}
+
+	query := db.DB.Preload("Environments").Where("project_id = ?", project.ID)
+
+	// Optionally keep only the envs a build in this environment would get
+	if name := r.URL.Query().Get("environment"); name != "" {
+		var environment db.Environment
+		if err := db.DB.Where("project_id = ? AND name = ?", project.ID, name).First(&environment).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				http.Error(w, "Environment not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+			return
+		}
+		query = query.Scopes(db.InEnvironment(environment.ID))
+	}
+
 	var envs []db.Env
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).Find(&envs).Error; err != nil {
+	if err := query.Find(&envs).Error; err != nil {
 		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
 		return
 	}
 
+	for i := range envs {
+		if err := revealEnv(&envs[i]); err != nil {
+			http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	utils.WriteJSON(w, map[string]interface{}{"envs": envs})
 }
 func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -50,45 +80,85 @@ func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
+		Key          string   `json:"key"`
+		Value        string   `json:"value"`
+		IsSecret     bool     `json:"is_secret"`
+		Environments []string `json:"environments,omitempty"` // empty applies to every environment
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if !envfile.ValidKey(req.Key) {
+		http.Error(w, "Invalid env key", http.StatusBadRequest)
+		return
+	}
 
-	// Verify project ownership
-	var project db.Project
-	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).First(&project).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Project not found", http.StatusNotFound)
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvWrite)
+	if !ok {
+		return
+	}
+
+	environments, err := findEnvironments(project.ID, req.Environments)
+	if err != nil {
+		if errors.Is(err, errUnknownEnvironment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
 		return
 	}
 
-	env := db.Env{
-		ProjectID: project.ID,
-		Key:       req.Key,
-		Value:     req.Value,
+	taken, err := envKeyTaken(db.DB, project.ID, req.Key, environments, 0)
+	if err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Env key already exists in this environment", http.StatusConflict)
+		return
 	}
 
-	if err := db.DB.Create(&env).Error; err != nil {
+	env := db.Env{
+		ProjectID:    project.ID,
+		Key:          req.Key,
+		IsSecret:     req.IsSecret,
+		Environments: environments,
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// Encrypted first so that the data key is locked before the rows
+		// rotation re-encrypts
+		if err := setEnvValue(tx, &env, req.Value, principal.KeycloakID); err != nil {
+			return err
+		}
+		if err := ensureEnvBaseline(tx, project.ID); err != nil {
+			return err
+		}
+		if err := tx.Create(&env).Error; err != nil {
+			return err
+		}
+		change, err := newEnvChange(tx, "created", nil, &env)
+		if err != nil {
+			return err
+		}
+		_, err = recordEnvRevision(tx, project.ID, principal.KeycloakID, "api", nil, []db.EnvChange{change})
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to create env", http.StatusInternalServerError)
 		return
 	}
 
+	if err := revealEnv(&env); err != nil {
+		http.Error(w, "Failed to decrypt env", http.StatusInternalServerError)
+		return
+	}
+
 	utils.WriteJSON(w, map[string]interface{}{"env": env})
 }
 
 func EnvGetByIdHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -103,8 +173,13 @@ func EnvGetByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvRead)
+	if !ok {
+		return
+	}
+
 	var env db.Env
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("envs.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", envID, projectID, *userInfo.Sub).First(&env).Error; err != nil {
+	if err := db.DB.Preload("Environments").Where("id = ? AND project_id = ?", envID, project.ID).First(&env).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			http.Error(w, "Env not found", http.StatusNotFound)
 			return
@@ -113,15 +188,16 @@ func EnvGetByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := revealEnv(&env); err != nil {
+		http.Error(w, "Failed to decrypt env", http.StatusInternalServerError)
+		return
+	}
+
 	utils.WriteJSON(w, map[string]interface{}{"env": env})
 }
 
 func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -136,17 +212,25 @@ func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Value is optional so a secret can be renamed without resending it
 	var req struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
+		Key          string    `json:"key"`
+		Value        *string   `json:"value,omitempty"`
+		IsSecret     *bool     `json:"is_secret,omitempty"`
+		Environments *[]string `json:"environments,omitempty"`
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvWrite)
+	if !ok {
+		return
+	}
+
 	var env db.Env
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("envs.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", envID, projectID, *userInfo.Sub).First(&env).Error; err != nil {
+	if err := db.DB.Preload("Environments").Where("id = ? AND project_id = ?", envID, project.ID).First(&env).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			http.Error(w, "Env not found", http.StatusNotFound)
 			return
@@ -154,24 +238,87 @@ func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to fetch env", http.StatusInternalServerError)
 		return
 	}
+	before := env
+
+	if req.IsSecret != nil {
+		// Turning a secret back into a plain env would make it readable
+		if env.IsSecret && !*req.IsSecret && req.Value == nil {
+			http.Error(w, "A new value is required to make a secret env readable", http.StatusBadRequest)
+			return
+		}
+		env.IsSecret = *req.IsSecret
+	}
+	if req.Key != "" {
+		if !envfile.ValidKey(req.Key) {
+			http.Error(w, "Invalid env key", http.StatusBadRequest)
+			return
+		}
+		env.Key = req.Key
+	}
 
-	env.Key = req.Key
-	env.Value = req.Value
+	environments := env.Environments
+	if req.Environments != nil {
+		environments, err = findEnvironments(env.ProjectID, *req.Environments)
+		if err != nil {
+			if errors.Is(err, errUnknownEnvironment) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if err := db.DB.Save(&env).Error; err != nil {
+	taken, err := envKeyTaken(db.DB, env.ProjectID, env.Key, environments, env.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Env key already exists in this environment", http.StatusConflict)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.Value != nil {
+			if err := setEnvValue(tx, &env, *req.Value, principal.KeycloakID); err != nil {
+				return err
+			}
+		}
+		if err := ensureEnvBaseline(tx, env.ProjectID); err != nil {
+			return err
+		}
+		if err := tx.Omit("Environments").Save(&env).Error; err != nil {
+			return err
+		}
+		if req.Environments != nil {
+			if err := tx.Model(&env).Association("Environments").Replace(environments); err != nil {
+				return err
+			}
+		}
+		env.Environments = environments
+		change, err := newEnvChange(tx, "updated", &before, &env)
+		if err != nil {
+			return err
+		}
+		_, err = recordEnvRevision(tx, env.ProjectID, principal.KeycloakID, "api", nil, []db.EnvChange{change})
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to update env", http.StatusInternalServerError)
 		return
 	}
 
+	if err := revealEnv(&env); err != nil {
+		http.Error(w, "Failed to decrypt env", http.StatusInternalServerError)
+		return
+	}
+
 	utils.WriteJSON(w, map[string]interface{}{"env": env})
 }
 
 func EnvDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -186,10 +333,89 @@ func EnvDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("envs.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", envID, projectID, *userInfo.Sub).Delete(&db.Env{}).Error; err != nil {
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvWrite)
+	if !ok {
+		return
+	}
+
+	var env db.Env
+	if err := db.DB.Preload("Environments").Where("id = ? AND project_id = ?", envID, project.ID).First(&env).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Env not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch env", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := ensureEnvBaseline(tx, env.ProjectID); err != nil {
+			return err
+		}
+		if err := tx.Model(&env).Association("Environments").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Delete(&env).Error; err != nil {
+			return err
+		}
+		change, err := newEnvChange(tx, "deleted", &env, nil)
+		if err != nil {
+			return err
+		}
+		_, err = recordEnvRevision(tx, env.ProjectID, principal.KeycloakID, "api", nil, []db.EnvChange{change})
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to delete env", http.StatusInternalServerError)
 		return
 	}
 
 	utils.WriteJSON(w, map[string]string{"status": "deleted"})
 }
+
+// setEnvValue encrypts value into env and records who changed it
+func setEnvValue(tx *gorm.DB, env *db.Env, value string, keycloakID string) error {
+	if err := secrets.EncryptEnv(tx, env, value); err != nil {
+		return err
+	}
+	env.ValuePreview = secrets.Mask(value)
+	env.ValueUpdatedAt = time.Now()
+	env.ValueUpdatedByID = nil
+
+	var user db.User
+	if err := tx.Where("keycloak_id = ?", keycloakID).First(&user).Error; err == nil {
+		env.ValueUpdatedByID = &user.ID
+	}
+	return nil
+}
+
+// envKeyTaken reports whether another env of the project already uses key in
+// one of the environments, or unscoped when environments is empty
+func envKeyTaken(tx *gorm.DB, projectID uint, key string, environments []db.Environment, excludeID uint) (bool, error) {
+	var others []db.Env
+	if err := tx.Preload("Environments").Where("project_id = ? AND key = ? AND id <> ?", projectID, key, excludeID).Find(&others).Error; err != nil {
+		return false, err
+	}
+
+	for _, other := range others {
+		if overlappingEnvironments(other.Environments, environments) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// revealEnv decrypts the value of a plain env for the response. Secret envs
+// are write-only and keep only their masked preview.
+func revealEnv(env *db.Env) error {
+	if env.IsSecret {
+		env.PlainValue = ""
+		return nil
+	}
+	value, err := secrets.DecryptEnv(db.DB, *env)
+	if err != nil {
+		return err
+	}
+	env.PlainValue = value
+	return nil
+}
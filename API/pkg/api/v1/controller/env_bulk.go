@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/envfile"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// maxEnvFileSize bounds the body of a bulk import
+const maxEnvFileSize = 1 << 20
+
+// envDiff lists the keys touched by a bulk import
+type envDiff struct {
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// EnvsPutHandler imports a whole set of envs from a .env, JSON or YAML body.
+//
+// Query parameters:
+//   - mode: "merge" (default) adds and updates keys, "replace" also deletes
+//     the envs missing from the file
+//   - environment: scope the imported envs to this environment only, the
+//     unscoped envs are targeted otherwise
+//   - secret: create the new envs as secrets
+//   - dry_run: only return the diff
+//   - format: dotenv, json or yaml, guessed from Content-Type when missing
+func EnvsPutHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, "Invalid mode, expected merge or replace", http.StatusBadRequest)
+		return
+	}
+	dryRun := query.Get("dry_run") == "true"
+	secret := query.Get("secret") == "true"
+	format := query.Get("format")
+	if format == "" {
+		format = envfile.FormatFromContentType(r.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEnvFileSize+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxEnvFileSize {
+		http.Error(w, "Env file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	values, err := envfile.Parse(format, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvWrite)
+	if !ok {
+		return
+	}
+
+	var environments []db.Environment
+	if name := query.Get("environment"); name != "" {
+		environments, err = findEnvironments(project.ID, []string{name})
+		if err != nil {
+			if errors.Is(err, errUnknownEnvironment) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var envs []db.Env
+	if err := db.DB.Preload("Environments").Where("project_id = ?", project.ID).Find(&envs).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+
+	// The targeted set is the envs scoped exactly like the import. Envs
+	// sharing a key with the import in an overlapping scope are conflicts.
+	target := map[string]db.Env{}
+	var conflicts []string
+	for _, env := range envs {
+		if sameEnvironments(env.Environments, environments) {
+			target[env.Key] = env
+			continue
+		}
+		if _, imported := values[env.Key]; imported && overlappingEnvironments(env.Environments, environments) {
+			conflicts = append(conflicts, env.Key)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		http.Error(w, "Keys already defined in an overlapping environment: "+strings.Join(conflicts, ", "), http.StatusConflict)
+		return
+	}
+
+	diff := envDiff{Added: []string{}, Updated: []string{}, Removed: []string{}, Unchanged: []string{}}
+	for key, value := range values {
+		env, exists := target[key]
+		if !exists {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+		current, err := secrets.DecryptEnv(db.DB, env)
+		if err != nil {
+			http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+			return
+		}
+		if current == value {
+			diff.Unchanged = append(diff.Unchanged, key)
+		} else {
+			diff.Updated = append(diff.Updated, key)
+		}
+	}
+	if mode == "replace" {
+		for key := range target {
+			if _, imported := values[key]; !imported {
+				diff.Removed = append(diff.Removed, key)
+			}
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Updated)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Unchanged)
+
+	if dryRun {
+		utils.WriteJSON(w, map[string]interface{}{"dry_run": true, "diff": diff})
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := ensureEnvBaseline(tx, project.ID); err != nil {
+			return err
+		}
+
+		var changes []db.EnvChange
+		for _, key := range diff.Added {
+			env := db.Env{
+				ProjectID:    project.ID,
+				Key:          key,
+				IsSecret:     secret,
+				Environments: environments,
+			}
+			if err := setEnvValue(tx, &env, values[key], principal.KeycloakID); err != nil {
+				return err
+			}
+			if err := tx.Create(&env).Error; err != nil {
+				return err
+			}
+			change, err := newEnvChange(tx, "created", nil, &env)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		for _, key := range diff.Updated {
+			before := target[key]
+			env := before
+			if err := setEnvValue(tx, &env, values[key], principal.KeycloakID); err != nil {
+				return err
+			}
+			if err := tx.Omit("Environments").Save(&env).Error; err != nil {
+				return err
+			}
+			change, err := newEnvChange(tx, "updated", &before, &env)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		for _, key := range diff.Removed {
+			env := target[key]
+			if err := tx.Model(&env).Association("Environments").Clear(); err != nil {
+				return err
+			}
+			if err := tx.Delete(&env).Error; err != nil {
+				return err
+			}
+			change, err := newEnvChange(tx, "deleted", &env, nil)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+		_, err := recordEnvRevision(tx, project.ID, principal.KeycloakID, "import", nil, changes)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to import envs", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"dry_run": false, "diff": diff})
+}
+
+// exportEnvs writes the envs a build in the requested environment (the
+// default one when missing) would receive, secret values left out
+func exportEnvs(w http.ResponseWriter, r *http.Request, project db.Project, format string) {
+	if format != envfile.FormatDotenv && format != envfile.FormatJSON && format != envfile.FormatYAML {
+		http.Error(w, "Invalid format, expected dotenv, json or yaml", http.StatusBadRequest)
+		return
+	}
+
+	environment, err := db.FindEnvironment(db.DB, project.ID, r.URL.Query().Get("environment"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Environment not found", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+		return
+	}
+
+	var envs []db.Env
+	if err := db.DB.Preload("Environments").Scopes(db.InEnvironment(environment.ID)).
+		Where("project_id = ?", project.ID).Order("id ASC").Find(&envs).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+
+	values := map[string]string{}
+	secretKeys := []string{}
+	for _, env := range db.EffectiveEnvs(envs) {
+		if env.IsSecret {
+			secretKeys = append(secretKeys, env.Key)
+			continue
+		}
+		value, err := secrets.DecryptEnv(db.DB, env)
+		if err != nil {
+			http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+			return
+		}
+		values[env.Key] = value
+	}
+
+	out, err := envfile.Format(format, values, secretKeys)
+	if err != nil {
+		http.Error(w, "Failed to export envs", http.StatusInternalServerError)
+		return
+	}
+
+	filename := project.Name + "." + environment.Name
+	switch format {
+	case envfile.FormatDotenv:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		filename += ".env"
+	case envfile.FormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		filename += ".json"
+	case envfile.FormatYAML:
+		w.Header().Set("Content-Type", "application/yaml")
+		filename += ".yaml"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Write(out)
+}
+
+// sameEnvironments reports whether two scopes contain the same environments
+func sameEnvironments(a, b []db.Environment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := map[uint]bool{}
+	for _, environment := range a {
+		ids[environment.ID] = true
+	}
+	for _, environment := range b {
+		if !ids[environment.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlappingEnvironments reports whether two scopes share an environment;
+// two unscoped envs overlap too
+func overlappingEnvironments(a, b []db.Environment) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x.ID == y.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Env revision handlers
+func EnvRevisionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvRead)
+	if !ok {
+		return
+	}
+
+	var revisions []db.EnvRevision
+	if err := db.DB.Preload("Changes").Where("project_id = ?", project.ID).Order("number DESC").Find(&revisions).Error; err != nil {
+		http.Error(w, "Failed to fetch env revisions", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"revisions": revisions})
+}
+
+// EnvRevisionRestoreHandler brings the project's envs back to their state
+// right after the given revision. The restore is itself a new revision.
+func EnvRevisionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	number, err := strconv.Atoi(vars["revision"])
+	if err != nil || number <= 0 {
+		http.Error(w, "Invalid revision number", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvRestore)
+	if !ok {
+		return
+	}
+
+	var revision db.EnvRevision
+	if err := db.DB.Where("number = ? AND project_id = ?", number, project.ID).First(&revision).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch revision", http.StatusInternalServerError)
+		return
+	}
+
+	var restored db.EnvRevision
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		restored, err = restoreEnvRevision(tx, revision, principal.KeycloakID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"revision": restored})
+}
+
+// restoreEnvRevision replays the changes up to target and applies the
+// difference with the current envs
+func restoreEnvRevision(tx *gorm.DB, target db.EnvRevision, keycloakID string) (db.EnvRevision, error) {
+	var history []db.EnvChange
+	if err := tx.Joins("JOIN env_revisions ON env_revisions.id = env_changes.revision_id").
+		Where("env_revisions.project_id = ? AND env_revisions.number <= ?", target.ProjectID, target.Number).
+		Order("env_revisions.number ASC, env_changes.id ASC").Find(&history).Error; err != nil {
+		return db.EnvRevision{}, fmt.Errorf("failed to fetch env history: %v", err)
+	}
+
+	// State of each env right after the target revision, nil when deleted
+	wanted := map[uint]*db.EnvChange{}
+	for i := range history {
+		change := history[i]
+		if change.Action == "deleted" {
+			wanted[change.EnvID] = nil
+		} else {
+			wanted[change.EnvID] = &change
+		}
+	}
+
+	var current []db.Env
+	if err := tx.Unscoped().Preload("Environments").Where("project_id = ?", target.ProjectID).Find(&current).Error; err != nil {
+		return db.EnvRevision{}, fmt.Errorf("failed to fetch envs: %v", err)
+	}
+
+	var environments []db.Environment
+	if err := tx.Where("project_id = ?", target.ProjectID).Find(&environments).Error; err != nil {
+		return db.EnvRevision{}, fmt.Errorf("failed to fetch environments: %v", err)
+	}
+	environmentsByID := map[uint]db.Environment{}
+	for _, environment := range environments {
+		environmentsByID[environment.ID] = environment
+	}
+
+	var changes []db.EnvChange
+	for i := range current {
+		env := current[i]
+		state, known := wanted[env.ID]
+		alive := !env.DeletedAt.Valid
+
+		switch {
+		case (!known || state == nil) && alive:
+			// Env created after the revision or deleted by it
+			before := env
+			if err := tx.Model(&env).Association("Environments").Clear(); err != nil {
+				return db.EnvRevision{}, err
+			}
+			if err := tx.Delete(&env).Error; err != nil {
+				return db.EnvRevision{}, err
+			}
+			change, err := newEnvChange(tx, "deleted", &before, nil)
+			if err != nil {
+				return db.EnvRevision{}, err
+			}
+			changes = append(changes, change)
+
+		case known && state != nil:
+			changed, err := envDiffersFrom(tx, env, *state)
+			if err != nil {
+				return db.EnvRevision{}, err
+			}
+			if alive && !changed {
+				continue
+			}
+
+			before := env
+			env.DeletedAt = gorm.DeletedAt{}
+			env.Key = state.Key
+			env.IsSecret = state.IsSecret
+			env.Value = state.Value
+			env.DataKeyID = state.DataKeyID
+			env.Environments = nil
+			for _, id := range state.EnvironmentIDs {
+				// Environments deleted since then are dropped from the scope
+				if environment, ok := environmentsByID[id]; ok {
+					env.Environments = append(env.Environments, environment)
+				}
+			}
+			if err := restoreEnvValueMetadata(tx, &env, keycloakID); err != nil {
+				return db.EnvRevision{}, err
+			}
+
+			if err := tx.Unscoped().Omit("Environments").Save(&env).Error; err != nil {
+				return db.EnvRevision{}, err
+			}
+			if err := tx.Model(&env).Association("Environments").Replace(env.Environments); err != nil {
+				return db.EnvRevision{}, err
+			}
+
+			action := "updated"
+			var previous *db.Env
+			if alive {
+				previous = &before
+			} else {
+				action = "created"
+			}
+			change, err := newEnvChange(tx, action, previous, &env)
+			if err != nil {
+				return db.EnvRevision{}, err
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	restoredFrom := target.Number
+	return recordEnvRevision(tx, target.ProjectID, keycloakID, "restore", &restoredFrom, changes)
+}
+
+// envDiffersFrom reports whether env no longer matches a recorded state
+func envDiffersFrom(tx *gorm.DB, env db.Env, state db.EnvChange) (bool, error) {
+	if env.Key != state.Key || env.IsSecret != state.IsSecret || len(env.Environments) != len(state.EnvironmentIDs) {
+		return true, nil
+	}
+	ids := map[uint]bool{}
+	for _, id := range state.EnvironmentIDs {
+		ids[id] = true
+	}
+	for _, environment := range env.Environments {
+		if !ids[environment.ID] {
+			return true, nil
+		}
+	}
+
+	current, err := secrets.DecryptEnv(tx, env)
+	if err != nil {
+		return false, err
+	}
+	previous, err := secrets.DecryptValue(tx, env.ProjectID, state.DataKeyID, state.Value)
+	if err != nil {
+		return false, err
+	}
+	return current != previous, nil
+}
+
+// restoreEnvValueMetadata refreshes the preview and update metadata of an env
+// whose encrypted value was copied back from a revision
+func restoreEnvValueMetadata(tx *gorm.DB, env *db.Env, keycloakID string) error {
+	value, err := secrets.DecryptEnv(tx, *env)
+	if err != nil {
+		return err
+	}
+	return setEnvValue(tx, env, value, keycloakID)
+}
+
+// ensureEnvBaseline records the envs that existed before revisions were
+// introduced, so that restoring an early revision does not drop them. It
+// must run before the first change is applied.
+func ensureEnvBaseline(tx *gorm.DB, projectID uint) error {
+	// Lock the project before counting, or concurrent first edits would
+	// both record a baseline
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&db.Project{}, projectID).Error; err != nil {
+		return err
+	}
+
+	var count int64
+	if err := tx.Model(&db.EnvRevision{}).Where("project_id = ?", projectID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var envs []db.Env
+	if err := tx.Preload("Environments").Where("project_id = ?", projectID).Find(&envs).Error; err != nil {
+		return err
+	}
+	if len(envs) == 0 {
+		return nil
+	}
+
+	changes := make([]db.EnvChange, 0, len(envs))
+	for i := range envs {
+		change, err := newEnvChange(tx, "created", nil, &envs[i])
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change)
+	}
+
+	_, err := recordEnvRevision(tx, projectID, "", "baseline", nil, changes)
+	return err
+}
+
+// newEnvChange describes the change of an env from before to after, either
+// being nil when the env was created or deleted. The Environments of after
+// must be loaded.
+func newEnvChange(tx *gorm.DB, action string, before, after *db.Env) (db.EnvChange, error) {
+	change := db.EnvChange{Action: action, EnvironmentIDs: []uint{}}
+
+	if before != nil {
+		hash, err := secrets.HashEnv(tx, *before)
+		if err != nil {
+			return change, err
+		}
+		change.OldHash = hash
+		change.EnvID = before.ID
+		change.Key = before.Key
+		change.IsSecret = before.IsSecret
+	}
+
+	if after != nil {
+		hash, err := secrets.HashEnv(tx, *after)
+		if err != nil {
+			return change, err
+		}
+		change.NewHash = hash
+		change.EnvID = after.ID
+		change.Key = after.Key
+		change.IsSecret = after.IsSecret
+		change.Value = after.Value
+		change.DataKeyID = after.DataKeyID
+		if after.DataKeyID == 0 {
+			// Values stored before encryption are encrypted in the revision
+			encrypted := db.Env{ProjectID: after.ProjectID}
+			if err := secrets.EncryptEnv(tx, &encrypted, after.Value); err != nil {
+				return change, err
+			}
+			change.Value = encrypted.Value
+			change.DataKeyID = encrypted.DataKeyID
+		}
+		for _, environment := range after.Environments {
+			change.EnvironmentIDs = append(change.EnvironmentIDs, environment.ID)
+		}
+	}
+
+	return change, nil
+}
+
+// recordEnvRevision saves changes as the next revision of the project
+func recordEnvRevision(tx *gorm.DB, projectID uint, keycloakID string, source string, restoredFrom *uint, changes []db.EnvChange) (db.EnvRevision, error) {
+	// Lock the project so concurrent edits get distinct revision numbers
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&db.Project{}, projectID).Error; err != nil {
+		return db.EnvRevision{}, err
+	}
+
+	var last uint
+	if err := tx.Model(&db.EnvRevision{}).Where("project_id = ?", projectID).Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+		return db.EnvRevision{}, err
+	}
+
+	revision := db.EnvRevision{
+		ProjectID:    projectID,
+		Number:       last + 1,
+		Source:       source,
+		RestoredFrom: restoredFrom,
+		Changes:      changes,
+	}
+	if keycloakID != "" {
+		var user db.User
+		if err := tx.Where("keycloak_id = ?", keycloakID).First(&user).Error; err == nil {
+			revision.UserID = &user.ID
+			revision.Username = user.Username
+		}
+	}
+
+	if err := tx.Create(&revision).Error; err != nil {
+		return db.EnvRevision{}, err
+	}
+	return revision, nil
+}
+
+// latestEnvRevision returns the number of the project's last env revision,
+// 0 when its envs were never changed
+func latestEnvRevision(tx *gorm.DB, projectID uint) (uint, error) {
+	var last uint
+	err := tx.Model(&db.EnvRevision{}).Where("project_id = ?", projectID).Select("COALESCE(MAX(number), 0)").Scan(&last).Error
+	return last, err
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"gorm.io/gorm"
+)
+
+func useKeyring(t *testing.T) {
+	t.Helper()
+	t.Setenv("ENV_KEYRING_FILE", "")
+	t.Setenv("ENV_ENCRYPTION_KEYS", "test:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	t.Setenv("ENV_ENCRYPTION_PRIMARY_KEY", "")
+	keyring, err := secrets.LoadKeyring()
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	previous := secrets.KEKs
+	secrets.KEKs = keyring
+	t.Cleanup(func() { secrets.KEKs = previous })
+}
+
+// Envs stored before encryption must not end up in plaintext in the
+// revisions recorded when they are edited
+func TestEnvRevisionsOfPlaintextEnv(t *testing.T) {
+	tx := dbtest.Open(t)
+	useKeyring(t)
+
+	suffix := time.Now().UnixNano()
+	user := db.User{
+		KeycloakID: fmt.Sprintf("env-revision-%d", suffix),
+		Email:      fmt.Sprintf("env-revision-%d@example.com", suffix),
+		Username:   fmt.Sprintf("env-revision-%d", suffix),
+	}
+	if err := tx.Create(&user).Error; err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	project := db.Project{Name: fmt.Sprintf("env-revision-%d", suffix), UserID: &user.ID}
+	if err := tx.Create(&project).Error; err != nil {
+		t.Fatalf("Create project: %v", err)
+	}
+	const plaintext = "legacy-secret"
+	env := db.Env{ProjectID: project.ID, Key: "API_KEY", Value: plaintext}
+	if err := tx.Create(&env).Error; err != nil {
+		t.Fatalf("Create env: %v", err)
+	}
+
+	// Renaming keeps the stored value, the baseline and the change copy it
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := ensureEnvBaseline(tx, project.ID); err != nil {
+			return err
+		}
+		before := env
+		env.Key = "RENAMED_API_KEY"
+		if err := tx.Save(&env).Error; err != nil {
+			return err
+		}
+		change, err := newEnvChange(tx, "updated", &before, &env)
+		if err != nil {
+			return err
+		}
+		_, err = recordEnvRevision(tx, project.ID, user.KeycloakID, "api", nil, []db.EnvChange{change})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	checkChanges := func(step string) {
+		t.Helper()
+		var changes []db.EnvChange
+		err := tx.Joins("JOIN env_revisions ON env_revisions.id = env_changes.revision_id").
+			Where("env_revisions.project_id = ?", project.ID).Find(&changes).Error
+		if err != nil {
+			t.Fatalf("Find changes: %v", err)
+		}
+		if len(changes) != 2 {
+			t.Fatalf("%s: recorded %d changes, want the baseline and the update", step, len(changes))
+		}
+		for _, change := range changes {
+			if change.DataKeyID == 0 || change.Value == plaintext {
+				t.Errorf("%s: change %d (%s) is stored in plaintext", step, change.ID, change.Action)
+			}
+			value, err := secrets.DecryptValue(tx, project.ID, change.DataKeyID, change.Value)
+			if err != nil {
+				t.Fatalf("%s: DecryptValue: %v", step, err)
+			}
+			if value != plaintext {
+				t.Errorf("%s: change %d decrypts to %q, want %q", step, change.ID, value, plaintext)
+			}
+		}
+	}
+	checkChanges("after the update")
+
+	if _, err := secrets.RotateProject(tx, project.ID); err != nil {
+		t.Fatalf("RotateProject: %v", err)
+	}
+	checkChanges("after rotation")
+
+	var stored db.Env
+	if err := tx.First(&stored, env.ID).Error; err != nil {
+		t.Fatalf("First: %v", err)
+	}
+	if stored.DataKeyID == 0 || stored.Value == plaintext {
+		t.Error("the env is still stored in plaintext after rotation")
+	}
+}
@@ -0,0 +1,297 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Environment names end up in Kubernetes labels
+var environmentNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Environment handlers
+func EnvironmentsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.ProjectRead)
+	if !ok {
+		return
+	}
+
+	environments, err := db.EnsureEnvironments(db.DB, project.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"environments": environments})
+}
+
+func EnvironmentPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name      string `json:"name"`
+		IsDefault bool   `json:"is_default"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !environmentNameRegexp.MatchString(req.Name) {
+		http.Error(w, "Invalid environment name", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvironmentWrite)
+	if !ok {
+		return
+	}
+
+	if _, err := db.EnsureEnvironments(db.DB, project.ID); err != nil {
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return
+	}
+
+	var count int64
+	if err := db.DB.Model(&db.Environment{}).Where("project_id = ? AND name = ?", project.ID, req.Name).Count(&count).Error; err != nil {
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Environment already exists", http.StatusConflict)
+		return
+	}
+
+	environment := db.Environment{
+		ProjectID: project.ID,
+		Name:      req.Name,
+		IsDefault: req.IsDefault,
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&environment).Error; err != nil {
+			return err
+		}
+		if environment.IsDefault {
+			return setDefaultEnvironment(tx, environment)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to create environment", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"environment": environment})
+}
+
+func EnvironmentPutByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	environmentID, err := strconv.Atoi(vars["environmentId"])
+	if err != nil {
+		http.Error(w, "Invalid environment ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name      string `json:"name,omitempty"`
+		IsDefault *bool  `json:"is_default,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name != "" && !environmentNameRegexp.MatchString(req.Name) {
+		http.Error(w, "Invalid environment name", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvironmentWrite)
+	if !ok {
+		return
+	}
+
+	var environment db.Environment
+	if err := db.DB.Where("id = ? AND project_id = ?", environmentID, project.ID).First(&environment).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Environment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+		return
+	}
+
+	if req.IsDefault != nil && !*req.IsDefault && environment.IsDefault {
+		http.Error(w, "Set another environment as default instead", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != "" && req.Name != environment.Name {
+		var count int64
+		if err := db.DB.Model(&db.Environment{}).Where("project_id = ? AND name = ?", environment.ProjectID, req.Name).Count(&count).Error; err != nil {
+			http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+			return
+		}
+		if count > 0 {
+			http.Error(w, "Environment already exists", http.StatusConflict)
+			return
+		}
+		environment.Name = req.Name
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&environment).Error; err != nil {
+			return err
+		}
+		if req.IsDefault != nil && *req.IsDefault {
+			environment.IsDefault = true
+			return setDefaultEnvironment(tx, environment)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to update environment", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"environment": environment})
+}
+
+func EnvironmentDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	environmentID, err := strconv.Atoi(vars["environmentId"])
+	if err != nil {
+		http.Error(w, "Invalid environment ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvironmentWrite)
+	if !ok {
+		return
+	}
+
+	var environment db.Environment
+	if err := db.DB.Where("id = ? AND project_id = ?", environmentID, project.ID).First(&environment).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Environment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+		return
+	}
+
+	if environment.IsDefault {
+		http.Error(w, "The default environment cannot be deleted", http.StatusBadRequest)
+		return
+	}
+
+	// Envs only scoped to this environment would silently apply to every
+	// environment once the scope is gone
+	var exclusive int64
+	if err := db.DB.Raw(`SELECT COUNT(*) FROM env_environments ee
+		JOIN envs ON envs.id = ee.env_id AND envs.deleted_at IS NULL
+		WHERE ee.environment_id = ?
+		AND NOT EXISTS (SELECT 1 FROM env_environments other WHERE other.env_id = ee.env_id AND other.environment_id <> ee.environment_id)`, environment.ID).Scan(&exclusive).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	if exclusive > 0 {
+		http.Error(w, fmt.Sprintf("%d envs are only scoped to this environment", exclusive), http.StatusConflict)
+		return
+	}
+	if err := db.DB.Raw(`SELECT COUNT(*) FROM secret_file_environments sfe
+		WHERE sfe.environment_id = ?
+		AND NOT EXISTS (SELECT 1 FROM secret_file_environments other WHERE other.secret_file_id = sfe.secret_file_id AND other.environment_id <> sfe.environment_id)`, environment.ID).Scan(&exclusive).Error; err != nil {
+		http.Error(w, "Failed to fetch files", http.StatusInternalServerError)
+		return
+	}
+	if exclusive > 0 {
+		http.Error(w, fmt.Sprintf("%d files are only scoped to this environment", exclusive), http.StatusConflict)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM env_environments WHERE environment_id = ?", environment.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM secret_file_environments WHERE environment_id = ?", environment.ID).Error; err != nil {
+			return err
+		}
+		// Hard delete so the name can be reused
+		return tx.Unscoped().Delete(&environment).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to delete environment", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+// setDefaultEnvironment makes environment the only default of its project
+func setDefaultEnvironment(tx *gorm.DB, environment db.Environment) error {
+	return tx.Model(&db.Environment{}).
+		Where("project_id = ? AND id <> ?", environment.ProjectID, environment.ID).
+		Update("is_default", false).Error
+}
+
+var errUnknownEnvironment = errors.New("unknown environment")
+
+// findEnvironments resolves environment names of a project
+func findEnvironments(projectID uint, names []string) ([]db.Environment, error) {
+	environments := make([]db.Environment, 0, len(names))
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("%w %q", errUnknownEnvironment, name)
+		}
+		environment, err := db.FindEnvironment(db.DB, projectID, name)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, fmt.Errorf("%w %q", errUnknownEnvironment, name)
+			}
+			return nil, err
+		}
+		environments = append(environments, environment)
+	}
+	return environments, nil
+}
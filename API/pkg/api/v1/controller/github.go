@@ -20,12 +20,7 @@ func NewGithubController(secret []byte) *GithubController {
 }
 
 func (c *GithubController) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	// userInfo := middleware.GetUserFromContext(r.Context())
-	// if userInfo == nil {
-	// 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	// 	return
-	// }
-
+	// Public route, GitHub requests are authenticated by their signature
 	payload, err := github.ValidatePayload(r, c.webhookSecretKey)
 	if err != nil {
 		http.Error(w, "invalid payload", http.StatusBadRequest)
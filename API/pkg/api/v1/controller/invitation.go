@@ -0,0 +1,393 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/invitations"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// invitationWithStatus is an invitation as listed in an organization
+type invitationWithStatus struct {
+	db.Invitation
+	Status string `json:"status"` // pending, accepted, revoked or expired
+}
+
+// Organization invitation handlers
+func OrganizationInvitationsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationMembers)
+	if !ok {
+		return
+	}
+
+	var list []db.Invitation
+	if err := db.DB.Where("organization_id = ?", organization.ID).Order("created_at DESC").Find(&list).Error; err != nil {
+		http.Error(w, "Failed to fetch invitations", http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]invitationWithStatus, 0, len(list))
+	for _, invitation := range list {
+		result = append(result, invitationWithStatus{Invitation: invitation, Status: invitationStatus(invitation)})
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"invitations": result})
+}
+
+// OrganizationInvitationPostHandler invites an email address to join the
+// organization, whether or not it already has an account
+func OrganizationInvitationPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Email string      `json:"email"`
+		Role  policy.Role `json:"role"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil || address.Name != "" {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(address.Address)
+	if req.Role == "" {
+		req.Role = policy.RoleDeveloper
+	}
+	if !req.Role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	organization, actor, ok := authorizeMembers(w, principal, organizationID)
+	if !ok {
+		return
+	}
+	if !policy.CanManage(actor, req.Role) {
+		http.Error(w, "Your role does not allow granting this role", http.StatusForbidden)
+		return
+	}
+
+	var members int64
+	if err := db.DB.Model(&db.OrganizationMember{}).Joins("JOIN users ON users.id = organization_members.user_id").
+		Where("organization_members.organization_id = ? AND LOWER(users.email) = ?", organization.ID, email).Count(&members).Error; err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	if members > 0 {
+		http.Error(w, "User is already a member", http.StatusConflict)
+		return
+	}
+
+	var pending int64
+	if err := db.DB.Model(&db.Invitation{}).Scopes(pendingInvitations).
+		Where("organization_id = ? AND email = ?", organization.ID, email).Count(&pending).Error; err != nil {
+		http.Error(w, "Failed to fetch invitations", http.StatusInternalServerError)
+		return
+	}
+	if pending > 0 {
+		http.Error(w, "An invitation is already pending for this email, resend it instead", http.StatusConflict)
+		return
+	}
+
+	invitation := db.Invitation{
+		OrganizationID: organization.ID,
+		Email:          email,
+		Role:           string(req.Role),
+	}
+	if principal.UserID != 0 {
+		invitation.InvitedByID = &principal.UserID
+	}
+	if err := invitations.Renew(&invitation); err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	// The invitation only exists if its email could be sent
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&invitation).Error; err != nil {
+			return err
+		}
+		return sendInvitation(r.Context(), invitation, organization, principal.Username)
+	})
+	if err != nil {
+		writeInvitationError(w, err, "Failed to create invitation")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"invitation": invitationWithStatus{Invitation: invitation, Status: invitationStatus(invitation)}})
+}
+
+// OrganizationInvitationResendHandler sends the invitation again with a new
+// link and expiry, the previous link stops working
+func OrganizationInvitationResendHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	organization, invitation, ok := findOrganizationInvitation(w, r)
+	if !ok {
+		return
+	}
+	if invitation.AcceptedAt != nil || invitation.RevokedAt != nil {
+		http.Error(w, "The invitation is no longer pending", http.StatusConflict)
+		return
+	}
+
+	if err := invitations.Renew(&invitation); err != nil {
+		http.Error(w, "Failed to renew invitation", http.StatusInternalServerError)
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&invitation).Error; err != nil {
+			return err
+		}
+		return sendInvitation(r.Context(), invitation, organization, principal.Username)
+	})
+	if err != nil {
+		writeInvitationError(w, err, "Failed to resend invitation")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"invitation": invitationWithStatus{Invitation: invitation, Status: invitationStatus(invitation)}})
+}
+
+// OrganizationInvitationDeleteHandler revokes an invitation, it stays listed
+func OrganizationInvitationDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	_, invitation, ok := findOrganizationInvitation(w, r)
+	if !ok {
+		return
+	}
+	if invitation.AcceptedAt != nil {
+		http.Error(w, "The invitation was already accepted", http.StatusConflict)
+		return
+	}
+
+	if invitation.RevokedAt == nil {
+		now := time.Now()
+		invitation.RevokedAt = &now
+		if err := db.DB.Model(&invitation).Update("revoked_at", now).Error; err != nil {
+			http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "revoked"})
+}
+
+// InvitationAcceptHandler joins the organization of an invitation sent to the
+// caller's email address
+func InvitationAcceptHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var user db.User
+	if err := db.DB.Where("id = ?", principal.UserID).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	invitation, err := invitations.Find(db.DB, req.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, invitations.ErrInvalidToken):
+			http.Error(w, "Invalid invitation", http.StatusNotFound)
+		case errors.Is(err, invitations.ErrExpired):
+			http.Error(w, "The invitation has expired", http.StatusGone)
+		default:
+			http.Error(w, "Failed to fetch invitation", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		http.Error(w, "The invitation was sent to another email address", http.StatusForbidden)
+		return
+	}
+
+	role, err := policy.OrganizationRole(db.DB, user.ID, invitation.OrganizationID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	if role != "" {
+		http.Error(w, "You are already a member of this organization", http.StatusConflict)
+		return
+	}
+
+	member, err := acceptInvitation(r.Context(), invitation, user)
+	if errors.Is(err, invitations.ErrInvalidToken) {
+		http.Error(w, "Invalid invitation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to accept invitation")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"organization": organizationWithRole{Organization: *invitation.Organization, Role: policy.Role(member.Role)},
+	})
+}
+
+// AcceptPendingInvitations makes a user a member of the organizations that
+// invited their email address, once they verified it: until then the
+// address may belong to someone else, who must use the invitation link.
+// Failures are only logged, the invitations can still be accepted from their
+// link.
+func AcceptPendingInvitations(ctx context.Context, user db.User) {
+	if !user.EmailVerified || user.Email == "" {
+		return
+	}
+
+	var pending []db.Invitation
+	if err := db.DB.Preload("Organization").Scopes(pendingInvitations).
+		Where("email = ?", strings.ToLower(user.Email)).Order("created_at ASC").Find(&pending).Error; err != nil {
+		log.Printf("Failed to fetch invitations of %s: %v", user.Email, err)
+		return
+	}
+
+	joined := map[uint]bool{}
+	for _, invitation := range pending {
+		if invitation.Organization == nil || joined[invitation.OrganizationID] {
+			continue
+		}
+		if _, err := acceptInvitation(ctx, invitation, user); err != nil {
+			log.Printf("Failed to accept invitation %d for %s: %v", invitation.ID, user.Email, err)
+			continue
+		}
+		joined[invitation.OrganizationID] = true
+	}
+}
+
+// acceptInvitation creates the membership of an invitation and marks it
+// accepted
+func acceptInvitation(ctx context.Context, invitation db.Invitation, user db.User) (db.OrganizationMember, error) {
+	return addOrganizationMember(ctx, *invitation.Organization, user, policy.Role(invitation.Role), func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&db.Invitation{}).Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", invitation.ID).
+			Updates(map[string]interface{}{"accepted_at": now, "accepted_by_id": user.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return invitations.ErrInvalidToken
+		}
+		return nil
+	})
+}
+
+// findOrganizationInvitation loads the invitation of the request if the
+// principal may manage the organization's members
+func findOrganizationInvitation(w http.ResponseWriter, r *http.Request) (db.Organization, db.Invitation, bool) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return db.Organization{}, db.Invitation{}, false
+	}
+	invitationID, err := strconv.Atoi(vars["invitationId"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return db.Organization{}, db.Invitation{}, false
+	}
+
+	organization, actor, ok := authorizeMembers(w, principal, organizationID)
+	if !ok {
+		return organization, db.Invitation{}, false
+	}
+
+	var invitation db.Invitation
+	if err := db.DB.Where("id = ? AND organization_id = ?", invitationID, organization.ID).First(&invitation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return organization, invitation, false
+		}
+		http.Error(w, "Failed to fetch invitation", http.StatusInternalServerError)
+		return organization, invitation, false
+	}
+	if !policy.CanManage(actor, policy.Role(invitation.Role)) {
+		http.Error(w, "Your role does not allow managing this invitation", http.StatusForbidden)
+		return organization, invitation, false
+	}
+	return organization, invitation, true
+}
+
+// pendingInvitations keeps the invitations that can still be accepted
+func pendingInvitations(tx *gorm.DB) *gorm.DB {
+	return tx.Where("accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", time.Now())
+}
+
+func invitationStatus(invitation db.Invitation) string {
+	switch {
+	case invitation.AcceptedAt != nil:
+		return "accepted"
+	case invitation.RevokedAt != nil:
+		return "revoked"
+	case time.Now().After(invitation.ExpiresAt):
+		return "expired"
+	default:
+		return "pending"
+	}
+}
+
+// errInvitationEmail wraps the failures to email an invitation
+var errInvitationEmail = errors.New("failed to send the invitation email")
+
+func sendInvitation(ctx context.Context, invitation db.Invitation, organization db.Organization, inviter string) error {
+	if err := invitations.Send(ctx, mailer.Default, invitation, organization, inviter); err != nil {
+		log.Printf("Failed to email invitation %d: %v", invitation.ID, err)
+		return errInvitationEmail
+	}
+	return nil
+}
+
+func writeInvitationError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errInvitationEmail) {
+		http.Error(w, message+": "+errInvitationEmail.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+	"github.com/flotio-dev/api/pkg/invitations"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+)
+
+// invitationTest is an organization owned by admin, and users who can be
+// invited to it
+type invitationTest struct {
+	tx           *gorm.DB
+	mail         *mailer.Memory
+	organization db.Organization
+	admin        db.User
+	invitee      db.User
+	other        db.User
+}
+
+func newInvitationTest(t *testing.T) *invitationTest {
+	t.Helper()
+	tx := dbtest.Open(t)
+
+	t.Setenv("KEYCLOAK_ORGANIZATIONS", "false")
+	t.Setenv("INVITATION_SECRET", "test-secret")
+	invitations.InitSigningKey()
+
+	mail := &mailer.Memory{}
+	previous := mailer.Default
+	mailer.Default = mail
+	t.Cleanup(func() { mailer.Default = previous })
+
+	suffix := time.Now().UnixNano()
+	newUser := func(name string) db.User {
+		user := db.User{
+			KeycloakID:    fmt.Sprintf("%s-%d", name, suffix),
+			Email:         fmt.Sprintf("%s-%d@example.com", name, suffix),
+			Username:      fmt.Sprintf("%s-%d", name, suffix),
+			EmailVerified: true,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			t.Fatalf("Create user: %v", err)
+		}
+		return user
+	}
+
+	test := &invitationTest{
+		tx:      tx,
+		mail:    mail,
+		admin:   newUser("admin"),
+		invitee: newUser("invitee"),
+		other:   newUser("other"),
+	}
+	test.organization = db.Organization{Name: fmt.Sprintf("invitation-test-%d", suffix)}
+	if err := tx.Create(&test.organization).Error; err != nil {
+		t.Fatalf("Create organization: %v", err)
+	}
+	owner := db.OrganizationMember{OrganizationID: test.organization.ID, UserID: test.admin.ID, Role: string(policy.RoleOwner)}
+	if err := tx.Create(&owner).Error; err != nil {
+		t.Fatalf("Create member: %v", err)
+	}
+	return test
+}
+
+// serve calls handler as user, with the route variables and JSON body
+func (it *invitationTest) serve(handler http.HandlerFunc, user db.User, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+	r := httptest.NewRequest(http.MethodPost, "/", &buf)
+	r = mux.SetURLVars(r, vars)
+	principal := &auth.Principal{UserID: user.ID, Username: user.Username, Email: user.Email, EmailVerified: user.EmailVerified}
+	r = r.WithContext(middleware.WithPrincipal(r.Context(), principal))
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// invite sends an invitation to the invitee and returns it
+func (it *invitationTest) invite(t *testing.T) db.Invitation {
+	t.Helper()
+	w := it.serve(OrganizationInvitationPostHandler, it.admin, it.vars(), map[string]string{"email": it.invitee.Email, "role": "developer"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("invite: status %d: %s", w.Code, w.Body)
+	}
+	var res struct {
+		Invitation db.Invitation `json:"invitation"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+	return res.Invitation
+}
+
+func (it *invitationTest) vars() map[string]string {
+	return map[string]string{"id": fmt.Sprint(it.organization.ID)}
+}
+
+func (it *invitationTest) invitationVars(invitation db.Invitation) map[string]string {
+	vars := it.vars()
+	vars["invitationId"] = fmt.Sprint(invitation.ID)
+	return vars
+}
+
+func (it *invitationTest) accept(user db.User, token string) *httptest.ResponseRecorder {
+	return it.serve(InvitationAcceptHandler, user, nil, map[string]string{"token": token})
+}
+
+// lastToken returns the token of the last invitation link emailed
+func (it *invitationTest) lastToken(t *testing.T) string {
+	t.Helper()
+	messages := it.mail.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no email sent")
+	}
+	msg := messages[len(messages)-1]
+	_, rest, found := strings.Cut(msg.Text, "/invitations/accept?token=")
+	if !found {
+		t.Fatalf("no invitation link in:\n%s", msg.Text)
+	}
+	escaped, _, _ := strings.Cut(rest, "\n")
+	token, err := url.QueryUnescape(strings.TrimSpace(escaped))
+	if err != nil {
+		t.Fatalf("QueryUnescape: %v", err)
+	}
+	return token
+}
+
+func (it *invitationTest) role(t *testing.T, user db.User) policy.Role {
+	t.Helper()
+	role, err := policy.OrganizationRole(it.tx, user.ID, it.organization.ID)
+	if err != nil {
+		t.Fatalf("OrganizationRole: %v", err)
+	}
+	return role
+}
+
+func TestInvitationSend(t *testing.T) {
+	it := newInvitationTest(t)
+	it.invite(t)
+
+	messages := it.mail.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(messages))
+	}
+	if messages[0].To != it.invitee.Email {
+		t.Errorf("To = %q, want %q", messages[0].To, it.invitee.Email)
+	}
+
+	token := it.lastToken(t)
+	if w := it.accept(it.invitee, token); w.Code != http.StatusOK {
+		t.Fatalf("accept: status %d: %s", w.Code, w.Body)
+	}
+	if role := it.role(t, it.invitee); role != policy.RoleDeveloper {
+		t.Errorf("role = %q, want developer", role)
+	}
+
+	// The link only works once
+	if w := it.accept(it.invitee, token); w.Code != http.StatusNotFound {
+		t.Errorf("second accept: status %d, want 404", w.Code)
+	}
+}
+
+func TestInvitationSendPending(t *testing.T) {
+	it := newInvitationTest(t)
+	it.invite(t)
+
+	w := it.serve(OrganizationInvitationPostHandler, it.admin, it.vars(), map[string]string{"email": it.invitee.Email})
+	if w.Code != http.StatusConflict {
+		t.Errorf("second invite: status %d, want 409", w.Code)
+	}
+	if n := len(it.mail.Messages()); n != 1 {
+		t.Errorf("sent %d emails, want 1", n)
+	}
+}
+
+func TestInvitationResend(t *testing.T) {
+	it := newInvitationTest(t)
+	invitation := it.invite(t)
+	old := it.lastToken(t)
+
+	w := it.serve(OrganizationInvitationResendHandler, it.admin, it.invitationVars(invitation), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resend: status %d: %s", w.Code, w.Body)
+	}
+	if n := len(it.mail.Messages()); n != 2 {
+		t.Fatalf("sent %d emails, want 2", n)
+	}
+	renewed := it.lastToken(t)
+	if renewed == old {
+		t.Fatal("resend sent the same link")
+	}
+
+	if w := it.accept(it.invitee, old); w.Code != http.StatusNotFound {
+		t.Errorf("accept with the old link: status %d, want 404", w.Code)
+	}
+	if w := it.accept(it.invitee, renewed); w.Code != http.StatusOK {
+		t.Errorf("accept with the new link: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestInvitationRevoke(t *testing.T) {
+	it := newInvitationTest(t)
+	invitation := it.invite(t)
+	token := it.lastToken(t)
+
+	w := it.serve(OrganizationInvitationDeleteHandler, it.admin, it.invitationVars(invitation), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", w.Code, w.Body)
+	}
+
+	if w := it.accept(it.invitee, token); w.Code != http.StatusNotFound {
+		t.Errorf("accept: status %d, want 404", w.Code)
+	}
+	if role := it.role(t, it.invitee); role != "" {
+		t.Errorf("role = %q, want none", role)
+	}
+	w = it.serve(OrganizationInvitationResendHandler, it.admin, it.invitationVars(invitation), nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("resend: status %d, want 409", w.Code)
+	}
+}
+
+func TestInvitationAcceptWrongEmail(t *testing.T) {
+	it := newInvitationTest(t)
+	it.invite(t)
+	token := it.lastToken(t)
+
+	if w := it.accept(it.other, token); w.Code != http.StatusForbidden {
+		t.Errorf("accept: status %d, want 403", w.Code)
+	}
+	if role := it.role(t, it.other); role != "" {
+		t.Errorf("role = %q, want none", role)
+	}
+
+	// The invitation is still pending for its address
+	if w := it.accept(it.invitee, token); w.Code != http.StatusOK {
+		t.Errorf("accept by the invitee: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAcceptPendingInvitations(t *testing.T) {
+	it := newInvitationTest(t)
+	it.invite(t)
+
+	// Someone registering the invited address without proving it owns it
+	unverified := it.invitee
+	unverified.EmailVerified = false
+	AcceptPendingInvitations(context.Background(), unverified)
+	if role := it.role(t, it.invitee); role != "" {
+		t.Fatalf("unverified user joined as %q", role)
+	}
+
+	AcceptPendingInvitations(context.Background(), it.invitee)
+	if role := it.role(t, it.invitee); role != policy.RoleDeveloper {
+		t.Errorf("role = %q, want developer", role)
+	}
+}
@@ -0,0 +1,665 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// errKeycloakSync wraps the failures to mirror a change in Keycloak, the
+// change is rolled back
+var errKeycloakSync = errors.New("failed to sync with Keycloak")
+
+// errLastOwner is returned when a change would leave an organization without
+// an owner
+var errLastOwner = errors.New("an organization needs at least one owner")
+
+// organizationWithRole is an organization as listed for a member
+type organizationWithRole struct {
+	db.Organization
+	Role policy.Role `json:"role"`
+}
+
+// organizationMember is a member as listed in an organization
+type organizationMember struct {
+	UserID   uint        `json:"user_id"`
+	Username string      `json:"username"`
+	Email    string      `json:"email"`
+	Role     policy.Role `json:"role"`
+	JoinedAt time.Time   `json:"joined_at"`
+}
+
+// Organization handlers
+func OrganizationsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	var members []db.OrganizationMember
+	if err := db.DB.Preload("Organization").Where("user_id = ?", principal.UserID).Find(&members).Error; err != nil {
+		http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+		return
+	}
+
+	organizations := make([]organizationWithRole, 0, len(members))
+	for _, member := range members {
+		if member.Organization == nil {
+			continue
+		}
+		organizations = append(organizations, organizationWithRole{Organization: *member.Organization, Role: policy.Role(member.Role)})
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"organizations": organizations})
+}
+
+// OrganizationPostHandler creates an organization owned by the caller
+func OrganizationPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+	if principal.UserID == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		http.Error(w, "Invalid organization name", http.StatusBadRequest)
+		return
+	}
+
+	taken, err := organizationNameTaken(req.Name, 0)
+	if err != nil {
+		http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Organization already exists", http.StatusConflict)
+		return
+	}
+
+	organization := db.Organization{
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	member := db.OrganizationMember{
+		UserID: principal.UserID,
+		Role:   string(policy.RoleOwner),
+	}
+
+	ctx := r.Context()
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+		member.OrganizationID = organization.ID
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+		if !keycloak.OrganizationsEnabled() {
+			return nil
+		}
+
+		// Mirrored last, so any failure leaves nothing in the database
+		return withKeycloakAdmin(func(admin *keycloak.Admin) error {
+			id, err := admin.CreateOrganization(ctx, keycloakOrganization(organization))
+			if err != nil {
+				return err
+			}
+			if err := admin.AddOrganizationMember(ctx, id, principal.KeycloakID); err != nil {
+				if err := admin.DeleteOrganization(ctx, id); err != nil {
+					log.Printf("Failed to delete Keycloak organization %s: %v", id, err)
+				}
+				return err
+			}
+			organization.KeycloakOrganizationID = &id
+			if err := tx.Model(&organization).Update("keycloak_organization_id", id).Error; err != nil {
+				if err := admin.DeleteOrganization(ctx, id); err != nil {
+					log.Printf("Failed to delete Keycloak organization %s: %v", id, err)
+				}
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to create organization")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"organization": organizationWithRole{Organization: organization, Role: policy.RoleOwner}})
+}
+
+func OrganizationGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationRead)
+	if !ok {
+		return
+	}
+	role, err := policy.OrganizationRole(db.DB, principal.UserID, organization.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch organization", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"organization": organizationWithRole{Organization: organization, Role: role}})
+}
+
+func OrganizationPutHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name             string  `json:"name,omitempty"`
+		Description      *string `json:"description,omitempty"`
+		LogRetentionDays *int    `json:"log_retention_days,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationUpdate)
+	if !ok {
+		return
+	}
+
+	if name := strings.TrimSpace(req.Name); name != "" && name != organization.Name {
+		if len(name) > 255 {
+			http.Error(w, "Invalid organization name", http.StatusBadRequest)
+			return
+		}
+		taken, err := organizationNameTaken(name, organization.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "Organization already exists", http.StatusConflict)
+			return
+		}
+		organization.Name = name
+	}
+	if req.Description != nil {
+		organization.Description = *req.Description
+	}
+	if req.LogRetentionDays != nil {
+		if *req.LogRetentionDays < 0 {
+			http.Error(w, "Invalid log retention", http.StatusBadRequest)
+			return
+		}
+		organization.LogRetentionDays = *req.LogRetentionDays
+	}
+
+	ctx := r.Context()
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&organization).Error; err != nil {
+			return err
+		}
+		if !keycloak.OrganizationsEnabled() || organization.KeycloakOrganizationID == nil {
+			return nil
+		}
+		return withKeycloakAdmin(func(admin *keycloak.Admin) error {
+			return admin.UpdateOrganization(ctx, keycloakOrganization(organization))
+		})
+	})
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to update organization")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"organization": organization})
+}
+
+// OrganizationDeleteHandler deletes an organization with its envs, keys and
+// memberships. Its projects have to be deleted or moved out first.
+func OrganizationDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationDelete)
+	if !ok {
+		return
+	}
+
+	var projects int64
+	if err := db.DB.Model(&db.Project{}).Where("organization_id = ?", organization.ID).Count(&projects).Error; err != nil {
+		http.Error(w, "Failed to fetch projects", http.StatusInternalServerError)
+		return
+	}
+	if projects > 0 {
+		http.Error(w, fmt.Sprintf("The organization still has %d projects", projects), http.StatusConflict)
+		return
+	}
+
+	ctx := r.Context()
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.OrganizationEnv{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.DataKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("organization_id = ?", organization.ID).Delete(&db.OrganizationMember{}).Error; err != nil {
+			return err
+		}
+		// Hard delete so the name can be reused
+		if err := tx.Unscoped().Delete(&organization).Error; err != nil {
+			return err
+		}
+		if !keycloak.OrganizationsEnabled() || organization.KeycloakOrganizationID == nil {
+			return nil
+		}
+		return withKeycloakAdmin(func(admin *keycloak.Admin) error {
+			return admin.DeleteOrganization(ctx, *organization.KeycloakOrganizationID)
+		})
+	})
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to delete organization")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+// Organization member handlers
+func OrganizationMembersGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationRead)
+	if !ok {
+		return
+	}
+
+	var members []db.OrganizationMember
+	if err := db.DB.Preload("User").Where("organization_id = ?", organization.ID).Order("created_at ASC").Find(&members).Error; err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]organizationMember, 0, len(members))
+	for _, member := range members {
+		list = append(list, newOrganizationMember(member))
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"members": list})
+}
+
+// OrganizationMemberPostHandler adds an existing user, found by username or
+// email, to the organization
+func OrganizationMemberPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		User string      `json:"user"` // username or email
+		Role policy.Role `json:"role"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// An empty user would match any user without an email
+	if req.User == "" {
+		http.Error(w, "User is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = policy.RoleDeveloper
+	}
+	if !req.Role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	organization, actor, ok := authorizeMembers(w, principal, organizationID)
+	if !ok {
+		return
+	}
+	if !policy.CanManage(actor, req.Role) {
+		http.Error(w, "Your role does not allow granting this role", http.StatusForbidden)
+		return
+	}
+
+	var user db.User
+	if err := db.DB.Where("username = ? OR email = ?", req.User, req.User).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	role, err := policy.OrganizationRole(db.DB, user.ID, organization.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	if role != "" {
+		http.Error(w, "User is already a member", http.StatusConflict)
+		return
+	}
+
+	member, err := addOrganizationMember(r.Context(), organization, user, req.Role, nil)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to add member")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"member": newOrganizationMember(member)})
+}
+
+func OrganizationMemberPutHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role policy.Role `json:"role"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !req.Role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	organization, actor, ok := authorizeMembers(w, principal, organizationID)
+	if !ok {
+		return
+	}
+
+	member, ok := findOrganizationMember(w, organization.ID, userID)
+	if !ok {
+		return
+	}
+	if !policy.CanManage(actor, policy.Role(member.Role)) || !policy.CanManage(actor, req.Role) {
+		http.Error(w, "Your role does not allow granting this role", http.StatusForbidden)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkLastOwner(tx, member, req.Role); err != nil {
+			return err
+		}
+		return tx.Model(&member).Update("role", string(req.Role)).Error
+	})
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to update member")
+		return
+	}
+	member.Role = string(req.Role)
+
+	utils.WriteJSON(w, map[string]interface{}{"member": newOrganizationMember(member)})
+}
+
+// OrganizationMemberDeleteHandler removes a member. Members can always leave
+// an organization themselves, unless they are its last owner.
+func OrganizationMemberDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	leaving := principal.UserID != 0 && uint(userID) == principal.UserID
+	action := policy.OrganizationMembers
+	if leaving {
+		action = policy.OrganizationRead
+	}
+	organization, ok := authorizeOrganization(w, principal, organizationID, action)
+	if !ok {
+		return
+	}
+
+	member, ok := findOrganizationMember(w, organization.ID, userID)
+	if !ok {
+		return
+	}
+	if !leaving {
+		actor, err := policy.OrganizationRole(db.DB, principal.UserID, organization.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+			return
+		}
+		if !policy.CanManage(actor, policy.Role(member.Role)) {
+			http.Error(w, "Your role does not allow removing this member", http.StatusForbidden)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkLastOwner(tx, member, ""); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&member).Error; err != nil {
+			return err
+		}
+		if !keycloak.OrganizationsEnabled() || organization.KeycloakOrganizationID == nil || member.User == nil {
+			return nil
+		}
+		return withKeycloakAdmin(func(admin *keycloak.Admin) error {
+			return admin.RemoveOrganizationMember(ctx, *organization.KeycloakOrganizationID, member.User.KeycloakID)
+		})
+	})
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to remove member")
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "removed"})
+}
+
+// addOrganizationMember makes user a member of the organization, in Keycloak
+// too. then runs in the same transaction.
+func addOrganizationMember(ctx context.Context, organization db.Organization, user db.User, role policy.Role, then func(tx *gorm.DB) error) (db.OrganizationMember, error) {
+	member := db.OrganizationMember{
+		OrganizationID: organization.ID,
+		UserID:         user.ID,
+		Role:           string(role),
+		User:           &user,
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("User").Create(&member).Error; err != nil {
+			return err
+		}
+		if then != nil {
+			if err := then(tx); err != nil {
+				return err
+			}
+		}
+		if !keycloak.OrganizationsEnabled() || organization.KeycloakOrganizationID == nil {
+			return nil
+		}
+		return withKeycloakAdmin(func(admin *keycloak.Admin) error {
+			err := admin.AddOrganizationMember(ctx, *organization.KeycloakOrganizationID, user.KeycloakID)
+			if errors.Is(err, keycloak.ErrConflict) {
+				return nil
+			}
+			return err
+		})
+	})
+	return member, err
+}
+
+// authorizeMembers loads the organization if the principal may manage its
+// members, with the principal's role
+func authorizeMembers(w http.ResponseWriter, principal *auth.Principal, organizationID int) (db.Organization, policy.Role, bool) {
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationMembers)
+	if !ok {
+		return organization, "", false
+	}
+	role, err := policy.OrganizationRole(db.DB, principal.UserID, organization.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return organization, "", false
+	}
+	return organization, role, true
+}
+
+func findOrganizationMember(w http.ResponseWriter, organizationID uint, userID int) (db.OrganizationMember, bool) {
+	var member db.OrganizationMember
+	if err := db.DB.Preload("User").Where("organization_id = ? AND user_id = ?", organizationID, userID).First(&member).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return member, false
+		}
+		http.Error(w, "Failed to fetch member", http.StatusInternalServerError)
+		return member, false
+	}
+	return member, true
+}
+
+// checkLastOwner returns errLastOwner when member is the last owner of the
+// organization and would no longer be one with role, empty for a removal.
+// The owner rows stay locked until tx ends, so concurrent demotions and
+// removals of the other owners wait for it and see its outcome.
+func checkLastOwner(tx *gorm.DB, member db.OrganizationMember, role policy.Role) error {
+	if role == policy.RoleOwner {
+		return nil
+	}
+	var owners []uint
+	err := tx.Model(&db.OrganizationMember{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("organization_id = ? AND role = ?", member.OrganizationID, policy.RoleOwner).
+		Pluck("id", &owners).Error
+	if err != nil {
+		return err
+	}
+	// The locked rows are current, member may have been demoted meanwhile
+	if len(owners) == 1 && owners[0] == member.ID {
+		return errLastOwner
+	}
+	return nil
+}
+
+func newOrganizationMember(member db.OrganizationMember) organizationMember {
+	view := organizationMember{
+		UserID:   member.UserID,
+		Role:     policy.Role(member.Role),
+		JoinedAt: member.CreatedAt,
+	}
+	if member.User != nil {
+		view.Username = member.User.Username
+		view.Email = member.User.Email
+	}
+	return view
+}
+
+func organizationNameTaken(name string, excludeID uint) (bool, error) {
+	var count int64
+	err := db.DB.Model(&db.Organization{}).Where("LOWER(name) = LOWER(?) AND id <> ?", name, excludeID).Count(&count).Error
+	return count > 0, err
+}
+
+func keycloakOrganization(organization db.Organization) keycloak.Organization {
+	kc := keycloak.Organization{
+		Name:        organization.Name,
+		Description: organization.Description,
+		Enabled:     true,
+	}
+	if organization.KeycloakOrganizationID != nil {
+		kc.ID = *organization.KeycloakOrganizationID
+	}
+	return kc
+}
+
+// withKeycloakAdmin runs fn with the Keycloak admin client, wrapping its
+// errors in errKeycloakSync
+func withKeycloakAdmin(fn func(admin *keycloak.Admin) error) error {
+	if err := fn(keycloak.Default); err != nil {
+		if errors.Is(err, keycloak.ErrConflict) {
+			return err
+		}
+		log.Printf("Keycloak organization sync failed: %v", err)
+		return fmt.Errorf("%w: %v", errKeycloakSync, err)
+	}
+	return nil
+}
+
+func writeOrganizationError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, errLastOwner):
+		http.Error(w, "An organization needs at least one owner", http.StatusConflict)
+	case errors.Is(err, keycloak.ErrConflict):
+		http.Error(w, "Organization already exists in Keycloak", http.StatusConflict)
+	case errors.Is(err, errKeycloakSync):
+		http.Error(w, message+": "+errKeycloakSync.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
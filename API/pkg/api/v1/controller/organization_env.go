@@ -0,0 +1,363 @@
+package controller
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/envfile"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// effectiveEnv is one variable of the set a project build receives
+type effectiveEnv struct {
+	Key          string `json:"key"`
+	Value        string `json:"value,omitempty"` // only set for non-secret envs
+	ValuePreview string `json:"value_preview"`
+	IsSecret     bool   `json:"is_secret"`
+	Source       string `json:"source"` // project or organization
+	EnvID        uint   `json:"env_id"` // id of the Env or OrganizationEnv
+	Overrides    bool   `json:"overrides"`
+}
+
+// Organization env handlers
+func OrganizationEnvsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationEnvRead)
+	if !ok {
+		return
+	}
+
+	var envs []db.OrganizationEnv
+	if err := db.DB.Where("organization_id = ?", organization.ID).Order("key ASC").Find(&envs).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range envs {
+		if err := revealOrganizationEnv(&envs[i]); err != nil {
+			http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"envs": envs})
+}
+
+func OrganizationEnvPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		IsSecret bool   `json:"is_secret"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !envfile.ValidKey(req.Key) {
+		http.Error(w, "Invalid env key", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationEnvWrite)
+	if !ok {
+		return
+	}
+
+	var count int64
+	if err := db.DB.Model(&db.OrganizationEnv{}).Where("organization_id = ? AND key = ?", organization.ID, req.Key).Count(&count).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Env key already exists in this organization", http.StatusConflict)
+		return
+	}
+
+	env := db.OrganizationEnv{
+		OrganizationID: organization.ID,
+		Key:            req.Key,
+		IsSecret:       req.IsSecret,
+	}
+	if err := setOrganizationEnvValue(&env, req.Value, principal.KeycloakID); err != nil {
+		http.Error(w, "Failed to encrypt env", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.DB.Create(&env).Error; err != nil {
+		http.Error(w, "Failed to create env", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revealOrganizationEnv(&env); err != nil {
+		http.Error(w, "Failed to decrypt env", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"env": env})
+}
+
+func OrganizationEnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	envID, err := strconv.Atoi(vars["envId"])
+	if err != nil {
+		http.Error(w, "Invalid env ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Key      string  `json:"key"`
+		Value    *string `json:"value,omitempty"`
+		IsSecret *bool   `json:"is_secret,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationEnvWrite)
+	if !ok {
+		return
+	}
+
+	var env db.OrganizationEnv
+	if err := db.DB.Where("id = ? AND organization_id = ?", envID, organization.ID).First(&env).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Env not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch env", http.StatusInternalServerError)
+		return
+	}
+
+	if req.IsSecret != nil {
+		// Turning a secret back into a plain env would make it readable
+		if env.IsSecret && !*req.IsSecret && req.Value == nil {
+			http.Error(w, "A new value is required to make a secret env readable", http.StatusBadRequest)
+			return
+		}
+		env.IsSecret = *req.IsSecret
+	}
+	if req.Key != "" && req.Key != env.Key {
+		if !envfile.ValidKey(req.Key) {
+			http.Error(w, "Invalid env key", http.StatusBadRequest)
+			return
+		}
+		var count int64
+		if err := db.DB.Model(&db.OrganizationEnv{}).Where("organization_id = ? AND key = ?", env.OrganizationID, req.Key).Count(&count).Error; err != nil {
+			http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+			return
+		}
+		if count > 0 {
+			http.Error(w, "Env key already exists in this organization", http.StatusConflict)
+			return
+		}
+		env.Key = req.Key
+	}
+
+	if req.Value != nil {
+		if err := setOrganizationEnvValue(&env, *req.Value, principal.KeycloakID); err != nil {
+			http.Error(w, "Failed to encrypt env", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := db.DB.Save(&env).Error; err != nil {
+		http.Error(w, "Failed to update env", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revealOrganizationEnv(&env); err != nil {
+		http.Error(w, "Failed to decrypt env", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"env": env})
+}
+
+func OrganizationEnvDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	organizationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	envID, err := strconv.Atoi(vars["envId"])
+	if err != nil {
+		http.Error(w, "Invalid env ID", http.StatusBadRequest)
+		return
+	}
+
+	organization, ok := authorizeOrganization(w, principal, organizationID, policy.OrganizationEnvWrite)
+	if !ok {
+		return
+	}
+
+	var env db.OrganizationEnv
+	if err := db.DB.Where("id = ? AND organization_id = ?", envID, organization.ID).First(&env).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Env not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch env", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.DB.Delete(&env).Error; err != nil {
+		http.Error(w, "Failed to delete env", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+// EnvsEffectiveGetHandler lists the variables a build of the project in the
+// requested environment (the default one when missing) receives, with the
+// source of each value
+func EnvsEffectiveGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.EnvRead)
+	if !ok {
+		return
+	}
+
+	environment, err := db.FindEnvironment(db.DB, project.ID, r.URL.Query().Get("environment"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Environment not found", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+		return
+	}
+
+	effective := map[string]effectiveEnv{}
+
+	if project.OrganizationID != nil {
+		var inherited []db.OrganizationEnv
+		if err := db.DB.Where("organization_id = ?", *project.OrganizationID).Find(&inherited).Error; err != nil {
+			http.Error(w, "Failed to fetch organization envs", http.StatusInternalServerError)
+			return
+		}
+		for i := range inherited {
+			env := inherited[i]
+			if err := revealOrganizationEnv(&env); err != nil {
+				http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+				return
+			}
+			effective[env.Key] = effectiveEnv{
+				Key:          env.Key,
+				Value:        env.PlainValue,
+				ValuePreview: env.ValuePreview,
+				IsSecret:     env.IsSecret,
+				Source:       "organization",
+				EnvID:        env.ID,
+			}
+		}
+	}
+
+	var envs []db.Env
+	if err := db.DB.Preload("Environments").Scopes(db.InEnvironment(environment.ID)).
+		Where("project_id = ?", project.ID).Order("id ASC").Find(&envs).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	for _, env := range db.EffectiveEnvs(envs) {
+		if err := revealEnv(&env); err != nil {
+			http.Error(w, "Failed to decrypt envs", http.StatusInternalServerError)
+			return
+		}
+		_, overrides := effective[env.Key]
+		effective[env.Key] = effectiveEnv{
+			Key:          env.Key,
+			Value:        env.PlainValue,
+			ValuePreview: env.ValuePreview,
+			IsSecret:     env.IsSecret,
+			Source:       "project",
+			EnvID:        env.ID,
+			Overrides:    overrides,
+		}
+	}
+
+	list := make([]effectiveEnv, 0, len(effective))
+	for _, env := range effective {
+		list = append(list, env)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	utils.WriteJSON(w, map[string]interface{}{"environment": environment.Name, "envs": list})
+}
+
+// setOrganizationEnvValue encrypts value into env and records who changed it
+func setOrganizationEnvValue(env *db.OrganizationEnv, value string, keycloakID string) error {
+	if err := secrets.EncryptOrganizationEnv(db.DB, env, value); err != nil {
+		return err
+	}
+	env.ValuePreview = secrets.Mask(value)
+	env.ValueUpdatedAt = time.Now()
+	env.ValueUpdatedByID = nil
+
+	var user db.User
+	if err := db.DB.Where("keycloak_id = ?", keycloakID).First(&user).Error; err == nil {
+		env.ValueUpdatedByID = &user.ID
+	}
+	return nil
+}
+
+// revealOrganizationEnv is revealEnv for organization envs
+func revealOrganizationEnv(env *db.OrganizationEnv) error {
+	if env.IsSecret {
+		env.PlainValue = ""
+		return nil
+	}
+	value, err := secrets.DecryptOrganizationEnv(db.DB, *env)
+	if err != nil {
+		return err
+	}
+	env.PlainValue = value
+	return nil
+}
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/flotio-dev/api/pkg/account"
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"gorm.io/gorm"
+)
+
+// maxAvatarURLLength bounds the avatar URLs users can set
+const maxAvatarURLLength = 2048
+
+// localePattern accepts BCP 47 tags such as "fr" or "pt-BR"
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// profileView is the caller's account as returned by /auth/@me, composed
+// of the Keycloak user and the local one
+type profileView struct {
+	ID            uint                `json:"id"`
+	KeycloakID    string              `json:"keycloak_id"`
+	Username      string              `json:"username"`
+	Email         string              `json:"email"`
+	EmailVerified bool                `json:"email_verified"`
+	FirstName     string              `json:"first_name"`
+	LastName      string              `json:"last_name"`
+	AvatarURL     string              `json:"avatar_url"`
+	Roles         []string            `json:"roles"`
+	Preferences   db.UserPreferences  `json:"preferences"`
+	Github        githubStatus        `json:"github"`
+	Organizations []profileMembership `json:"organizations"`
+	Usage         profileUsage        `json:"usage"`
+	CreatedAt     time.Time           `json:"created_at"`
+	// DeletionScheduledFor is set while a deletion of the account can be
+	// cancelled
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+// githubStatus tells whether GitHub is linked, without the tokens
+type githubStatus struct {
+	Connected    bool                `json:"connected"`
+	Installation *githubInstallation `json:"installation,omitempty"`
+}
+
+type githubInstallation struct {
+	InstallationID int64  `json:"installation_id"`
+	AccountLogin   string `json:"account_login"`
+	AccountType    string `json:"account_type"`
+}
+
+type profileMembership struct {
+	ID       uint      `json:"id"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// profileUsage counts the personal projects of the user and their builds
+// since the start of the month
+type profileUsage struct {
+	Projects         int64 `json:"projects"`
+	Builds           int64 `json:"builds_this_month"`
+	BuildMinutes     int64 `json:"build_minutes_this_month"`
+	BuildsInProgress int64 `json:"builds_in_progress"`
+	PeriodStartedAt  int64 `json:"period_started_at"` // Unix timestamp
+}
+
+// buildProfile composes the profile of the principal. The names come from
+// Keycloak, or from the token claims when Keycloak cannot be reached.
+func buildProfile(ctx context.Context, principal *auth.Principal) (profileView, error) {
+	var user db.User
+	if err := db.DB.Preload("GithubInstallation").First(&user, principal.UserID).Error; err != nil {
+		return profileView{}, err
+	}
+
+	profile := profileView{
+		ID:            user.ID,
+		KeycloakID:    user.KeycloakID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		AvatarURL:     user.AvatarURL,
+		Roles:         principal.Roles,
+		Preferences:   user.EffectivePreferences(),
+		Github:        githubStatus{Connected: user.GithubAccessToken != ""},
+		Organizations: []profileMembership{},
+		CreatedAt:     user.CreatedAt,
+	}
+	if profile.Roles == nil {
+		profile.Roles = []string{}
+	}
+
+	if kcUser, err := keycloak.Default.User(ctx, user.KeycloakID); err == nil {
+		profile.FirstName = gocloak.PString(kcUser.FirstName)
+		profile.LastName = gocloak.PString(kcUser.LastName)
+	} else {
+		log.Printf("Failed to fetch Keycloak user %s: %v", user.KeycloakID, err)
+		if principal.Claims != nil {
+			profile.FirstName = principal.Claims.GivenName
+			profile.LastName = principal.Claims.FamilyName
+		}
+	}
+
+	if installation := user.GithubInstallation; installation != nil {
+		profile.Github.Installation = &githubInstallation{
+			InstallationID: installation.InstallationID,
+			AccountLogin:   installation.AccountLogin,
+			AccountType:    installation.AccountType,
+		}
+	}
+
+	var memberships []db.OrganizationMember
+	if err := db.DB.Preload("Organization").Where("user_id = ?", user.ID).Order("created_at").Find(&memberships).Error; err != nil {
+		return profile, err
+	}
+	for _, membership := range memberships {
+		if membership.Organization == nil {
+			continue
+		}
+		profile.Organizations = append(profile.Organizations, profileMembership{
+			ID:       membership.OrganizationID,
+			Name:     membership.Organization.Name,
+			Role:     membership.Role,
+			JoinedAt: membership.CreatedAt,
+		})
+	}
+
+	usage, err := userUsage(user.ID)
+	if err != nil {
+		return profile, err
+	}
+	profile.Usage = usage
+
+	deletion, err := account.PendingDeletion(db.DB, user.ID)
+	switch {
+	case err == nil:
+		profile.DeletionScheduledFor = &deletion.ScheduledFor
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return profile, err
+	}
+
+	return profile, nil
+}
+
+func userUsage(userID uint) (profileUsage, error) {
+	now := time.Now().UTC()
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	usage := profileUsage{PeriodStartedAt: periodStart.Unix()}
+
+	personal := db.DB.Model(&db.Project{}).Select("id").Where("user_id = ? AND organization_id IS NULL", userID)
+	if err := db.DB.Model(&db.Project{}).Where("user_id = ? AND organization_id IS NULL", userID).Count(&usage.Projects).Error; err != nil {
+		return usage, err
+	}
+
+	var builds struct {
+		Count    int64
+		Duration int64
+	}
+	err := db.DB.Model(&db.Build{}).Select("COUNT(*) AS count, COALESCE(SUM(duration), 0) AS duration").
+		Where("project_id IN (?) AND created_at >= ?", personal, periodStart).Scan(&builds).Error
+	if err != nil {
+		return usage, err
+	}
+	usage.Builds = builds.Count
+	usage.BuildMinutes = (builds.Duration + 59) / 60
+
+	err = db.DB.Model(&db.Build{}).Where("project_id IN (?) AND status IN ?", personal, []string{"pending", "running"}).
+		Count(&usage.BuildsInProgress).Error
+	return usage, err
+}
+
+// validAvatarURL accepts absolute http(s) URLs, or an empty one to remove
+// the avatar
+func validAvatarURL(avatarURL string) bool {
+	if avatarURL == "" {
+		return true
+	}
+	if len(avatarURL) > maxAvatarURLLength {
+		return false
+	}
+	u, err := url.Parse(avatarURL)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
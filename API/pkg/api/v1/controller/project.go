@@ -3,13 +3,16 @@ package controller
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/flotio-dev/api/pkg/buildlog"
 	"github.com/flotio-dev/api/pkg/db"
 	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/policy"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
@@ -19,45 +22,64 @@ import (
 )
 
 // Projects
+
+// ProjectsGetHandler lists the projects the user holds a role on, personal
+// and from their organizations.
+//
+// Query parameters:
+//   - owner: "user" for personal projects only, "organization" for
+//     organization projects only
+//   - organization_id: only the projects of this organization
+//   - search: name contains, case-insensitive
 func ProjectsGetHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	principal := middleware.GetPrincipal(r.Context())
+
+	if principal.UserID == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	var user db.User
-	if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "User not found", http.StatusNotFound)
+	query := db.DB.Preload("Organization").Scopes(policy.VisibleProjects(principal.UserID))
+
+	params := r.URL.Query()
+	switch params.Get("owner") {
+	case "":
+	case "user":
+		query = query.Where("projects.organization_id IS NULL")
+	case "organization":
+		query = query.Where("projects.organization_id IS NOT NULL")
+	default:
+		http.Error(w, "Invalid owner, expected user or organization", http.StatusBadRequest)
+		return
+	}
+	if id := params.Get("organization_id"); id != "" {
+		organizationID, err := strconv.Atoi(id)
+		if err != nil {
+			http.Error(w, "Invalid organization ID", http.StatusBadRequest)
 			return
 		}
-		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
-		return
+		query = query.Where("projects.organization_id = ?", organizationID)
+	}
+	if search := params.Get("search"); search != "" {
+		query = query.Where("projects.name ILIKE ?", "%"+escapeLike(search)+"%")
 	}
 
 	var projects []db.Project
-	if err := db.DB.Where("user_id = ?", user.ID).Find(&projects).Error; err != nil {
+	if err := query.Order("projects.name ASC").Find(&projects).Error; err != nil {
 		http.Error(w, "Failed to fetch projects", http.StatusInternalServerError)
 		return
 	}
 
 	utils.WriteJSON(w, map[string]interface{}{"projects": projects})
 }
+
+// ProjectCreateHandler creates a personal project, or an organization
+// project when organization_id is set
 func ProjectCreateHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
-	var user db.User
-	if err := db.DB.Where("keycloak_id = ?", *userInfo.Sub).First(&user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+	if principal.UserID == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
@@ -66,6 +88,8 @@ func ProjectCreateHandler(w http.ResponseWriter, r *http.Request) {
 		GitRepo        string `json:"git_repo"`
 		BuildFolder    string `json:"build_folder,omitempty"`
 		FlutterVersion string `json:"flutter_version,omitempty"`
+		Analyze        bool   `json:"analyze,omitempty"`
+		OrganizationID *uint  `json:"organization_id,omitempty"`
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -77,7 +101,16 @@ func ProjectCreateHandler(w http.ResponseWriter, r *http.Request) {
 		GitRepo:        req.GitRepo,
 		BuildFolder:    req.BuildFolder,
 		FlutterVersion: req.FlutterVersion,
-		UserID:         user.ID,
+		Analyze:        req.Analyze,
+	}
+	if req.OrganizationID != nil {
+		organization, ok := authorizeOrganization(w, principal, int(*req.OrganizationID), policy.OrganizationProjectCreate)
+		if !ok {
+			return
+		}
+		project.OrganizationID = &organization.ID
+	} else {
+		project.UserID = &principal.UserID
 	}
 
 	if err := db.DB.Create(&project).Error; err != nil {
@@ -85,14 +118,17 @@ func ProjectCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	environments, err := db.EnsureEnvironments(db.DB, project.ID)
+	if err != nil {
+		http.Error(w, "Failed to create project environments", http.StatusInternalServerError)
+		return
+	}
+	project.Environments = environments
+
 	utils.WriteJSON(w, map[string]interface{}{"project": project})
 }
 func ProjectGetHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -101,12 +137,11 @@ func ProjectGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var project db.Project
-	if err := db.DB.Preload("Builds").Preload("Envs").Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).First(&project).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Project not found", http.StatusNotFound)
-			return
-		}
+	project, ok := authorizeProject(w, principal, projectID, policy.ProjectRead)
+	if !ok {
+		return
+	}
+	if err := db.DB.Preload("Builds").Preload("Envs").First(&project, project.ID).Error; err != nil {
 		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
 		return
 	}
@@ -114,11 +149,7 @@ func ProjectGetHandler(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, map[string]interface{}{"project": project})
 }
 func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -132,19 +163,15 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 		GitRepo        string `json:"git_repo,omitempty"`
 		BuildFolder    string `json:"build_folder,omitempty"`
 		FlutterVersion string `json:"flutter_version,omitempty"`
+		Analyze        *bool  `json:"analyze,omitempty"`
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	var project db.Project
-	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).First(&project).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Project not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+	project, ok := authorizeProject(w, principal, projectID, policy.ProjectUpdate)
+	if !ok {
 		return
 	}
 
@@ -160,6 +187,9 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 	if req.FlutterVersion != "" {
 		project.FlutterVersion = req.FlutterVersion
 	}
+	if req.Analyze != nil {
+		project.Analyze = *req.Analyze
+	}
 
 	if err := db.DB.Save(&project).Error; err != nil {
 		http.Error(w, "Failed to update project", http.StatusInternalServerError)
@@ -169,11 +199,7 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, map[string]interface{}{"project": project})
 }
 func ProjectDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -182,20 +208,94 @@ func ProjectDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).Delete(&db.Project{}).Error; err != nil {
+	project, ok := authorizeProject(w, principal, projectID, policy.ProjectDelete)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.Delete(&project).Error; err != nil {
 		http.Error(w, "Failed to delete project", http.StatusInternalServerError)
 		return
 	}
 
 	utils.WriteJSON(w, map[string]string{"status": "deleted"})
 }
-func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+// ProjectTransferHandler moves a project to an organization, or to the
+// caller's personal account. Builds, envs, secret files and artifacts belong
+// to the project and move with it; the inherited organization envs become
+// the ones of the new owner.
+func ProjectTransferHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
 		return
 	}
 
+	var req struct {
+		OrganizationID *uint `json:"organization_id,omitempty"`
+		UserID         *uint `json:"user_id,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.OrganizationID == nil) == (req.UserID == nil) {
+		http.Error(w, "Either organization_id or user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.ProjectTransfer)
+	if !ok {
+		return
+	}
+
+	if req.OrganizationID != nil {
+		organization, ok := authorizeOrganization(w, principal, int(*req.OrganizationID), policy.OrganizationProjectReceive)
+		if !ok {
+			return
+		}
+		if project.OrganizationID != nil && *project.OrganizationID == organization.ID {
+			http.Error(w, "The project already belongs to this organization", http.StatusBadRequest)
+			return
+		}
+		project.OrganizationID = &organization.ID
+		project.UserID = nil
+	} else {
+		// Nobody is handed a project without asking for it
+		if *req.UserID != principal.UserID {
+			http.Error(w, "Projects can only be transferred to your own account", http.StatusForbidden)
+			return
+		}
+		if project.OrganizationID == nil {
+			http.Error(w, "The project already belongs to you", http.StatusBadRequest)
+			return
+		}
+		project.OrganizationID = nil
+		project.UserID = &principal.UserID
+	}
+
+	if err := db.DB.Model(&project).Updates(map[string]interface{}{
+		"user_id":         project.UserID,
+		"organization_id": project.OrganizationID,
+	}).Error; err != nil {
+		http.Error(w, "Failed to transfer project", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.Preload("Organization").First(&project, project.ID).Error; err != nil {
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"project": project})
+}
+
+func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -204,27 +304,53 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Platform string `json:"platform,omitempty"` // e.g., android, ios
+		Platform    string `json:"platform,omitempty"`    // e.g., android, ios
+		Environment string `json:"environment,omitempty"` // defaults to the project's default environment
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		// If no body, use default
 		req.Platform = "android"
 	}
 
-	var project db.Project
-	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).First(&project).Error; err != nil {
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildCreate)
+	if !ok {
+		return
+	}
+	if emailVerificationRequired() && !principal.EmailVerified {
+		http.Error(w, "Verify your email address before starting builds", http.StatusForbidden)
+		return
+	}
+
+	environment, err := db.FindEnvironment(db.DB, project.ID, req.Environment)
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Project not found", http.StatusNotFound)
+			http.Error(w, "Environment not found", http.StatusBadRequest)
 			return
 		}
-		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch environment", http.StatusInternalServerError)
+		return
+	}
+
+	// Record which env set the build ran with
+	envRevision, err := latestEnvRevision(db.DB, project.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch env revision", http.StatusInternalServerError)
+		return
+	}
+
+	uploadToken, uploadTokenHash, err := generateUploadToken()
+	if err != nil {
+		http.Error(w, "Failed to create build", http.StatusInternalServerError)
 		return
 	}
 
 	build := db.Build{
-		ProjectID: project.ID,
-		Status:    "pending",
-		Platform:  req.Platform,
+		ProjectID:       project.ID,
+		Status:          "pending",
+		Platform:        req.Platform,
+		Environment:     environment.Name,
+		EnvRevision:     envRevision,
+		UploadTokenHash: uploadTokenHash,
 	}
 
 	if err := db.DB.Create(&build).Error; err != nil {
@@ -233,7 +359,7 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Start the build process by creating a Kubernetes pod
-	if err := kubernetes.CreateBuildPod(build.ID, project, req.Platform); err != nil {
+	if err := kubernetes.CreateBuildPod(build.ID, project, environment, req.Platform, uploadToken); err != nil {
 		// If pod creation fails, update build status to failed
 		build.Status = "failed"
 		db.DB.Save(&build)
@@ -245,15 +371,14 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 	build.Status = "running"
 	db.DB.Save(&build)
 
+	// The log is ingested whether or not anyone views it
+	go buildlog.Watch(context.Background(), build.ID, kubernetes.StreamPodLogs)
+
 	utils.WriteJSON(w, map[string]interface{}{"build": build})
 }
 
 func BuildCancelHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -267,8 +392,13 @@ func BuildCancelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildCancel)
+	if !ok {
+		return
+	}
+
 	var build db.Build
-	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Sub).First(&build).Error; err != nil {
+	if err := db.DB.Where("id = ? AND project_id = ?", buildID, project.ID).First(&build).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			http.Error(w, "Build not found", http.StatusNotFound)
 			return
@@ -277,21 +407,29 @@ func BuildCancelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	build.Status = "cancelled"
-	if err := db.DB.Save(&build).Error; err != nil {
+	// Only the status is written, the log watcher updates the build
+	// concurrently
+	res := db.DB.Model(&db.Build{}).Where("id = ? AND status IN ?", build.ID, []string{"pending", "running"}).
+		Update("status", "cancelled")
+	if res.Error != nil {
 		http.Error(w, "Failed to cancel build", http.StatusInternalServerError)
 		return
 	}
+	if res.RowsAffected == 0 {
+		http.Error(w, "Build is not running", http.StatusConflict)
+		return
+	}
+	build.Status = "cancelled"
+
+	if err := kubernetes.DeleteBuildPod(build.ID); err != nil {
+		log.Printf("Failed to delete the pod of build %d: %v", build.ID, err)
+	}
 
 	utils.WriteJSON(w, map[string]interface{}{"build": build})
 }
 
 func BuildsListHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -300,8 +438,13 @@ func BuildsListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildRead)
+	if !ok {
+		return
+	}
+
 	var builds []db.Build
-	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Sub).Find(&builds).Error; err != nil {
+	if err := db.DB.Where("project_id = ?", project.ID).Find(&builds).Error; err != nil {
 		http.Error(w, "Failed to fetch builds", http.StatusInternalServerError)
 		return
 	}
@@ -310,11 +453,7 @@ func BuildsListHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func BuildLogsHandler(w http.ResponseWriter, r *http.Request) {
-	userInfo := middleware.GetUserFromContext(r.Context())
-	if userInfo == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
 	vars := mux.Vars(r)
 	projectID, err := strconv.Atoi(vars["id"])
@@ -328,9 +467,13 @@ func BuildLogsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify the build belongs to the user's project
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildRead)
+	if !ok {
+		return
+	}
+
 	var build db.Build
-	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Sub).First(&build).Error; err != nil {
+	if err := db.DB.Where("id = ? AND project_id = ?", buildID, project.ID).First(&build).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			http.Error(w, "Build not found", http.StatusNotFound)
 			return
@@ -339,41 +482,71 @@ func BuildLogsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get logs from the Kubernetes pod
+	// Finished builds are served from storage, running ones from the pod
+	if build.LogArchiveKey != "" || build.LogsPurged {
+		logs, err := buildlog.Lines(r.Context(), build)
+		if err == buildlog.ErrLogsPurged {
+			http.Error(w, "Build logs have expired", http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJSON(w, map[string]interface{}{"logs": logs})
+		return
+	}
+
+	// Get logs from the Kubernetes pod, falling back to the saved lines once
+	// the pod is gone
 	logs, err := kubernetes.GetPodLogs(uint(buildID))
 	if err != nil {
-		http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
-		return
+		logs, err = buildlog.Lines(r.Context(), build)
+		if err != nil {
+			http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	utils.WriteJSON(w, map[string]interface{}{"logs": logs})
 }
 
+// logPollInterval is how often the log WebSocket looks for new lines
+const logPollInterval = time.Second
+
+// BuildLogsWSHandler streams the log of a build. It only tails the lines
+// saved by the build's watcher, see buildlog.Watch. The access token can be
+// passed in the token query parameter, see QueryTokenAuthMiddleware.
 func BuildLogsWSHandler(w http.ResponseWriter, r *http.Request) {
-	// Auth via query param
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
-	}
+	principal := middleware.GetPrincipal(r.Context())
 
-	// Validate token (simplified, in real app use proper validation)
-	client := utils.GetKeycloakClient()
-	ctx := context.Background()
-	realm := os.Getenv("KEYCLOAK_REALM")
-	_, err := client.GetUserInfo(ctx, token, realm)
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
 		return
 	}
-
-	vars := mux.Vars(r)
 	buildID, err := strconv.Atoi(vars["buildId"])
 	if err != nil {
 		http.Error(w, "Invalid build ID", http.StatusBadRequest)
 		return
 	}
 
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildRead)
+	if !ok {
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.Where("id = ? AND project_id = ?", buildID, project.ID).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true }, // Allow all origins for demo
 	}
@@ -384,52 +557,124 @@ func BuildLogsWSHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Stream logs from the Kubernetes pod
-	logChan := make(chan string, 100)
+	// Reading is only used to notice the client going away
+	gone := make(chan struct{})
 	go func() {
-		err := kubernetes.StreamPodLogs(uint(buildID), logChan)
-		if err != nil {
-			fmt.Printf("Error streaming pod logs: %v\n", err)
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
 		}
 	}()
 
-	// Get the current max line number for this build
-	var maxLine db.Log
-	if err := db.DB.Where("build_id = ?", buildID).Order("line_number DESC").First(&maxLine).Error; err != nil {
-		// If no logs exist, start from 1
-		maxLine.LineNumber = 0
-	}
-	lineNumber := maxLine.LineNumber + 1
-
-	for logLine := range logChan {
-		// Save log to database
-		logEntry := db.Log{
-			BuildID:    uint(buildID),
-			LineNumber: lineNumber,
-			Content:    logLine,
-			Timestamp:  time.Now().Unix(),
+	if err := tailBuildLog(r.Context(), conn, build.ID, gone); err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+		return
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// tailBuildLog sends the log of a build to conn as its watcher saves it,
+// until the build is done or gone is closed. The log is read from the
+// archive once the build is archived, which holds the same content as the
+// saved lines.
+func tailBuildLog(ctx context.Context, conn *websocket.Conn, buildID uint, gone <-chan struct{}) error {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	lastLine, sent := 0, 0
+	for {
+		var build db.Build
+		if err := db.DB.First(&build, buildID).Error; err != nil {
+			return fmt.Errorf("failed to fetch build: %v", err)
 		}
-		if err := db.DB.Create(&logEntry).Error; err != nil {
-			fmt.Printf("Failed to save log to database: %v\n", err)
+
+		if build.LogArchiveKey != "" || build.LogsPurged {
+			lines, err := buildlog.Lines(ctx, build)
+			if err != nil {
+				return err
+			}
+			if content := strings.Join(lines, ""); sent < len(content) {
+				return conn.WriteMessage(websocket.TextMessage, []byte(content[sent:]))
+			}
+			return nil
 		}
 
-		err := conn.WriteMessage(websocket.TextMessage, []byte(logLine))
-		if err != nil {
-			break
+		var logs []db.Log
+		if err := db.DB.Where("build_id = ? AND line_number > ?", buildID, lastLine).Order("line_number ASC").Find(&logs).Error; err != nil {
+			return fmt.Errorf("failed to fetch logs: %v", err)
+		}
+		for _, l := range logs {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(l.Content)); err != nil {
+				return nil
+			}
+			lastLine = l.LineNumber
+			sent += len(l.Content)
+		}
+
+		// Every line is saved before the build leaves running; the rows
+		// may have been archived in the meantime, which the next round
+		// picks up
+		if len(logs) == 0 && build.Status != "pending" && build.Status != "running" {
+			var archived int64
+			if err := db.DB.Model(&db.Build{}).Where("id = ? AND log_archive_key <> ''", buildID).Count(&archived).Error; err != nil {
+				return fmt.Errorf("failed to fetch build: %v", err)
+			}
+			if archived == 0 {
+				return nil
+			}
+			continue
+		}
+
+		select {
+		case <-gone:
+			return nil
+		case <-ticker.C:
 		}
-		lineNumber++
 	}
 }
 
-func BuildDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	if middleware.GetUserFromContext(r.Context()) == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func BuildStepsHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.BuildRead)
+	if !ok {
 		return
 	}
-	vars := mux.Vars(r)
-	// Simulate file download
-	filename := "app-" + vars["buildId"] + ".apk"
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	w.Write([]byte("fake apk content"))
+
+	var build db.Build
+	if err := db.DB.Where("id = ? AND project_id = ?", buildID, project.ID).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
+	var steps []db.BuildStep
+	if err := db.DB.Where("build_id = ?", build.ID).Order("position ASC").Find(&steps).Error; err != nil {
+		http.Error(w, "Failed to fetch build steps", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"steps": steps})
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
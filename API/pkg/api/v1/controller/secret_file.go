@@ -0,0 +1,376 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Build pods receive the secret files through a Kubernetes Secret, which is
+// limited to 1MiB
+const (
+	maxSecretFileSize  = 256 << 10
+	maxSecretFilesSize = 768 << 10
+)
+
+// Secret file handlers
+func SecretFilesGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.FileRead)
+	if !ok {
+		return
+	}
+
+	var files []db.SecretFile
+	if err := db.DB.Preload("Environments").Where("project_id = ?", project.ID).Order("path ASC").Find(&files).Error; err != nil {
+		http.Error(w, "Failed to fetch files", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"files": files})
+}
+
+// SecretFilePostHandler uploads a file as multipart/form-data with the
+// fields:
+//   - file: the content
+//   - path: target path in the repository, the uploaded file name by default
+//   - environments: repeated, the environments the file is written in
+func SecretFilePostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	form, ok := parseSecretFileForm(w, r)
+	if !ok {
+		return
+	}
+	content, filename, err := readSecretFile(form)
+	if err != nil {
+		writeSecretFileError(w, err)
+		return
+	}
+	if content == nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	path := formValue(form, "path")
+	if path == "" {
+		path = filename
+	}
+	if !secrets.ValidFilePath(path) {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.FileWrite)
+	if !ok {
+		return
+	}
+
+	environments, err := findEnvironments(project.ID, formEnvironments(form))
+	if err != nil {
+		if errors.Is(err, errUnknownEnvironment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return
+	}
+
+	file := db.SecretFile{
+		ProjectID:    project.ID,
+		Path:         path,
+		Environments: environments,
+	}
+	if status, msg := checkSecretFile(project.ID, file, len(content), 0); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	if err := setSecretFileContent(&file, content, principal.KeycloakID); err != nil {
+		http.Error(w, "Failed to encrypt file", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.Create(&file).Error; err != nil {
+		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"file": file})
+}
+
+// SecretFilePutByIdHandler takes the same fields as SecretFilePostHandler,
+// all optional. Sending an empty environments field makes the file apply to
+// every environment.
+func SecretFilePutByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	fileID, err := strconv.Atoi(vars["fileId"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	form, ok := parseSecretFileForm(w, r)
+	if !ok {
+		return
+	}
+	content, _, err := readSecretFile(form)
+	if err != nil {
+		writeSecretFileError(w, err)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.FileWrite)
+	if !ok {
+		return
+	}
+
+	var file db.SecretFile
+	if err := db.DB.Preload("Environments").Where("id = ? AND project_id = ?", fileID, project.ID).First(&file).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+		return
+	}
+
+	if path := formValue(form, "path"); path != "" {
+		if !secrets.ValidFilePath(path) {
+			http.Error(w, "Invalid file path", http.StatusBadRequest)
+			return
+		}
+		file.Path = path
+	}
+
+	_, scoped := form.Value["environments"]
+	if scoped {
+		file.Environments, err = findEnvironments(file.ProjectID, formEnvironments(form))
+		if err != nil {
+			if errors.Is(err, errUnknownEnvironment) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	size := file.Size
+	if content != nil {
+		size = len(content)
+	}
+	if status, msg := checkSecretFile(file.ProjectID, file, size, file.ID); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	if content != nil {
+		if err := setSecretFileContent(&file, content, principal.KeycloakID); err != nil {
+			http.Error(w, "Failed to encrypt file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Environments").Save(&file).Error; err != nil {
+			return err
+		}
+		if scoped {
+			return tx.Model(&file).Association("Environments").Replace(file.Environments)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to update file", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"file": file})
+}
+
+func SecretFileDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	fileID, err := strconv.Atoi(vars["fileId"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := authorizeProject(w, principal, projectID, policy.FileWrite)
+	if !ok {
+		return
+	}
+
+	var file db.SecretFile
+	if err := db.DB.Where("id = ? AND project_id = ?", fileID, project.ID).First(&file).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&file).Association("Environments").Clear(); err != nil {
+			return err
+		}
+		// Hard delete, the encrypted content has no reason to be kept
+		return tx.Unscoped().Delete(&file).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+var errSecretFileTooLarge = errors.New("file too large")
+
+// parseSecretFileForm reads the multipart body of an upload, writing the
+// error response when it fails
+func parseSecretFileForm(w http.ResponseWriter, r *http.Request) (*multipart.Form, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSecretFileSize+64<<10)
+	if err := r.ParseMultipartForm(maxSecretFileSize + 64<<10); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+		return nil, false
+	}
+	return r.MultipartForm, true
+}
+
+// readSecretFile returns the content and name of the uploaded file, a nil
+// content when none was sent
+func readSecretFile(form *multipart.Form) ([]byte, string, error) {
+	headers := form.File["file"]
+	if len(headers) == 0 {
+		return nil, "", nil
+	}
+
+	f, err := headers[0].Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, maxSecretFileSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(content) > maxSecretFileSize {
+		return nil, "", errSecretFileTooLarge
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return content, headers[0].Filename, nil
+}
+
+func writeSecretFileError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSecretFileTooLarge) {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Failed to read file", http.StatusBadRequest)
+}
+
+func formValue(form *multipart.Form, name string) string {
+	if values := form.Value[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// formEnvironments returns the environment names of the form, skipping the
+// empty ones
+func formEnvironments(form *multipart.Form) []string {
+	var names []string
+	for _, name := range form.Value["environments"] {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkSecretFile verifies that no other file of the project targets the same
+// path in an overlapping scope and that the project files fit in a build pod.
+// It returns the error status and message, 0 when the file is fine.
+func checkSecretFile(projectID uint, file db.SecretFile, size int, excludeID uint) (int, string) {
+	var others []db.SecretFile
+	if err := db.DB.Preload("Environments").Where("project_id = ? AND id <> ?", projectID, excludeID).Find(&others).Error; err != nil {
+		return http.StatusInternalServerError, "Failed to fetch files"
+	}
+
+	total := size
+	for _, other := range others {
+		if other.Path == file.Path && overlappingEnvironments(other.Environments, file.Environments) {
+			return http.StatusConflict, "A file already targets this path in this environment"
+		}
+		total += other.Size
+	}
+	if total > maxSecretFilesSize {
+		return http.StatusRequestEntityTooLarge, "Project files too large"
+	}
+	return 0, ""
+}
+
+// setSecretFileContent encrypts content into file and records who uploaded it
+func setSecretFileContent(file *db.SecretFile, content []byte, keycloakID string) error {
+	if err := secrets.EncryptFile(db.DB, file, content); err != nil {
+		return err
+	}
+	file.UploadedByID = nil
+
+	var user db.User
+	if err := db.DB.Where("keycloak_id = ?", keycloakID).First(&user).Error; err == nil {
+		file.UploadedByID = &user.ID
+	}
+	return nil
+}
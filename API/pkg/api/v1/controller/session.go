@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/keycloak"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm/clause"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// sessionView is an active Keycloak session of the caller
+type sessionView struct {
+	ID           string    `json:"id"`
+	IPAddress    string    `json:"ip_address"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	Clients      []string  `json:"clients"`
+	StartedAt    time.Time `json:"started_at"`
+	LastAccessAt time.Time `json:"last_access_at"`
+	Current      bool      `json:"current"` // the session of the request
+}
+
+// LogoutHandler ends the session of a refresh token in Keycloak, its access
+// tokens stay valid until they expire
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	client := utils.GetKeycloakClient()
+	ctx := context.Background()
+	realm := os.Getenv("KEYCLOAK_REALM")
+	clientID := os.Getenv("KEYCLOAK_CLIENT_ID")
+	clientSecret := os.Getenv("KEYCLOAK_CLIENT_SECRET")
+
+	if err := client.Logout(ctx, clientID, clientSecret, realm, body.RefreshToken); err != nil {
+		var apiErr *gocloak.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Logout failed: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	if sessionID := tokenSessionID(body.RefreshToken); sessionID != "" {
+		forgetLoginSession(sessionID)
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "logged_out"})
+}
+
+// SessionsGetHandler lists the active sessions of the caller, most recently
+// used first
+func SessionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	sessions, err := keycloak.Default.UserSessions(r.Context(), principal.KeycloakID)
+	if err != nil {
+		log.Printf("Failed to fetch sessions of %s: %v", principal.KeycloakID, err)
+		http.Error(w, "Failed to fetch sessions", http.StatusBadGateway)
+		return
+	}
+
+	var devices []db.LoginSession
+	if err := db.DB.Where("keycloak_id = ?", principal.KeycloakID).Find(&devices).Error; err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	deviceOf := map[string]db.LoginSession{}
+	for _, device := range devices {
+		deviceOf[device.SessionID] = device
+	}
+
+	current := ""
+	if principal.Claims != nil {
+		current = principal.Claims.SessionID
+	}
+
+	result := make([]sessionView, 0, len(sessions))
+	active := map[string]bool{}
+	for _, session := range sessions {
+		view := sessionView{
+			ID:           gocloak.PString(session.ID),
+			IPAddress:    gocloak.PString(session.IPAddress),
+			Clients:      []string{},
+			StartedAt:    time.UnixMilli(gocloak.PInt64(session.Start)),
+			LastAccessAt: time.UnixMilli(gocloak.PInt64(session.LastAccess)),
+		}
+		view.Current = view.ID == current
+		if device, ok := deviceOf[view.ID]; ok {
+			view.IPAddress = device.IPAddress
+			view.UserAgent = device.UserAgent
+		}
+		if session.Clients != nil {
+			for _, client := range *session.Clients {
+				view.Clients = append(view.Clients, client)
+			}
+			sort.Strings(view.Clients)
+		}
+		active[view.ID] = true
+		result = append(result, view)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastAccessAt.After(result[j].LastAccessAt) })
+
+	// Sessions that expired in Keycloak are forgotten
+	for _, device := range devices {
+		if !active[device.SessionID] {
+			forgetLoginSession(device.SessionID)
+		}
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"sessions": result})
+}
+
+// SessionDeleteHandler ends one of the caller's sessions, the current one
+// included
+func SessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+	sessionID := mux.Vars(r)["id"]
+
+	sessions, err := keycloak.Default.UserSessions(r.Context(), principal.KeycloakID)
+	if err != nil {
+		log.Printf("Failed to fetch sessions of %s: %v", principal.KeycloakID, err)
+		http.Error(w, "Failed to fetch sessions", http.StatusBadGateway)
+		return
+	}
+	found := false
+	for _, session := range sessions {
+		if gocloak.PString(session.ID) == sessionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := keycloak.Default.DeleteSession(r.Context(), sessionID); err != nil {
+		log.Printf("Failed to delete session %s: %v", sessionID, err)
+		http.Error(w, "Failed to delete session", http.StatusBadGateway)
+		return
+	}
+	forgetLoginSession(sessionID)
+
+	utils.WriteJSON(w, map[string]string{"status": "revoked"})
+}
+
+// recordLoginSession remembers the device a session was opened from.
+// Failures are only logged, the session is listed without it.
+func recordLoginSession(r *http.Request, token *gocloak.JWT) {
+	var claims auth.Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token.AccessToken, &claims); err != nil {
+		log.Printf("Failed to read the session of a new token: %v", err)
+		return
+	}
+	sessionID := claims.SessionID
+	if sessionID == "" {
+		sessionID = token.SessionState
+	}
+	if sessionID == "" || claims.Subject == "" {
+		return
+	}
+
+	device := db.LoginSession{
+		SessionID:  sessionID,
+		KeycloakID: claims.Subject,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  utils.ClientIP(r),
+	}
+	if err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&device).Error; err != nil {
+		log.Printf("Failed to record session %s: %v", sessionID, err)
+	}
+}
+
+func forgetLoginSession(sessionID string) {
+	if err := db.DB.Unscoped().Where("session_id = ?", sessionID).Delete(&db.LoginSession{}).Error; err != nil {
+		log.Printf("Failed to delete session %s: %v", sessionID, err)
+	}
+}
+
+// tokenSessionID returns the session of a Keycloak token. The token is not
+// verified, only use it once Keycloak accepted the token.
+func tokenSessionID(token string) string {
+	var claims auth.Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return ""
+	}
+	return claims.SessionID
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// Personal access tokens expire after 90 days unless asked otherwise, and
+// never live longer than a year
+const (
+	defaultAccessTokenLifetime = 90 * 24 * time.Hour
+	maxAccessTokenLifetime     = 365 * 24 * time.Hour
+)
+
+// accessTokenPrefixLength is how much of a token is kept in clear to tell
+// tokens apart in listings
+const accessTokenPrefixLength = len(auth.TokenPrefix) + 4
+
+// Personal access token handlers
+func TokensGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+	if principal.UserID == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var tokens []db.AccessToken
+	if err := db.DB.Where("user_id = ?", principal.UserID).Order("created_at DESC").Find(&tokens).Error; err != nil {
+		http.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"tokens": tokens})
+}
+
+// TokenPostHandler creates a token. The plaintext token is only part of this
+// response, only its hash is stored.
+func TokenPostHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+	if principal.UserID == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Missing token name", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			http.Error(w, "Invalid scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultAccessTokenLifetime)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) {
+		http.Error(w, "Expiration must be in the future", http.StatusBadRequest)
+		return
+	}
+	if expiresAt.After(now.Add(maxAccessTokenLifetime)) {
+		http.Error(w, "Tokens cannot live longer than a year", http.StatusBadRequest)
+		return
+	}
+
+	token, hash, err := auth.GenerateAccessToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := db.AccessToken{
+		UserID:    principal.UserID,
+		Name:      req.Name,
+		Prefix:    token[:accessTokenPrefixLength],
+		TokenHash: hash,
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := db.DB.Create(&accessToken).Error; err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"token":        accessToken,
+		"access_token": token,
+	})
+}
+
+// TokenDeleteByIdHandler revokes a token, it stays listed for auditing
+func TokenDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	principal := middleware.GetPrincipal(r.Context())
+
+	vars := mux.Vars(r)
+	tokenID, err := strconv.Atoi(vars["tokenId"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	var accessToken db.AccessToken
+	if err := db.DB.Where("id = ? AND user_id = ?", tokenID, principal.UserID).First(&accessToken).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch token", http.StatusInternalServerError)
+		return
+	}
+
+	if accessToken.RevokedAt == nil {
+		now := time.Now()
+		accessToken.RevokedAt = &now
+		if err := db.DB.Model(&accessToken).Update("revoked_at", now).Error; err != nil {
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "revoked"})
+}
@@ -2,48 +2,349 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/Nerzal/gocloak/v13"
-	utils "github.com/flotio-dev/api/pkg/utils"
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/policy"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type contextKey string
 
-const userContextKey contextKey = "user"
+const principalContextKey contextKey = "principal"
 
+// Error codes of the 401 responses
+const (
+	ErrorTokenMissing = "token_missing"
+	ErrorTokenExpired = "token_expired"
+	ErrorTokenInvalid = "token_invalid"
+)
+
+// ErrEmailTaken is returned when a user cannot be provisioned because
+// another local user has its email
+var ErrEmailTaken = errors.New("email already used by another user")
+
+// ErrAccountDeleted is returned for the tokens of a deleted account, which
+// stay valid until they expire
+var ErrAccountDeleted = errors.New("account deleted")
+
+// EmailVerified is called when a user is provisioned with a verified email
+// address, or when their claims first report it verified. Set by the router
+// to join the organizations that invited the address.
+var EmailVerified func(ctx context.Context, user db.User)
+
+// lastUsedResolution bounds how often the last use of an access token is
+// written
+const lastUsedResolution = time.Minute
+
+// AuthMiddleware only lets requests with a valid bearer token through: a
+// Keycloak access token, verified locally with the realm's signing keys, or
+// a personal access token allowed on the route. The resulting principal is
+// stored in the context. Public routes must be registered outside of the
+// routers using it.
 func AuthMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, bearerToken)
+}
+
+// QueryTokenAuthMiddleware is AuthMiddleware for WebSocket routes: browsers
+// cannot set headers on the upgrade request, so the token may be passed in
+// the token query parameter instead
+func QueryTokenAuthMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, func(r *http.Request) string {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token
+		}
+		return bearerToken(r)
+	})
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return token
+}
+
+func authenticate(next http.Handler, tokenOf func(r *http.Request) string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" || len(authHeader) < 7 || authHeader[:7] != "Bearer " {
-			next.ServeHTTP(w, r)
+		token := tokenOf(r)
+		if token == "" {
+			unauthorized(w, ErrorTokenMissing, "Missing bearer token")
 			return
 		}
-		token := authHeader[7:]
 
-		client := utils.GetKeycloakClient()
-		ctx := context.Background()
-		realm := os.Getenv("KEYCLOAK_REALM")
+		if auth.IsAccessToken(token) {
+			principal, code, err := accessTokenPrincipal(token)
+			if err != nil {
+				http.Error(w, "Failed to load access token", http.StatusInternalServerError)
+				return
+			}
+			if code != "" {
+				unauthorized(w, code, "Invalid or expired access token")
+				return
+			}
 
-		// Get user info from token
-		userInfo, err := client.GetUserInfo(ctx, token, realm)
-		if err != nil {
+			scope, allowed := "", false
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					scope, allowed = auth.RequiredScope(r.Method, template)
+				}
+			}
+			if !allowed {
+				http.Error(w, "Access tokens cannot be used on this route", http.StatusForbidden)
+				return
+			}
+			if !principal.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope", scope=%q`, realm(), scope))
+				http.Error(w, "Access token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			r = r.WithContext(WithPrincipal(r.Context(), principal))
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Add user info to context
-		ctxWithUser := context.WithValue(r.Context(), userContextKey, userInfo)
-		r = r.WithContext(ctxWithUser)
+		claims, err := auth.Tokens.Verify(r.Context(), token)
+		switch {
+		case err == nil:
+		case errors.Is(err, jwt.ErrTokenExpired):
+			unauthorized(w, ErrorTokenExpired, "The access token expired")
+			return
+		case auth.KeysUnavailable(err):
+			// The signing keys could not be fetched, the token may be fine
+			log.Printf("Token verification unavailable: %v", err)
+			http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		default:
+			unauthorized(w, ErrorTokenInvalid, "Invalid access token")
+			return
+		}
+
+		principal, err := newPrincipal(r.Context(), claims)
+		if errors.Is(err, ErrEmailTaken) {
+			http.Error(w, "The email of this account is already used by another user", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrAccountDeleted) {
+			http.Error(w, "Account deleted", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load user", http.StatusInternalServerError)
+			return
+		}
 
+		r = r.WithContext(WithPrincipal(r.Context(), principal))
 		next.ServeHTTP(w, r)
 	})
 }
 
-func GetUserFromContext(ctx context.Context) *gocloak.UserInfo {
-	if user, ok := ctx.Value(userContextKey).(*gocloak.UserInfo); ok {
-		return user
+// WithPrincipal returns a copy of ctx carrying principal, as AuthMiddleware
+// does for the requests it lets through
+func WithPrincipal(ctx context.Context, principal *auth.Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, principal)
+}
+
+// GetPrincipal returns the caller of a request that went through
+// AuthMiddleware
+func GetPrincipal(ctx context.Context) *auth.Principal {
+	if principal, ok := ctx.Value(principalContextKey).(*auth.Principal); ok {
+		return principal
 	}
 	return nil
 }
+
+// newPrincipal builds the principal of verified claims, with the local user
+// and organization memberships
+func newPrincipal(ctx context.Context, claims *auth.Claims) (*auth.Principal, error) {
+	principal := &auth.Principal{
+		KeycloakID:    claims.Subject,
+		Username:      claims.PreferredUsername,
+		Email:         claims.Email,
+		Roles:         claims.RealmAccess.Roles,
+		Organizations: []uint{},
+		Claims:        claims,
+	}
+
+	user, err := provisionUser(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	principal.UserID = user.ID
+	principal.EmailVerified = user.EmailVerified
+
+	if err := loadOrganizations(principal); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+// provisionUser returns the local user of the claims, created on their first
+// request for accounts made outside RegisterHandler (social login, admin
+// console). Its email and username follow the claims when they change.
+func provisionUser(ctx context.Context, claims *auth.Claims) (db.User, error) {
+	var user db.User
+	if err := db.DB.Where("keycloak_id = ?", claims.Subject).Limit(1).Find(&user).Error; err != nil {
+		return user, err
+	}
+
+	if user.ID == 0 {
+		var deleted int64
+		if err := db.DB.Model(&db.AccountDeletion{}).Where("keycloak_id = ? AND completed_at IS NOT NULL", claims.Subject).Count(&deleted).Error; err != nil {
+			return user, err
+		}
+		if deleted > 0 {
+			return user, ErrAccountDeleted
+		}
+
+		user = db.User{
+			KeycloakID:    claims.Subject,
+			Email:         claims.Email,
+			Username:      claims.PreferredUsername,
+			EmailVerified: claims.EmailVerified,
+		}
+		// Concurrent first requests of the same user insert only one row
+		err := db.DB.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "keycloak_id"}}, DoNothing: true}).Create(&user).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return user, ErrEmailTaken
+		}
+		if err != nil {
+			return user, err
+		}
+		if user.ID == 0 {
+			if err := db.DB.Where("keycloak_id = ?", claims.Subject).First(&user).Error; err != nil {
+				return user, err
+			}
+		}
+		log.Printf("Provisioned user %d for Keycloak user %s", user.ID, claims.Subject)
+		if user.EmailVerified {
+			emailVerified(ctx, user)
+		}
+		return user, nil
+	}
+
+	// Tokens issued before the last change of the user, through the API,
+	// carry outdated claims
+	if claims.IssuedAt != nil && claims.IssuedAt.Before(user.UpdatedAt) {
+		return user, nil
+	}
+
+	changes := map[string]interface{}{}
+	if claims.Email != "" && claims.Email != user.Email {
+		changes["email"] = claims.Email
+		changes["email_verified"] = claims.EmailVerified
+	} else if claims.EmailVerified && !user.EmailVerified {
+		changes["email_verified"] = true
+	}
+	if claims.PreferredUsername != "" && claims.PreferredUsername != user.Username {
+		changes["username"] = claims.PreferredUsername
+	}
+	if len(changes) > 0 {
+		// A failed sync keeps the previous values, the request goes on
+		if err := db.DB.Model(&user).Updates(changes).Error; err != nil {
+			log.Printf("Failed to sync user %d with its claims: %v", user.ID, err)
+			return user, nil
+		}
+		if email, ok := changes["email"].(string); ok {
+			user.Email = email
+		}
+		if username, ok := changes["username"].(string); ok {
+			user.Username = username
+		}
+		if verified, ok := changes["email_verified"].(bool); ok {
+			user.EmailVerified = verified
+			if verified {
+				emailVerified(ctx, user)
+			}
+		}
+	}
+	return user, nil
+}
+
+func emailVerified(ctx context.Context, user db.User) {
+	if EmailVerified != nil {
+		EmailVerified(ctx, user)
+	}
+}
+
+// accessTokenPrincipal builds the principal of a personal access token. The
+// returned code is set when the token is not usable.
+func accessTokenPrincipal(token string) (*auth.Principal, string, error) {
+	var accessToken db.AccessToken
+	if err := db.DB.Preload("User").Where("token_hash = ?", auth.HashAccessToken(token)).Limit(1).Find(&accessToken).Error; err != nil {
+		return nil, "", err
+	}
+	if accessToken.ID == 0 || accessToken.RevokedAt != nil || accessToken.User == nil {
+		return nil, ErrorTokenInvalid, nil
+	}
+	now := time.Now()
+	if now.After(accessToken.ExpiresAt) {
+		return nil, ErrorTokenExpired, nil
+	}
+
+	if accessToken.LastUsedAt == nil || now.Sub(*accessToken.LastUsedAt) > lastUsedResolution {
+		if err := db.DB.Model(&accessToken).UpdateColumn("last_used_at", now).Error; err != nil {
+			log.Printf("Failed to record access token use: %v", err)
+		}
+	}
+
+	principal := &auth.Principal{
+		KeycloakID:    accessToken.User.KeycloakID,
+		UserID:        accessToken.User.ID,
+		Username:      accessToken.User.Username,
+		Email:         accessToken.User.Email,
+		EmailVerified: accessToken.User.EmailVerified,
+		Roles:         []string{},
+		Organizations: []uint{},
+		TokenID:       accessToken.ID,
+		Scopes:        accessToken.Scopes,
+	}
+	if err := loadOrganizations(principal); err != nil {
+		return nil, "", err
+	}
+	return principal, "", nil
+}
+
+// loadOrganizations sets the organizations the principal's user is a member
+// of
+func loadOrganizations(principal *auth.Principal) error {
+	organizations, err := policy.MemberOrganizations(db.DB, principal.UserID)
+	if err != nil {
+		return err
+	}
+	principal.Organizations = organizations
+	return nil
+}
+
+// unauthorized writes a 401 response following RFC 6750
+func unauthorized(w http.ResponseWriter, code, message string) {
+	challenge := fmt.Sprintf(`Bearer realm=%q`, realm())
+	if code != ErrorTokenMissing {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, message)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "message": message})
+}
+
+func realm() string {
+	if realm := os.Getenv("KEYCLOAK_REALM"); realm != "" {
+		return realm
+	}
+	return "flotio"
+}
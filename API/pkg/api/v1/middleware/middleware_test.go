@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/auth"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func claimsFor(subject, email string) *auth.Claims {
+	return &auth.Claims{
+		RegisteredClaims:  jwt.RegisteredClaims{Subject: subject},
+		PreferredUsername: subject,
+		Email:             email,
+	}
+}
+
+func TestProvisionUserWithoutEmail(t *testing.T) {
+	dbtest.Open(t)
+	suffix := time.Now().UnixNano()
+
+	// Service accounts and identity providers may not share an email
+	first, err := provisionUser(context.Background(), claimsFor(fmt.Sprintf("no-email-a-%d", suffix), ""))
+	if err != nil {
+		t.Fatalf("first user: %v", err)
+	}
+	second, err := provisionUser(context.Background(), claimsFor(fmt.Sprintf("no-email-b-%d", suffix), ""))
+	if err != nil {
+		t.Fatalf("second user: %v", err)
+	}
+	if first.ID == 0 || second.ID == 0 || first.ID == second.ID {
+		t.Errorf("provisioned users %d and %d, want two distinct users", first.ID, second.ID)
+	}
+
+	// Their next requests find them again
+	again, err := provisionUser(context.Background(), claimsFor(fmt.Sprintf("no-email-b-%d", suffix), ""))
+	if err != nil || again.ID != second.ID {
+		t.Errorf("second request = user %d, %v, want user %d", again.ID, err, second.ID)
+	}
+}
+
+func TestProvisionUserEmailTaken(t *testing.T) {
+	dbtest.Open(t)
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("taken-%d@example.com", suffix)
+
+	if _, err := provisionUser(context.Background(), claimsFor(fmt.Sprintf("taken-a-%d", suffix), email)); err != nil {
+		t.Fatalf("first user: %v", err)
+	}
+	_, err := provisionUser(context.Background(), claimsFor(fmt.Sprintf("taken-b-%d", suffix), email))
+	if !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("second user error = %v, want ErrEmailTaken", err)
+	}
+}
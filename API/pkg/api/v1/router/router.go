@@ -1,7 +1,6 @@
 package router
 
 import (
-	"fmt"
 	"net/http"
 	"os"
 
@@ -14,56 +13,127 @@ import (
 func Router() http.Handler {
 	r := mux.NewRouter()
 
+	// Users provisioned with a verified email join the organizations that
+	// invited it
+	middleware.EmailVerified = controller.AcceptPendingInvitations
+
 	// Public auth routes
 	r.HandleFunc("/auth/register", controller.RegisterHandler).Methods("POST")
 	r.HandleFunc("/auth/login", controller.LoginHandler).Methods("POST")
 	r.HandleFunc("/auth/refresh", controller.RefreshTokenHandler).Methods("POST")
+	r.HandleFunc("/auth/logout", controller.LogoutHandler).Methods("POST")
+	r.HandleFunc("/auth/password/forgot", controller.PasswordForgotHandler).Methods("POST")
+	r.HandleFunc("/auth/password/reset", controller.PasswordResetHandler).Methods("POST")
+	r.HandleFunc("/auth/email/verify", controller.EmailVerifyHandler).Methods("POST")
 	r.HandleFunc("/auth/github/callback", controller.GithubCallbackHandler).Methods("GET")
 
+	// Github webhooks (public, verified with the webhook secret)
+	githubController := controller.NewGithubController([]byte(os.Getenv("GITHUB_WEBHOOK_SECRET")))
+	r.HandleFunc("/github/webhooks", githubController.HandleWebhook).Methods("POST")
+
+	// Artifact upload from the build pods (public, verified with the
+	// upload token of the build)
+	r.HandleFunc("/builds/{buildId}/artifact", controller.BuildArtifactUploadHandler).Methods("PUT")
+
+	// Build log WebSocket, authenticated like the protected routes but
+	// with the token in the query
+	r.Handle("/project/{id}/build/{buildId}/logs/ws", middleware.QueryTokenAuthMiddleware(http.HandlerFunc(controller.BuildLogsWSHandler))).Methods("GET")
+
 	// Health check
 	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 		w.Write([]byte("ok"))
 	}).Methods("GET")
 
-	// Protected routes
+	// Protected routes, everything not registered above requires a valid
+	// bearer token
 	protected := r.PathPrefix("/").Subrouter()
 	protected.Use(middleware.AuthMiddleware)
 
 	// Protected auth routes
 	protected.HandleFunc("/auth/@me", controller.MeGetHandler).Methods("GET")
 	protected.HandleFunc("/auth/@me", controller.MePutHandler).Methods("PUT")
+	protected.HandleFunc("/auth/@me", controller.MeDeleteHandler).Methods("DELETE")
+	protected.HandleFunc("/auth/@me/export", controller.MeExportHandler).Methods("GET")
+	protected.HandleFunc("/auth/@me/deletion", controller.MeDeletionGetHandler).Methods("GET")
+	protected.HandleFunc("/auth/@me/deletion", controller.MeDeletionDeleteHandler).Methods("DELETE")
+	protected.HandleFunc("/auth/password/change", controller.PasswordChangeHandler).Methods("POST")
+	protected.HandleFunc("/auth/email/verification", controller.EmailVerificationPostHandler).Methods("POST")
+	protected.HandleFunc("/auth/sessions", controller.SessionsGetHandler).Methods("GET")
+	protected.HandleFunc("/auth/sessions/{id}", controller.SessionDeleteHandler).Methods("DELETE")
+
+	// Personal access token routes, only usable with a session token
+	protected.HandleFunc("/tokens", controller.TokensGetHandler).Methods("GET")
+	protected.HandleFunc("/tokens", controller.TokenPostHandler).Methods("POST")
+	protected.HandleFunc("/tokens/{tokenId}", controller.TokenDeleteByIdHandler).Methods("DELETE")
 
-	// Github route (protected)
+	// Github routes (protected)
 	protected.HandleFunc("/github", controller.GithubHandler).Methods("GET")
+	protected.HandleFunc("/github", controller.GithubDeleteHandler).Methods("DELETE")
 
 	// Env routes (by project)
 	protected.HandleFunc("/project/{id}/env", controller.EnvGetHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/env", controller.EnvPostHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}/envs", controller.EnvGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/envs", controller.EnvsPutHandler).Methods("PUT")
+	protected.HandleFunc("/project/{id}/envs/effective", controller.EnvsEffectiveGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/envs/revisions", controller.EnvRevisionsGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/envs/revisions/{revision}/restore", controller.EnvRevisionRestoreHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvGetByIdHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvPutByIdHandler).Methods("PUT")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvDeleteByIdHandler).Methods("DELETE")
 
+	// Organization routes
+	protected.HandleFunc("/organization", controller.OrganizationsGetHandler).Methods("GET")
+	protected.HandleFunc("/organization", controller.OrganizationPostHandler).Methods("POST")
+	protected.HandleFunc("/organization/{id}", controller.OrganizationGetHandler).Methods("GET")
+	protected.HandleFunc("/organization/{id}", controller.OrganizationPutHandler).Methods("PUT")
+	protected.HandleFunc("/organization/{id}", controller.OrganizationDeleteHandler).Methods("DELETE")
+	protected.HandleFunc("/organization/{id}/members", controller.OrganizationMembersGetHandler).Methods("GET")
+	protected.HandleFunc("/organization/{id}/members", controller.OrganizationMemberPostHandler).Methods("POST")
+	protected.HandleFunc("/organization/{id}/members/{userId}", controller.OrganizationMemberPutHandler).Methods("PUT")
+	protected.HandleFunc("/organization/{id}/members/{userId}", controller.OrganizationMemberDeleteHandler).Methods("DELETE")
+
+	// Organization invitation routes
+	protected.HandleFunc("/organization/{id}/invitations", controller.OrganizationInvitationsGetHandler).Methods("GET")
+	protected.HandleFunc("/organization/{id}/invitations", controller.OrganizationInvitationPostHandler).Methods("POST")
+	protected.HandleFunc("/organization/{id}/invitations/{invitationId}/resend", controller.OrganizationInvitationResendHandler).Methods("POST")
+	protected.HandleFunc("/organization/{id}/invitations/{invitationId}", controller.OrganizationInvitationDeleteHandler).Methods("DELETE")
+	protected.HandleFunc("/invitations/accept", controller.InvitationAcceptHandler).Methods("POST")
+
+	// Env routes (by organization), inherited by the organization's projects
+	protected.HandleFunc("/organization/{id}/envs", controller.OrganizationEnvsGetHandler).Methods("GET")
+	protected.HandleFunc("/organization/{id}/envs", controller.OrganizationEnvPostHandler).Methods("POST")
+	protected.HandleFunc("/organization/{id}/envs/{envId}", controller.OrganizationEnvPutByIdHandler).Methods("PUT")
+	protected.HandleFunc("/organization/{id}/envs/{envId}", controller.OrganizationEnvDeleteByIdHandler).Methods("DELETE")
+
+	// Secret file routes (by project)
+	protected.HandleFunc("/project/{id}/files", controller.SecretFilesGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/files", controller.SecretFilePostHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/files/{fileId}", controller.SecretFilePutByIdHandler).Methods("PUT")
+	protected.HandleFunc("/project/{id}/files/{fileId}", controller.SecretFileDeleteByIdHandler).Methods("DELETE")
+
+	// Environment routes (by project)
+	protected.HandleFunc("/project/{id}/environments", controller.EnvironmentsGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/environments", controller.EnvironmentPostHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/environments/{environmentId}", controller.EnvironmentPutByIdHandler).Methods("PUT")
+	protected.HandleFunc("/project/{id}/environments/{environmentId}", controller.EnvironmentDeleteByIdHandler).Methods("DELETE")
+
 	// Project routes
 	protected.HandleFunc("/project", controller.ProjectsGetHandler).Methods("GET")
 	protected.HandleFunc("/project", controller.ProjectCreateHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}", controller.ProjectGetHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}", controller.ProjectPutHandler).Methods("PUT")
 	protected.HandleFunc("/project/{id}", controller.ProjectDeleteHandler).Methods("DELETE")
+	protected.HandleFunc("/project/{id}/transfer", controller.ProjectTransferHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}/build", controller.ProjectBuildHandler).Methods("POST")
 
 	// Build routes
 	protected.HandleFunc("/project/{id}/build/{buildId}/cancel", controller.BuildCancelHandler).Methods("PUT")
 	protected.HandleFunc("/project/{id}/builds", controller.BuildsListHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/build/{buildId}/logs", controller.BuildLogsHandler).Methods("GET")
-	protected.HandleFunc("/project/{id}/build/{buildId}/logs/ws", controller.BuildLogsWSHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/build/{buildId}/steps", controller.BuildStepsHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/build/{buildId}/download", controller.BuildDownloadHandler).Methods("GET")
 
-	// Github routes
-	fmt.Printf("Webhook secret: '%s'\n", os.Getenv("GITHUB_WEBHOOK_SECRET"))
-	githubController := controller.NewGithubController([]byte(os.Getenv("GITHUB_WEBHOOK_SECRET")))
-	protected.HandleFunc("/github/webhooks", githubController.HandleWebhook)
-
 	return r
 }
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyServer is a JWKS endpoint serving a set of locally generated keys
+type keyServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []jwk
+	status   int
+	requests int
+}
+
+func newKeyServer(t *testing.T) *keyServer {
+	t.Helper()
+	s := &keyServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *keyServer) setKeys(keys ...jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *keyServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *keyServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		Kid: kid,
+		Kty: "RSA",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kid: kid,
+		Kty: "EC",
+		Use: "sig",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func TestJWKSKeyTypes(t *testing.T) {
+	server := newKeyServer(t)
+	rsaKey := newRSAKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	encryption := rsaJWK("enc", &rsaKey.PublicKey)
+	encryption.Use = "enc"
+	server.setKeys(rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey), encryption, jwk{Kid: "oct", Kty: "oct"})
+
+	keys := NewJWKS(server.URL)
+	ctx := context.Background()
+
+	got, err := keys.Key(ctx, "rsa")
+	if err != nil {
+		t.Fatalf("Key(rsa): %v", err)
+	}
+	if !rsaKey.PublicKey.Equal(got) {
+		t.Errorf("Key(rsa) returned another key")
+	}
+	got, err = keys.Key(ctx, "ec")
+	if err != nil {
+		t.Fatalf("Key(ec): %v", err)
+	}
+	if !ecKey.PublicKey.Equal(got) {
+		t.Errorf("Key(ec) returned another key")
+	}
+	for _, kid := range []string{"enc", "oct"} {
+		if _, err := keys.Key(ctx, kid); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Key(%s) error = %v, want ErrUnknownKey", kid, err)
+		}
+	}
+}
+
+func TestJWKSUnknownKidRefreshes(t *testing.T) {
+	server := newKeyServer(t)
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	server.setKeys(rsaJWK("old", &oldKey.PublicKey))
+
+	keys := NewJWKS(server.URL)
+	keys.MinRefreshInterval = 0
+	ctx := context.Background()
+
+	if _, err := keys.Key(ctx, "old"); err != nil {
+		t.Fatalf("Key(old): %v", err)
+	}
+
+	// The provider rotated its keys
+	server.setKeys(rsaJWK("old", &oldKey.PublicKey), rsaJWK("new", &newKey.PublicKey))
+	got, err := keys.Key(ctx, "new")
+	if err != nil {
+		t.Fatalf("Key(new): %v", err)
+	}
+	if !newKey.PublicKey.Equal(got) {
+		t.Errorf("Key(new) returned another key")
+	}
+	if n := server.requestCount(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+
+	// Known keys are served from the cache
+	if _, err := keys.Key(ctx, "old"); err != nil {
+		t.Fatalf("Key(old): %v", err)
+	}
+	if n := server.requestCount(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestJWKSUnknownKidRefreshIsRateLimited(t *testing.T) {
+	server := newKeyServer(t)
+	key := newRSAKey(t)
+	server.setKeys(rsaJWK("known", &key.PublicKey))
+
+	keys := NewJWKS(server.URL)
+	keys.MinRefreshInterval = time.Hour
+	ctx := context.Background()
+
+	if _, err := keys.Key(ctx, "known"); err != nil {
+		t.Fatalf("Key(known): %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := keys.Key(ctx, "forged"); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Key(forged) error = %v, want ErrUnknownKey", err)
+		}
+	}
+	if n := server.requestCount(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+
+	// Once the interval is over an unknown kid triggers a single refresh
+	keys.fetchedAt = time.Now().Add(-2 * time.Hour)
+	keys.TTL = 24 * time.Hour
+	if _, err := keys.Key(ctx, "forged"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(forged) error = %v, want ErrUnknownKey", err)
+	}
+	if n := server.requestCount(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestJWKSKeepsKeysWhenRefreshFails(t *testing.T) {
+	server := newKeyServer(t)
+	key := newRSAKey(t)
+	server.setKeys(rsaJWK("known", &key.PublicKey))
+
+	keys := NewJWKS(server.URL)
+	ctx := context.Background()
+	if _, err := keys.Key(ctx, "known"); err != nil {
+		t.Fatalf("Key(known): %v", err)
+	}
+
+	// The set is stale but the provider is down
+	server.setStatus(http.StatusServiceUnavailable)
+	keys.fetchedAt = time.Now().Add(-2 * keys.TTL)
+	if _, err := keys.Key(ctx, "known"); err != nil {
+		t.Errorf("Key(known) with the provider down: %v", err)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	server := newKeyServer(t)
+	server.setStatus(http.StatusInternalServerError)
+
+	keys := NewJWKS(server.URL)
+	_, err := keys.Key(context.Background(), "any")
+	if err == nil || errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key error = %v, want a fetch error", err)
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	KeycloakID string
+	UserID     uint // local user, provisioned on the first request
+	Username   string
+	Email      string
+	// EmailVerified is set once the user confirmed their email address
+	EmailVerified bool
+	// Roles are the realm roles granted by Keycloak
+	Roles []string
+	// Organizations are the IDs of the organizations the user belongs to
+	Organizations []uint
+	// Claims are set when authenticated with a Keycloak access token
+	Claims *Claims
+	// TokenID and Scopes are set when authenticated with a personal access
+	// token, whose scopes restrict what the principal can do
+	TokenID uint
+	Scopes  []string
+}
+
+// HasScope reports whether the principal may act within scope. Keycloak
+// sessions are not restricted by scopes.
+func (p *Principal) HasScope(scope string) bool {
+	if p.TokenID == 0 {
+		return true
+	}
+	if containsString(p.Scopes, scope) {
+		return true
+	}
+	if resource, ok := strings.CutSuffix(scope, ":read"); ok {
+		return containsString(p.Scopes, resource+":write")
+	}
+	return false
+}
+
+// UserInfo returns the principal in the shape of the Keycloak userinfo
+// endpoint
+func (p *Principal) UserInfo() *gocloak.UserInfo {
+	if p.Claims != nil {
+		return p.Claims.UserInfo()
+	}
+	info := &gocloak.UserInfo{Sub: gocloak.StringP(p.KeycloakID)}
+	if p.Username != "" {
+		info.PreferredUsername = gocloak.StringP(p.Username)
+	}
+	if p.Email != "" {
+		info.Email = gocloak.StringP(p.Email)
+	}
+	return info
+}
+
+// HasRole reports whether the principal was granted the realm role
+func (p *Principal) HasRole(role string) bool {
+	return containsString(p.Roles, role)
+}
+
+// InOrganization reports whether the principal belongs to the organization
+func (p *Principal) InOrganization(organizationID uint) bool {
+	for _, id := range p.Organizations {
+		if id == organizationID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenPrefix starts every personal access token, telling them apart from
+// Keycloak JWTs and making leaked tokens easy to scan for
+const TokenPrefix = "flotio_pat_"
+
+// Scopes that can be granted to a personal access token. A write scope
+// implies the matching read scope.
+var Scopes = []string{
+	"projects:read", "projects:write",
+	"builds:read", "builds:write",
+	"envs:read", "envs:write",
+	"organizations:read", "organizations:write",
+	"user:read", "user:write",
+}
+
+// ValidScope reports whether scope can be granted to a token
+func ValidScope(scope string) bool {
+	return containsString(Scopes, scope)
+}
+
+// IsAccessToken reports whether a bearer token is a personal access token
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, TokenPrefix)
+}
+
+// GenerateAccessToken returns a new personal access token and the hash to
+// store; the token itself is only shown once
+func GenerateAccessToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token = TokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAccessToken(token), nil
+}
+
+// HashAccessToken returns the stored form of a token. Tokens are random, a
+// plain SHA-256 is enough to make a database leak useless.
+func HashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequiredScope returns the scope a personal access token needs for a request
+// to the route with the given path template. ok is false for routes tokens
+// cannot use at all: token management, and changes to the account itself
+// (profile, email, password, deletion), so a leaked token cannot be turned
+// into a takeover of the account.
+func RequiredScope(method, pathTemplate string) (scope string, ok bool) {
+	var resource string
+	switch {
+	case strings.HasPrefix(pathTemplate, "/tokens"):
+		return "", false
+	case strings.HasPrefix(pathTemplate, "/auth/@me/"), pathTemplate == "/auth/@me" && method != http.MethodGet && method != http.MethodHead:
+		return "", false
+	case strings.Contains(pathTemplate, "/environments"):
+		resource = "projects"
+	case strings.Contains(pathTemplate, "/env"), strings.Contains(pathTemplate, "/files"):
+		resource = "envs"
+	case strings.Contains(pathTemplate, "/build"):
+		resource = "builds"
+	case strings.HasPrefix(pathTemplate, "/project"):
+		resource = "projects"
+	case strings.HasPrefix(pathTemplate, "/organization"):
+		resource = "organizations"
+	case strings.HasPrefix(pathTemplate, "/auth/@me"), strings.HasPrefix(pathTemplate, "/github"):
+		resource = "user"
+	default:
+		return "", false
+	}
+
+	if method == http.MethodGet || method == http.MethodHead {
+		return resource + ":read", true
+	}
+	return resource + ":write", true
+}
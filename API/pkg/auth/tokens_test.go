@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method, path string
+		scope        string
+		ok           bool
+	}{
+		{http.MethodGet, "/project", "projects:read", true},
+		{http.MethodPost, "/project/{id}/build", "builds:write", true},
+		{http.MethodGet, "/project/{id}/build/{buildId}/logs/ws", "builds:read", true},
+		{http.MethodPut, "/project/{id}/envs", "envs:write", true},
+		{http.MethodGet, "/project/{id}/environments", "projects:read", true},
+		{http.MethodGet, "/organization/{id}/members", "organizations:read", true},
+		{http.MethodGet, "/auth/@me", "user:read", true},
+		{http.MethodDelete, "/github", "user:write", true},
+
+		// The account itself cannot be changed with a token
+		{http.MethodPut, "/auth/@me", "", false},
+		{http.MethodDelete, "/auth/@me", "", false},
+		{http.MethodGet, "/auth/@me/export", "", false},
+		{http.MethodPost, "/auth/password/change", "", false},
+		{http.MethodPost, "/auth/email/verification", "", false},
+		{http.MethodGet, "/tokens", "", false},
+		{http.MethodPost, "/tokens", "", false},
+	}
+
+	for _, tt := range tests {
+		scope, ok := RequiredScope(tt.method, tt.path)
+		if scope != tt.scope || ok != tt.ok {
+			t.Errorf("RequiredScope(%s, %s) = %q, %v, want %q, %v", tt.method, tt.path, scope, ok, tt.scope, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package auth verifies the Keycloak access tokens sent to the API locally,
+// against the realm's published signing keys.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingMethods are the algorithms accepted for access tokens
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Claims are the claims of a Keycloak access token used by the API
+type Claims struct {
+	jwt.RegisteredClaims
+	Type              string `json:"typ"`
+	AuthorizedParty   string `json:"azp"`
+	SessionID         string `json:"sid"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	GivenName         string `json:"given_name"`
+	FamilyName        string `json:"family_name"`
+	RealmAccess       struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+}
+
+// UserInfo returns the principal described by the claims, in the shape the
+// userinfo endpoint would have returned it
+func (c *Claims) UserInfo() *gocloak.UserInfo {
+	info := &gocloak.UserInfo{
+		Sub:           gocloak.StringP(c.Subject),
+		EmailVerified: gocloak.BoolP(c.EmailVerified),
+	}
+	if c.PreferredUsername != "" {
+		info.PreferredUsername = gocloak.StringP(c.PreferredUsername)
+	}
+	if c.Email != "" {
+		info.Email = gocloak.StringP(c.Email)
+	}
+	if c.Name != "" {
+		info.Name = gocloak.StringP(c.Name)
+	}
+	if c.GivenName != "" {
+		info.GivenName = gocloak.StringP(c.GivenName)
+	}
+	if c.FamilyName != "" {
+		info.FamilyName = gocloak.StringP(c.FamilyName)
+	}
+	return info
+}
+
+// Verifier checks the signature and claims of access tokens
+type Verifier struct {
+	Issuer string
+	// Audience must appear in the aud claim or be the authorized party
+	// (Keycloak only sets aud for clients with an audience mapper). Empty
+	// skips the check.
+	Audience string
+	// Leeway absorbs clock skew with Keycloak on exp, nbf and iat
+	Leeway time.Duration
+	Keys   *JWKS
+}
+
+// Tokens is the verifier used by the API, set up by InitVerifier
+var Tokens *Verifier
+
+func InitVerifier() {
+	verifier, err := NewVerifierFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure token verification: %v", err)
+	}
+	Tokens = verifier
+
+	log.Printf("Verifying access tokens issued by %s", verifier.Issuer)
+}
+
+// NewVerifierFromEnv configures a Verifier from KEYCLOAK_ISSUER (or
+// KEYCLOAK_BASE_URL and KEYCLOAK_REALM), KEYCLOAK_JWKS_URL,
+// KEYCLOAK_AUDIENCE (KEYCLOAK_CLIENT_ID by default) and JWT_CLOCK_SKEW
+func NewVerifierFromEnv() (*Verifier, error) {
+	issuer := strings.TrimSuffix(os.Getenv("KEYCLOAK_ISSUER"), "/")
+	if issuer == "" {
+		baseURL := strings.TrimSuffix(os.Getenv("KEYCLOAK_BASE_URL"), "/")
+		realm := os.Getenv("KEYCLOAK_REALM")
+		if baseURL == "" || realm == "" {
+			return nil, fmt.Errorf("KEYCLOAK_ISSUER or KEYCLOAK_BASE_URL and KEYCLOAK_REALM must be set")
+		}
+		issuer = baseURL + "/realms/" + realm
+	}
+
+	jwksURL := os.Getenv("KEYCLOAK_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = issuer + "/protocol/openid-connect/certs"
+	}
+
+	audience := os.Getenv("KEYCLOAK_AUDIENCE")
+	if audience == "" {
+		audience = os.Getenv("KEYCLOAK_CLIENT_ID")
+	}
+
+	leeway := 30 * time.Second
+	if skew := os.Getenv("JWT_CLOCK_SKEW"); skew != "" {
+		d, err := time.ParseDuration(skew)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_CLOCK_SKEW: %v", err)
+		}
+		leeway = d
+	}
+
+	return &Verifier{
+		Issuer:   issuer,
+		Audience: audience,
+		Leeway:   leeway,
+		Keys:     NewJWKS(jwksURL),
+	}, nil
+}
+
+// Verify parses token and returns its claims if it is a valid, unexpired
+// access token of the issuer. Errors wrap the jwt package errors, e.g.
+// jwt.ErrTokenExpired.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.Keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(v.Issuer),
+		jwt.WithLeeway(v.Leeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: exp", jwt.ErrTokenRequiredClaimMissing)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: sub", jwt.ErrTokenRequiredClaimMissing)
+	}
+	// Refresh and ID tokens are signed with the same keys
+	if claims.Type != "" && !strings.EqualFold(claims.Type, "Bearer") {
+		return nil, fmt.Errorf("%w: not an access token", jwt.ErrTokenInvalidClaims)
+	}
+	if v.Audience != "" && claims.AuthorizedParty != v.Audience && !containsString(claims.Audience, v.Audience) {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+
+	return claims, nil
+}
+
+// KeysUnavailable reports whether a Verify error means the signing keys
+// could not be fetched rather than the token being invalid; the request can
+// be retried later
+func KeysUnavailable(err error) bool {
+	return errors.Is(err, jwt.ErrTokenUnverifiable) && !errors.Is(err, ErrUnknownKey)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
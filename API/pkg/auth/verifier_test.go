@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://keycloak.test/realms/flotio"
+	testAudience = "flotio-api"
+)
+
+type testVerifier struct {
+	*Verifier
+	server *keyServer
+	key    *rsa.PrivateKey
+}
+
+func newTestVerifier(t *testing.T) *testVerifier {
+	t.Helper()
+	server := newKeyServer(t)
+	key := newRSAKey(t)
+	server.setKeys(rsaJWK("key-1", &key.PublicKey))
+
+	return &testVerifier{
+		Verifier: &Verifier{
+			Issuer:   testIssuer,
+			Audience: testAudience,
+			Leeway:   30 * time.Second,
+			Keys:     NewJWKS(server.URL),
+		},
+		server: server,
+		key:    key,
+	}
+}
+
+// validClaims returns the claims of a valid access token
+func validClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    testIssuer,
+			Subject:   "8d3c2a4e-0000-4000-8000-000000000001",
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Type:              "Bearer",
+		AuthorizedParty:   testAudience,
+		PreferredUsername: "alice",
+		Email:             "alice@example.com",
+	}
+}
+
+func (v *testVerifier) sign(t *testing.T, claims *Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(v.key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyValid(t *testing.T) {
+	v := newTestVerifier(t)
+
+	claims, err := v.Verify(context.Background(), v.sign(t, validClaims()))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.PreferredUsername != "alice" {
+		t.Errorf("PreferredUsername = %q, want alice", claims.PreferredUsername)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Claims)
+		want   error // nil when the token is valid
+	}{
+		{"expired", func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, jwt.ErrTokenExpired},
+		{"expired within leeway", func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Second)) }, nil},
+		{"not yet valid", func(c *Claims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute)) }, jwt.ErrTokenNotValidYet},
+		{"no expiry", func(c *Claims) { c.ExpiresAt = nil }, jwt.ErrTokenRequiredClaimMissing},
+		{"no subject", func(c *Claims) { c.Subject = "" }, jwt.ErrTokenRequiredClaimMissing},
+		{"wrong issuer", func(c *Claims) { c.Issuer = "https://keycloak.test/realms/other" }, jwt.ErrTokenInvalidIssuer},
+		{"wrong audience and azp", func(c *Claims) {
+			c.AuthorizedParty = "other-client"
+			c.Audience = jwt.ClaimStrings{"account"}
+		}, jwt.ErrTokenInvalidAudience},
+		{"audience only", func(c *Claims) {
+			c.AuthorizedParty = "other-client"
+			c.Audience = jwt.ClaimStrings{"account", testAudience}
+		}, nil},
+		{"refresh token", func(c *Claims) { c.Type = "Refresh" }, jwt.ErrTokenInvalidClaims},
+		{"ID token", func(c *Claims) { c.Type = "ID" }, jwt.ErrTokenInvalidClaims},
+	}
+
+	v := newTestVerifier(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.modify(claims)
+
+			_, err := v.Verify(context.Background(), v.sign(t, claims))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsAlgorithms(t *testing.T) {
+	v := newTestVerifier(t)
+	ctx := context.Background()
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+	none.Header["kid"] = "key-1"
+	unsigned, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("SignedString(none): %v", err)
+	}
+	if _, err := v.Verify(ctx, unsigned); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("alg=none: Verify error = %v, want ErrTokenSignatureInvalid", err)
+	}
+
+	// HS256 with the public key as the secret, the classic algorithm
+	// confusion attack
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	hs.Header["kid"] = "key-1"
+	secret := v.key.PublicKey.N.Bytes()
+	symmetric, err := hs.SignedString(secret)
+	if err != nil {
+		t.Fatalf("SignedString(HS256): %v", err)
+	}
+	if _, err := v.Verify(ctx, symmetric); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("HS256: Verify error = %v, want ErrTokenSignatureInvalid", err)
+	}
+}
+
+func TestVerifyRejectsOtherKey(t *testing.T) {
+	v := newTestVerifier(t)
+
+	// Signed by a key the provider never published, under a known kid
+	forger := &testVerifier{Verifier: v.Verifier, key: newRSAKey(t)}
+	if _, err := v.Verify(context.Background(), forger.sign(t, validClaims())); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("Verify error = %v, want ErrTokenSignatureInvalid", err)
+	}
+}
+
+func TestVerifyUnknownKid(t *testing.T) {
+	v := newTestVerifier(t)
+	v.Keys.MinRefreshInterval = time.Hour
+	ctx := context.Background()
+
+	if _, err := v.Verify(ctx, v.sign(t, validClaims())); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	token.Header["kid"] = "unknown"
+	signed, err := token.SignedString(v.key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := v.Verify(ctx, signed)
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Verify error = %v, want ErrUnknownKey", err)
+		}
+		// An unknown kid is an invalid token (401), not an outage
+		if KeysUnavailable(err) {
+			t.Fatalf("KeysUnavailable(%v) = true", err)
+		}
+	}
+	if n := v.server.requestCount(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestVerifyKeysUnavailable(t *testing.T) {
+	v := newTestVerifier(t)
+	v.server.setStatus(http.StatusServiceUnavailable)
+
+	_, err := v.Verify(context.Background(), v.sign(t, validClaims()))
+	if err == nil {
+		t.Fatal("Verify succeeded without signing keys")
+	}
+	// The middleware answers 503 for these
+	if !KeysUnavailable(err) {
+		t.Errorf("KeysUnavailable(%v) = false", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	v := newTestVerifier(t)
+	for _, token := range []string{"", "not-a-jwt", strings.Repeat("a.", 3)} {
+		if _, err := v.Verify(context.Background(), token); err == nil || KeysUnavailable(err) {
+			t.Errorf("Verify(%q) error = %v, want an invalid token error", token, err)
+		}
+	}
+}
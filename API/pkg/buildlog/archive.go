@@ -0,0 +1,206 @@
+package buildlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/storage"
+	"gorm.io/gorm"
+)
+
+// ErrLogsPurged is returned when the archived log of a build has been
+// deleted by the retention policy
+var ErrLogsPurged = errors.New("build logs have expired")
+
+const defaultRetentionDays = 30
+
+// ArchiveKey returns the artifact store key of a build's archived log
+func ArchiveKey(buildID uint) string {
+	return fmt.Sprintf("logs/build-%d.log.gz", buildID)
+}
+
+// Archive compresses the log rows of a build into a single object in the
+// artifact store, then deletes the rows. Archiving twice is a no-op.
+func Archive(ctx context.Context, buildID uint) error {
+	var build db.Build
+	if err := db.DB.First(&build, buildID).Error; err != nil {
+		return fmt.Errorf("failed to fetch build: %v", err)
+	}
+	if build.LogArchiveKey != "" || build.LogsPurged {
+		return nil
+	}
+
+	var logs []db.Log
+	if err := db.DB.Where("build_id = ?", buildID).Order("line_number ASC").Find(&logs).Error; err != nil {
+		return fmt.Errorf("failed to fetch logs: %v", err)
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, l := range logs {
+		if _, err := zw.Write([]byte(l.Content)); err != nil {
+			return fmt.Errorf("failed to compress logs: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress logs: %v", err)
+	}
+
+	key := ArchiveKey(buildID)
+	if err := storage.Artifacts.Put(ctx, key, &buf); err != nil {
+		return fmt.Errorf("failed to upload log archive: %v", err)
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&build).Updates(map[string]interface{}{
+			"log_archive_key": key,
+			"log_archived_at": time.Now().Unix(),
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update build: %v", err)
+		}
+		// Hard delete, soft-deleted rows would keep the table growing
+		if err := tx.Unscoped().Where("build_id = ?", buildID).Delete(&db.Log{}).Error; err != nil {
+			return fmt.Errorf("failed to delete logs: %v", err)
+		}
+		return nil
+	})
+}
+
+// Lines returns the stored log of a build, read from the archive once the
+// build has been archived and from the logs table before that
+func Lines(ctx context.Context, build db.Build) ([]string, error) {
+	if build.LogsPurged {
+		return nil, ErrLogsPurged
+	}
+
+	if build.LogArchiveKey == "" {
+		var logs []db.Log
+		if err := db.DB.Where("build_id = ?", build.ID).Order("line_number ASC").Find(&logs).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch logs: %v", err)
+		}
+		lines := make([]string, 0, len(logs))
+		for _, l := range logs {
+			lines = append(lines, l.Content)
+		}
+		return lines, nil
+	}
+
+	obj, err := storage.Artifacts.Get(ctx, build.LogArchiveKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch log archive: %v", err)
+	}
+	defer obj.Close()
+
+	zr, err := gzip.NewReader(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log archive: %v", err)
+	}
+	defer zr.Close()
+
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log archive: %v", err)
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, nil
+}
+
+// RetentionDays returns how long archived logs of the organization are kept,
+// falling back to LOG_RETENTION_DAYS for personal projects
+func RetentionDays(org *db.Organization) int {
+	if org != nil && org.LogRetentionDays > 0 {
+		return org.LogRetentionDays
+	}
+	if days, err := strconv.Atoi(os.Getenv("LOG_RETENTION_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return defaultRetentionDays
+}
+
+// PurgeExpired deletes the log archives that are older than the retention
+// period of their project's organization
+func PurgeExpired(ctx context.Context) error {
+	var builds []db.Build
+	err := db.DB.Model(&db.Build{}).
+		Joins("JOIN projects ON projects.id = builds.project_id").
+		Joins("LEFT JOIN organizations ON organizations.id = projects.organization_id").
+		Where("builds.log_archive_key <> '' AND builds.logs_purged = ?", false).
+		Where("builds.log_archived_at < ? - COALESCE(NULLIF(organizations.log_retention_days, 0), ?) * 86400",
+			time.Now().Unix(), RetentionDays(nil)).
+		Select("builds.id", "builds.log_archive_key").
+		Find(&builds).Error
+	if err != nil {
+		return fmt.Errorf("failed to fetch expired log archives: %v", err)
+	}
+
+	for _, build := range builds {
+		if err := storage.Artifacts.Delete(ctx, build.LogArchiveKey); err != nil {
+			log.Printf("Failed to delete log archive of build %d: %v", build.ID, err)
+			continue
+		}
+		if err := db.DB.Model(&build).Updates(map[string]interface{}{
+			"log_archive_key": "",
+			"logs_purged":     true,
+		}).Error; err != nil {
+			log.Printf("Failed to mark logs of build %d as purged: %v", build.ID, err)
+		}
+	}
+	return nil
+}
+
+// RunRetention archives the logs of finished builds and purges expired
+// archives every interval until ctx is cancelled
+func RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		archiveFinished(ctx)
+		if err := PurgeExpired(ctx); err != nil {
+			log.Printf("Log retention failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// archiveFinished catches builds whose logs were not archived when their
+// stream ended, e.g. because the artifact store was unavailable
+func archiveFinished(ctx context.Context) {
+	var buildIDs []uint
+	err := db.DB.Model(&db.Build{}).
+		Where("status IN ? AND log_archive_key = '' AND logs_purged = ?", []string{"success", "failed", "cancelled"}, false).
+		Where("EXISTS (SELECT 1 FROM logs WHERE logs.build_id = builds.id)").
+		Pluck("id", &buildIDs).Error
+	if err != nil {
+		log.Printf("Failed to fetch finished builds: %v", err)
+		return
+	}
+
+	for _, id := range buildIDs {
+		if err := Complete(ctx, id); err != nil {
+			log.Printf("Failed to archive logs of build %d: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package buildlog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+// Complete wraps up a build once its log stream has ended: the status and
+// duration are derived from the recorded steps, failures are diagnosed and
+// the log is archived. A build that ended without any step failed.
+func Complete(ctx context.Context, buildID uint) error {
+	var build db.Build
+	if err := db.DB.Preload("Steps").First(&build, buildID).Error; err != nil {
+		return fmt.Errorf("failed to fetch build: %v", err)
+	}
+
+	if len(build.Steps) == 0 && (build.Status == "pending" || build.Status == "running") {
+		build.Status = "failed"
+		if err := db.DB.Model(&build).Select("status").Updates(&build).Error; err != nil {
+			return fmt.Errorf("failed to update build: %v", err)
+		}
+	}
+
+	if build.Status != "cancelled" && len(build.Steps) > 0 {
+		first, last := build.Steps[0], build.Steps[0]
+		failed := false
+		for _, step := range build.Steps {
+			if step.Position < first.Position {
+				first = step
+			}
+			if step.Position > last.Position {
+				last = step
+			}
+			if step.Status != "success" {
+				failed = true
+			}
+		}
+
+		build.Status = "success"
+		if failed {
+			build.Status = "failed"
+		}
+		build.Duration = last.FinishedAt - first.StartedAt
+		if err := db.DB.Model(&build).Select("status", "duration").Updates(&build).Error; err != nil {
+			return fmt.Errorf("failed to update build: %v", err)
+		}
+	}
+
+	if build.Status == "failed" && build.FailureReason == nil {
+		if err := DiagnoseBuild(ctx, &build); err != nil {
+			return err
+		}
+	}
+
+	return Archive(ctx, buildID)
+}
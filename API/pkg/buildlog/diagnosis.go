@@ -0,0 +1,239 @@
+package buildlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+// Rule maps a known error signature in the build output to a human
+// readable failure reason and a suggested fix
+type Rule struct {
+	ID         string `yaml:"id" json:"id"`
+	Category   string `yaml:"category" json:"category"` // flutter, dart, gradle, android, cocoapods, ios, git
+	Pattern    string `yaml:"pattern" json:"pattern"`   // regular expression matched against each log line
+	Reason     string `yaml:"reason" json:"reason"`
+	Suggestion string `yaml:"suggestion" json:"suggestion"`
+
+	re *regexp.Regexp
+}
+
+// DefaultRules are the built-in signatures, most specific first
+var DefaultRules = []Rule{
+	{
+		ID:         "dart-sdk-version",
+		Category:   "dart",
+		Pattern:    `requires SDK version .*, version solving failed`,
+		Reason:     "A dependency requires a different Dart SDK than the one shipped with the selected Flutter version",
+		Suggestion: "Change the project's Flutter version to one whose Dart SDK satisfies the environment constraint, or relax the constraint in pubspec.yaml.",
+	},
+	{
+		ID:         "pub-version-solving",
+		Category:   "dart",
+		Pattern:    `version solving failed`,
+		Reason:     "Dependency resolution failed during flutter pub get",
+		Suggestion: "Check the version constraints in pubspec.yaml, run `flutter pub upgrade --major-versions` locally and commit the updated pubspec.lock.",
+	},
+	{
+		ID:         "pubspec-missing",
+		Category:   "flutter",
+		Pattern:    `Expected to find project root|No pubspec\.yaml file found|Could not find a file named "pubspec\.yaml"`,
+		Reason:     "No Flutter project was found in the build folder",
+		Suggestion: "Set the project's build folder to the directory that contains pubspec.yaml.",
+	},
+	{
+		ID:         "gradle-oom",
+		Category:   "gradle",
+		Pattern:    `java\.lang\.OutOfMemoryError|Java heap space|GC overhead limit exceeded|Gradle build daemon disappeared unexpectedly`,
+		Reason:     "Gradle ran out of memory",
+		Suggestion: "Raise org.gradle.jvmargs in android/gradle.properties, for example `-Xmx4g -XX:MaxMetaspaceSize=1g`.",
+	},
+	{
+		ID:         "android-licenses",
+		Category:   "android",
+		Pattern:    `You have not accepted the license agreements|some licen[cs]es have not been accepted|License for package .* not accepted`,
+		Reason:     "Android SDK licenses have not been accepted",
+		Suggestion: "Run `yes | flutter doctor --android-licenses` in the build image or use an image with the licenses already accepted.",
+	},
+	{
+		ID:         "android-sdk-missing",
+		Category:   "android",
+		Pattern:    `No Android SDK found|SDK location not found|ANDROID_(HOME|SDK_ROOT).*(not set|does not exist)`,
+		Reason:     "The Android SDK could not be found",
+		Suggestion: "Use a Flutter image that bundles the Android SDK or set ANDROID_HOME.",
+	},
+	{
+		ID:         "kotlin-version-mismatch",
+		Category:   "gradle",
+		Pattern:    `compiled with an incompatible version of Kotlin|The binary version of its metadata is .*, expected version is|requires a newer version of the Kotlin Gradle plugin`,
+		Reason:     "A dependency was compiled with a newer Kotlin version than the project's Kotlin Gradle plugin",
+		Suggestion: "Bump the org.jetbrains.kotlin.android plugin version in android/settings.gradle (or ext.kotlin_version in android/build.gradle).",
+	},
+	{
+		ID:         "gradle-java-version",
+		Category:   "gradle",
+		Pattern:    `Unsupported class file major version|requires Java \d+ to run|Android Gradle plugin requires Java \d+`,
+		Reason:     "The Java version of the build image does not match the Android Gradle plugin",
+		Suggestion: "Upgrade the Android Gradle plugin and Gradle wrapper, or use a Flutter version whose image ships a compatible JDK.",
+	},
+	{
+		ID:         "cocoapods-version-conflict",
+		Category:   "cocoapods",
+		Pattern:    `CocoaPods could not find compatible versions for pod|specs repository is too out-of-date`,
+		Reason:     "CocoaPods could not resolve the iOS dependencies",
+		Suggestion: "Run `pod install --repo-update` and raise the platform version in ios/Podfile if a pod requires a newer iOS deployment target.",
+	},
+	{
+		ID:         "cocoapods-missing",
+		Category:   "cocoapods",
+		Pattern:    `CocoaPods not installed|pod: (command )?not found`,
+		Reason:     "CocoaPods is not available in the build environment",
+		Suggestion: "iOS builds need a macOS builder with CocoaPods installed.",
+	},
+	{
+		ID:         "ios-requires-macos",
+		Category:   "ios",
+		Pattern:    `only supported on macOS|"build ios" is not supported|Could not find an option named "ios"`,
+		Reason:     "iOS builds cannot run on a Linux builder",
+		Suggestion: "Build for Android or run iOS builds on a macOS builder.",
+	},
+	{
+		ID:         "git-clone-failed",
+		Category:   "git",
+		Pattern:    `fatal: (repository .* not found|could not read Username|Authentication failed)`,
+		Reason:     "The repository could not be cloned",
+		Suggestion: "Check the project's git URL and that the Flotio GitHub app has access to the repository.",
+	},
+	{
+		ID:         "dart-compile-error",
+		Category:   "dart",
+		Pattern:    `\.dart:\d+:\d+: Error:`,
+		Reason:     "The Dart code does not compile",
+		Suggestion: "Fix the compilation errors reported above; run `flutter analyze` locally to reproduce them.",
+	},
+}
+
+// rules is the active rule set, set up by InitRules
+var rules []Rule
+
+// InitRules loads the rules of FAILURE_RULES_FILE, if set, followed by the
+// built-in ones it does not override. An invalid file stops the API rather
+// than silently diagnosing with the built-in rules only.
+func InitRules() {
+	loaded, err := LoadRules(os.Getenv("FAILURE_RULES_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load failure rules from %s: %v", os.Getenv("FAILURE_RULES_FILE"), err)
+	}
+	rules = loaded
+
+	log.Printf("Loaded %d failure rules", len(rules))
+}
+
+// Rules returns the active rule set, the built-in rules when InitRules was
+// not called
+func Rules() []Rule {
+	if rules == nil {
+		builtIn, _ := LoadRules("")
+		return builtIn
+	}
+	return rules
+}
+
+// LoadRules compiles the built-in rules together with the ones of the YAML
+// (or JSON) file at path. File rules come first and replace built-in rules
+// with the same ID.
+//
+//	rules:
+//	  - id: gradle-oom
+//	    category: gradle
+//	    pattern: "OutOfMemoryError"
+//	    reason: Gradle ran out of memory
+//	    suggestion: Raise org.gradle.jvmargs
+func LoadRules(path string) ([]Rule, error) {
+	var custom []Rule
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules file: %v", err)
+		}
+		var file struct {
+			Rules []Rule `yaml:"rules"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse rules file: %v", err)
+		}
+		custom = file.Rules
+	}
+
+	overridden := map[string]bool{}
+	for _, r := range custom {
+		overridden[r.ID] = true
+	}
+
+	all := append([]Rule{}, custom...)
+	for _, r := range DefaultRules {
+		if !overridden[r.ID] {
+			all = append(all, r)
+		}
+	}
+
+	for i := range all {
+		if all[i].ID == "" || all[i].Pattern == "" {
+			return nil, fmt.Errorf("rule %d: id and pattern are required", i)
+		}
+		re, err := regexp.Compile(all[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid pattern: %v", all[i].ID, err)
+		}
+		all[i].re = re
+	}
+	return all, nil
+}
+
+// Diagnose returns the first rule, in rule order, matching a line of the
+// build output, or nil when no known signature was found
+func Diagnose(rules []Rule, output []string) *db.FailureReason {
+	lines := strings.Split(strings.Join(output, ""), "\n")
+
+	for _, rule := range rules {
+		for i, line := range lines {
+			if !rule.re.MatchString(line) {
+				continue
+			}
+			return &db.FailureReason{
+				RuleID:     rule.ID,
+				Category:   rule.Category,
+				Reason:     rule.Reason,
+				Suggestion: rule.Suggestion,
+				Line:       i + 1,
+				Match:      strings.TrimSpace(line),
+			}
+		}
+	}
+	return nil
+}
+
+// DiagnoseBuild scans the log of a failed build and stores the failure
+// reason on it
+func DiagnoseBuild(ctx context.Context, build *db.Build) error {
+	output, err := Lines(ctx, *build)
+	if err != nil {
+		return err
+	}
+
+	build.FailureReason = Diagnose(Rules(), output)
+	if build.FailureReason == nil {
+		return nil
+	}
+	if err := db.DB.Model(build).Select("failure_reason").Updates(build).Error; err != nil {
+		return fmt.Errorf("failed to save failure reason: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package buildlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		line string
+		rule string
+	}{
+		{"dart sdk", "Because app requires SDK version >=3.4.0 <4.0.0, version solving failed.", "dart-sdk-version"},
+		{"pub", "Because every version of foo depends on bar ^2.0.0, version solving failed.", "pub-version-solving"},
+		{"no pubspec", "Error: No pubspec.yaml file found.", "pubspec-missing"},
+		{"project root", "Expected to find project root in current working directory.", "pubspec-missing"},
+		{"gradle heap", "java.lang.OutOfMemoryError: Java heap space", "gradle-oom"},
+		{"gradle daemon", "Gradle build daemon disappeared unexpectedly (it may have been killed or may have crashed)", "gradle-oom"},
+		{"licenses", "Warning: License for package Android SDK Build-Tools 33 not accepted.", "android-licenses"},
+		{"sdk missing", "[!] No Android SDK found. Try setting the ANDROID_HOME environment variable.", "android-sdk-missing"},
+		{"kotlin", "Module was compiled with an incompatible version of Kotlin. The binary version of its metadata is 1.9.0, expected version is 1.7.1.", "kotlin-version-mismatch"},
+		{"java", "Unsupported class file major version 65", "gradle-java-version"},
+		{"cocoapods versions", "[!] CocoaPods could not find compatible versions for pod \"Firebase/Core\":", "cocoapods-version-conflict"},
+		{"cocoapods missing", "sh: pod: command not found", "cocoapods-missing"},
+		{"ios on linux", "\"build ios\" is not supported on Linux", "ios-requires-macos"},
+		{"clone", "fatal: repository 'https://github.com/acme/app.git/' not found", "git-clone-failed"},
+		{"dart compile", "lib/main.dart:12:5: Error: Undefined name 'foo'.", "dart-compile-error"},
+		{"unknown", "FAILURE: Build failed with an exception.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := []string{"Running Gradle task 'assembleRelease'...\n", "  " + tt.line + "\n", "done\n"}
+			reason := Diagnose(rules, output)
+			if tt.rule == "" {
+				if reason != nil {
+					t.Fatalf("Diagnose matched %s, want no match", reason.RuleID)
+				}
+				return
+			}
+			if reason == nil {
+				t.Fatalf("Diagnose found no match, want %s", tt.rule)
+			}
+			if reason.RuleID != tt.rule {
+				t.Errorf("RuleID = %s, want %s", reason.RuleID, tt.rule)
+			}
+			if reason.Line != 2 || reason.Match != tt.line {
+				t.Errorf("matched line %d %q, want line 2 %q", reason.Line, reason.Match, tt.line)
+			}
+		})
+	}
+}
+
+func TestDiagnoseRuleOrder(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+
+	// An earlier rule wins over a match on an earlier line
+	output := []string{
+		"lib/main.dart:3:1: Error: Expected ';' after this.\n",
+		"java.lang.OutOfMemoryError: Metaspace\n",
+	}
+	if reason := Diagnose(rules, output); reason == nil || reason.RuleID != "gradle-oom" || reason.Line != 2 {
+		t.Errorf("Diagnose = %+v, want gradle-oom on line 2", reason)
+	}
+
+	// Chunks do not follow line boundaries
+	output = []string{"java.lang.OutOfMem", "oryError\n"}
+	if reason := Diagnose(rules, output); reason == nil || reason.RuleID != "gradle-oom" || reason.Line != 1 {
+		t.Errorf("Diagnose of split chunks = %+v, want gradle-oom on line 1", reason)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write(t, `rules:
+  - id: flaky-network
+    category: network
+    pattern: "Connection reset by peer"
+    reason: The network dropped
+    suggestion: Retry the build
+  - id: gradle-oom
+    category: gradle
+    pattern: "Killed"
+    reason: The build container ran out of memory
+`)
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	if len(rules) != len(DefaultRules)+1 {
+		t.Fatalf("loaded %d rules, want %d", len(rules), len(DefaultRules)+1)
+	}
+	if rules[0].ID != "flaky-network" || rules[1].ID != "gradle-oom" {
+		t.Errorf("file rules come first, got %s, %s", rules[0].ID, rules[1].ID)
+	}
+	for _, r := range rules[2:] {
+		if r.ID == "gradle-oom" {
+			t.Error("the built-in gradle-oom rule was not replaced")
+		}
+	}
+
+	if reason := Diagnose(rules, []string{"java.lang.OutOfMemoryError\n"}); reason != nil {
+		t.Errorf("the replaced pattern still matched: %+v", reason)
+	}
+	if reason := Diagnose(rules, []string{"Killed\n"}); reason == nil || reason.Reason != "The build container ran out of memory" {
+		t.Errorf("Diagnose = %+v, want the file's gradle-oom rule", reason)
+	}
+
+	invalid := map[string]string{
+		"missing id":      "rules:\n  - pattern: x\n",
+		"missing pattern": "rules:\n  - id: x\n",
+		"bad pattern":     "rules:\n  - id: x\n    pattern: \"(\"\n",
+		"bad yaml":        "rules: [",
+	}
+	for name, content := range invalid {
+		if _, err := LoadRules(write(t, content)); err == nil {
+			t.Errorf("%s: LoadRules succeeded", name)
+		}
+	}
+	if _, err := LoadRules(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.Contains(err.Error(), "read") {
+		t.Errorf("missing file: LoadRules error = %v", err)
+	}
+}
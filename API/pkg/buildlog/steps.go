@@ -0,0 +1,183 @@
+package buildlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+// Step markers written by the build script around each phase:
+//
+//	::flotio-step-start::<name>::<unix ts>
+//	::flotio-step-end::<name>::<exit code>::<unix ts>
+const (
+	StepStartMarker     = "::flotio-step-start::"
+	StepEndMarker       = "::flotio-step-end::"
+	StepMarkerSeparator = "::"
+)
+
+// StepMarker is a parsed step start or end line
+type StepMarker struct {
+	Start     bool
+	Name      string
+	ExitCode  int
+	Timestamp int64
+}
+
+// ParseStepMarker reports whether line is a step marker and decodes it
+func ParseStepMarker(line string) (StepMarker, bool) {
+	line = strings.TrimSpace(line)
+
+	switch {
+	case strings.HasPrefix(line, StepStartMarker):
+		parts := strings.Split(strings.TrimPrefix(line, StepStartMarker), StepMarkerSeparator)
+		if len(parts) != 2 || parts[0] == "" {
+			return StepMarker{}, false
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return StepMarker{}, false
+		}
+		return StepMarker{Start: true, Name: parts[0], Timestamp: ts}, true
+
+	case strings.HasPrefix(line, StepEndMarker):
+		parts := strings.Split(strings.TrimPrefix(line, StepEndMarker), StepMarkerSeparator)
+		if len(parts) != 3 || parts[0] == "" {
+			return StepMarker{}, false
+		}
+		code, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return StepMarker{}, false
+		}
+		ts, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return StepMarker{}, false
+		}
+		return StepMarker{Name: parts[0], ExitCode: code, Timestamp: ts}, true
+	}
+
+	return StepMarker{}, false
+}
+
+// StepRecorder turns the log chunks of a build into BuildStep records.
+// Chunks do not follow line boundaries, so incomplete lines are buffered
+// until the rest of the line arrives.
+type StepRecorder struct {
+	buildID  uint
+	partial  string
+	last     int // line number of the latest chunk
+	position int
+	current  *db.BuildStep
+}
+
+func NewStepRecorder(buildID uint) *StepRecorder {
+	return &StepRecorder{buildID: buildID}
+}
+
+// Record consumes a chunk of log output saved under lineNumber
+func (r *StepRecorder) Record(lineNumber int, chunk string) error {
+	lines := strings.Split(r.partial+chunk, "\n")
+	r.partial = lines[len(lines)-1]
+	r.last = lineNumber
+
+	for _, line := range lines[:len(lines)-1] {
+		if err := r.line(line, lineNumber); err != nil {
+			return err
+		}
+	}
+
+	if r.current != nil {
+		r.current.LastLine = lineNumber
+	}
+	return nil
+}
+
+// Finish records the last line when the output does not end with a newline,
+// then marks the step still running as failed, which happens when the pod
+// is killed in the middle of a phase.
+func (r *StepRecorder) Finish() error {
+	if r.partial != "" {
+		line := r.partial
+		r.partial = ""
+		if err := r.line(line, r.last); err != nil {
+			return err
+		}
+	}
+	if r.current == nil {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	r.current.Status = "failed"
+	r.current.FinishedAt = now
+	r.current.Duration = now - r.current.StartedAt
+	err := db.DB.Save(r.current).Error
+	r.current = nil
+	if err != nil {
+		return fmt.Errorf("failed to save build step: %v", err)
+	}
+	return nil
+}
+
+func (r *StepRecorder) line(line string, lineNumber int) error {
+	marker, ok := ParseStepMarker(line)
+	if !ok {
+		return nil
+	}
+	if marker.Start {
+		return r.start(marker, lineNumber)
+	}
+	return r.end(marker, lineNumber)
+}
+
+func (r *StepRecorder) start(marker StepMarker, lineNumber int) error {
+	r.position++
+
+	// A build can be streamed more than once, so reuse the existing row
+	step := db.BuildStep{}
+	err := db.DB.Where(db.BuildStep{BuildID: r.buildID, Name: marker.Name}).
+		Assign(map[string]interface{}{
+			"position":    r.position,
+			"status":      "running",
+			"started_at":  marker.Timestamp,
+			"finished_at": 0,
+			"duration":    0,
+			"first_line":  lineNumber,
+			"last_line":   lineNumber,
+		}).
+		FirstOrCreate(&step).Error
+	if err != nil {
+		return fmt.Errorf("failed to save build step: %v", err)
+	}
+
+	r.current = &step
+	return nil
+}
+
+func (r *StepRecorder) end(marker StepMarker, lineNumber int) error {
+	step := r.current
+	if step == nil || step.Name != marker.Name {
+		step = &db.BuildStep{}
+		if err := db.DB.Where("build_id = ? AND name = ?", r.buildID, marker.Name).First(step).Error; err != nil {
+			return fmt.Errorf("failed to fetch build step %q: %v", marker.Name, err)
+		}
+	}
+
+	step.Status = "success"
+	if marker.ExitCode != 0 {
+		step.Status = "failed"
+	}
+	step.FinishedAt = marker.Timestamp
+	step.Duration = marker.Timestamp - step.StartedAt
+	step.LastLine = lineNumber
+
+	if err := db.DB.Save(step).Error; err != nil {
+		return fmt.Errorf("failed to save build step: %v", err)
+	}
+
+	r.current = nil
+	return nil
+}
@@ -0,0 +1,103 @@
+package buildlog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+)
+
+func TestParseStepMarker(t *testing.T) {
+	tests := []struct {
+		line string
+		want StepMarker
+		ok   bool
+	}{
+		{"::flotio-step-start::clone::1700000000", StepMarker{Start: true, Name: "clone", Timestamp: 1700000000}, true},
+		{"  ::flotio-step-start::pub get::1700000001\r", StepMarker{Start: true, Name: "pub get", Timestamp: 1700000001}, true},
+		{"::flotio-step-end::build::0::1700000100", StepMarker{Name: "build", Timestamp: 1700000100}, true},
+		{"::flotio-step-end::build::127::1700000100", StepMarker{Name: "build", ExitCode: 127, Timestamp: 1700000100}, true},
+		{"::flotio-step-end::build::-1::1700000100", StepMarker{Name: "build", ExitCode: -1, Timestamp: 1700000100}, true},
+
+		{"", StepMarker{}, false},
+		{"Running Gradle task 'assembleRelease'...", StepMarker{}, false},
+		{"echo ::flotio-step-start::clone::1700000000", StepMarker{}, false},
+		{"::flotio-step-start::::1700000000", StepMarker{}, false},
+		{"::flotio-step-start::clone", StepMarker{}, false},
+		{"::flotio-step-start::clone::now", StepMarker{}, false},
+		{"::flotio-step-start::clone::1700000000::extra", StepMarker{}, false},
+		{"::flotio-step-end::build::1700000100", StepMarker{}, false},
+		{"::flotio-step-end::build::x::1700000100", StepMarker{}, false},
+		{"::flotio-step-end::build::0::later", StepMarker{}, false},
+		{"::flotio-step-end::::0::1700000100", StepMarker{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseStepMarker(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParseStepMarker(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStepRecorder(t *testing.T) {
+	tx := dbtest.Open(t)
+
+	project := db.Project{Name: fmt.Sprintf("steps-test-%d", time.Now().UnixNano())}
+	if err := tx.Create(&project).Error; err != nil {
+		t.Fatalf("Create project: %v", err)
+	}
+	build := db.Build{ProjectID: project.ID, Status: "running"}
+	if err := tx.Create(&build).Error; err != nil {
+		t.Fatalf("Create build: %v", err)
+	}
+
+	// Chunks split in the middle of markers, the last step is interrupted
+	chunks := []string{
+		"::flotio-step-start::clone::100\ncloning\n::flotio-step-en",
+		"d::clone::0::110\n::flotio-step-start::build::110\n",
+		"compiling\n::flotio-step-end::build::1::150\n::flotio-step-start::upload::150\nuploading",
+	}
+	recorder := NewStepRecorder(build.ID)
+	for i, chunk := range chunks {
+		if err := recorder.Record(i+1, chunk); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	if err := recorder.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	var steps []db.BuildStep
+	if err := tx.Where("build_id = ?", build.ID).Order("position").Find(&steps).Error; err != nil {
+		t.Fatalf("Find steps: %v", err)
+	}
+	want := []struct {
+		name                string
+		status              string
+		duration            int64
+		firstLine, lastLine int
+	}{
+		{"clone", "success", 10, 1, 2},
+		{"build", "failed", 40, 2, 3},
+		{"upload", "failed", -1, 3, 3}, // interrupted, measured up to now
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("recorded %d steps, want %d", len(steps), len(want))
+	}
+	for i, step := range steps {
+		w := want[i]
+		if step.Name != w.name || step.Status != w.status || step.FirstLine != w.firstLine || step.LastLine != w.lastLine {
+			t.Errorf("step %d = %s %s lines %d-%d, want %s %s lines %d-%d", i, step.Name, step.Status, step.FirstLine, step.LastLine,
+				w.name, w.status, w.firstLine, w.lastLine)
+		}
+		if w.duration >= 0 && step.Duration != w.duration {
+			t.Errorf("step %s duration = %d, want %d", step.Name, step.Duration, w.duration)
+		}
+		if step.Position != i+1 {
+			t.Errorf("step %s position = %d, want %d", step.Name, step.Position, i+1)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package buildlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+// LogSource streams the output of a build from its start into ch, and
+// closes ch once the output has ended
+type LogSource func(buildID uint, ch chan<- string) error
+
+const (
+	// leaseDuration is how long the log of a running build is left alone
+	// after its watcher stopped renewing the lease
+	leaseDuration = time.Minute
+	leaseRenewal  = 20 * time.Second
+)
+
+// Watch ingests the log of a running build: the output is saved, steps are
+// recorded and the build is completed once the output ends, whether or not
+// anyone is viewing it. A single API instance watches a build, Watch returns
+// right away when another one holds the lease.
+func Watch(ctx context.Context, buildID uint, source LogSource) {
+	claimed, err := claimLease(buildID)
+	if err != nil {
+		log.Printf("Failed to claim the log of build %d: %v", buildID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go renewLease(buildID, stop)
+
+	if err := ingest(ctx, buildID, source); err != nil {
+		// The lease expires and the build is picked up again by WatchRunning
+		log.Printf("Failed to ingest the log of build %d: %v", buildID, err)
+	}
+}
+
+// WatchRunning watches the running builds nobody is watching, such as the
+// ones started by an API instance that has since stopped, every interval
+// until ctx is cancelled
+func WatchRunning(ctx context.Context, source LogSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var ids []uint
+		err := db.DB.Model(&db.Build{}).Where("status = ? AND log_lease_until < ?", "running", time.Now().Unix()).
+			Pluck("id", &ids).Error
+		if err != nil {
+			log.Printf("Failed to fetch running builds: %v", err)
+		}
+		for _, id := range ids {
+			go Watch(ctx, id, source)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func claimLease(buildID uint) (bool, error) {
+	now := time.Now()
+	res := db.DB.Model(&db.Build{}).Where("id = ? AND status = ? AND log_lease_until < ?", buildID, "running", now.Unix()).
+		Update("log_lease_until", now.Add(leaseDuration).Unix())
+	return res.RowsAffected == 1, res.Error
+}
+
+func renewLease(buildID uint, stop <-chan struct{}) {
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := db.DB.Model(&db.Build{}).Where("id = ?", buildID).
+				Update("log_lease_until", time.Now().Add(leaseDuration).Unix()).Error
+			if err != nil {
+				log.Printf("Failed to renew the log lease of build %d: %v", buildID, err)
+			}
+		}
+	}
+}
+
+func ingest(ctx context.Context, buildID uint, source LogSource) error {
+	steps := NewStepRecorder(buildID)
+
+	// The source starts from the beginning of the output again when another
+	// watcher already saved part of it: the saved lines are replayed to the
+	// step recorder and skipped in the output
+	var saved []db.Log
+	if err := db.DB.Where("build_id = ?", buildID).Order("line_number ASC").Find(&saved).Error; err != nil {
+		return fmt.Errorf("failed to fetch logs: %v", err)
+	}
+	lineNumber, skip := 1, 0
+	for _, l := range saved {
+		if err := steps.Record(l.LineNumber, l.Content); err != nil {
+			return err
+		}
+		lineNumber = l.LineNumber + 1
+		skip += len(l.Content)
+	}
+
+	ch := make(chan string, 100)
+	go func() {
+		// An unreadable output is handled as ended, the pod is gone
+		if err := source(buildID, ch); err != nil {
+			log.Printf("Failed to stream the log of build %d: %v", buildID, err)
+		}
+	}()
+	// Keep the source from blocking when returning early
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+
+	for chunk := range ch {
+		if skip > 0 {
+			n := min(skip, len(chunk))
+			chunk, skip = chunk[n:], skip-n
+			if chunk == "" {
+				continue
+			}
+		}
+
+		entry := db.Log{
+			BuildID:    buildID,
+			LineNumber: lineNumber,
+			Content:    chunk,
+			Timestamp:  time.Now().Unix(),
+		}
+		if err := db.DB.Create(&entry).Error; err != nil {
+			return fmt.Errorf("failed to save log line: %v", err)
+		}
+		if err := steps.Record(lineNumber, chunk); err != nil {
+			return err
+		}
+		lineNumber++
+	}
+
+	if err := steps.Finish(); err != nil {
+		return err
+	}
+	return Complete(ctx, buildID)
+}
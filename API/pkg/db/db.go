@@ -19,16 +19,36 @@ func InitDB() {
 	}
 
 	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// Constraint violations are translated to gorm errors (ErrDuplicatedKey)
+	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	// Auto migrate
-	err = DB.AutoMigrate(&User{}, &Project{}, &Build{}, &Env{}, &Organization{}, &GithubInstallation{})
-	if err != nil {
-		log.Fatalf("Failed to migrate database: %v", err)
+	if err := Migrate(DB); err != nil {
+		log.Fatalf("Database migration failed: %v", err)
 	}
 
 	log.Println("Database connected and migrated")
 }
+
+// Migrate creates or updates the tables and runs the pending data migrations
+func Migrate(tx *gorm.DB) error {
+	// Users without an email share the empty one, only set emails are
+	// unique
+	if tx.Migrator().HasIndex(&User{}, "idx_users_email") {
+		if err := tx.Migrator().DropIndex(&User{}, "idx_users_email"); err != nil {
+			return fmt.Errorf("failed to drop the users email index: %v", err)
+		}
+	}
+
+	// Auto migrate
+	err := tx.AutoMigrate(&User{}, &AccessToken{}, &EmailToken{}, &LoginSession{}, &AccountDeletion{}, &Project{}, &Build{}, &BuildStep{}, &Log{}, &Env{}, &EnvRevision{}, &EnvChange{}, &OrganizationEnv{}, &SecretFile{}, &Environment{}, &DataKey{}, &Organization{}, &OrganizationMember{}, &Invitation{}, &GithubInstallation{}, &DataMigration{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %v", err)
+	}
+	if err := runDataMigrations(tx); err != nil {
+		return fmt.Errorf("failed to migrate data: %v", err)
+	}
+	return nil
+}
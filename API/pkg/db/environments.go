@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// DefaultEnvironments are created for every project, the first one being the
+// project's default environment
+var DefaultEnvironments = []string{"development", "staging", "production"}
+
+// EnsureEnvironments creates the default environments of a project that has
+// none yet and returns the project's environments
+func EnsureEnvironments(tx *gorm.DB, projectID uint) ([]Environment, error) {
+	var environments []Environment
+	if err := tx.Where("project_id = ?", projectID).Order("id ASC").Find(&environments).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch environments: %v", err)
+	}
+	if len(environments) > 0 {
+		return environments, nil
+	}
+
+	for i, name := range DefaultEnvironments {
+		environments = append(environments, Environment{
+			ProjectID: projectID,
+			Name:      name,
+			IsDefault: i == 0,
+		})
+	}
+	if err := tx.Create(&environments).Error; err != nil {
+		return nil, fmt.Errorf("failed to create environments: %v", err)
+	}
+	return environments, nil
+}
+
+// FindEnvironment returns the project's environment called name, or its
+// default environment when name is empty
+func FindEnvironment(tx *gorm.DB, projectID uint, name string) (Environment, error) {
+	environments, err := EnsureEnvironments(tx, projectID)
+	if err != nil {
+		return Environment{}, err
+	}
+
+	for _, environment := range environments {
+		if (name == "" && environment.IsDefault) || (name != "" && environment.Name == name) {
+			return environment, nil
+		}
+	}
+	if name == "" {
+		// No default flagged, fall back to the oldest environment
+		return environments[0], nil
+	}
+	return Environment{}, gorm.ErrRecordNotFound
+}
+
+// InEnvironment restricts an Env query to the envs applying to the
+// environment: the ones scoped to it and the unscoped ones
+func InEnvironment(environmentID uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("(envs.id NOT IN (SELECT env_id FROM env_environments) OR envs.id IN (SELECT env_id FROM env_environments WHERE environment_id = ?))", environmentID)
+	}
+}
+
+// EffectiveEnvs keeps one env per key out of the envs applying to an
+// environment: an env scoped to the environment wins over an unscoped one.
+// The Environments association must be loaded.
+func EffectiveEnvs(envs []Env) []Env {
+	index := map[string]int{}
+	effective := make([]Env, 0, len(envs))
+	for _, env := range envs {
+		i, seen := index[env.Key]
+		if !seen {
+			index[env.Key] = len(effective)
+			effective = append(effective, env)
+			continue
+		}
+		if len(effective[i].Environments) == 0 && len(env.Environments) > 0 {
+			effective[i] = env
+		}
+	}
+	return effective
+}
+
+// SecretFilesInEnvironment restricts a SecretFile query to the files written
+// in the environment: the ones scoped to it and the unscoped ones
+func SecretFilesInEnvironment(environmentID uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("(secret_files.id NOT IN (SELECT secret_file_id FROM secret_file_environments) OR secret_files.id IN (SELECT secret_file_id FROM secret_file_environments WHERE environment_id = ?))", environmentID)
+	}
+}
+
+// EffectiveSecretFiles keeps one file per path, like EffectiveEnvs does per
+// key. The Environments association must be loaded.
+func EffectiveSecretFiles(files []SecretFile) []SecretFile {
+	index := map[string]int{}
+	effective := make([]SecretFile, 0, len(files))
+	for _, file := range files {
+		i, seen := index[file.Path]
+		if !seen {
+			index[file.Path] = len(effective)
+			effective = append(effective, file)
+			continue
+		}
+		if len(effective[i].Environments) == 0 && len(file.Environments) > 0 {
+			effective[i] = file
+		}
+	}
+	return effective
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DataMigration records a data migration that has run
+type DataMigration struct {
+	ID    string `gorm:"primaryKey"`
+	RanAt time.Time
+}
+
+// dataMigrations run once each, in order, after the schema is migrated.
+// Append new migrations, never rename or reorder them.
+var dataMigrations = []struct {
+	id  string
+	run func(tx *gorm.DB) error
+}{
+	{"mask-value-previews", migrateValuePreviews},
+	{"organization-projects", migrateOrganizationProjects},
+	{"email-verified", migrateEmailVerified},
+}
+
+// MaskedValue is the preview stored in place of env values
+const MaskedValue = "********"
+
+// runDataMigrations runs the data migrations that have not run yet
+func runDataMigrations(tx *gorm.DB) error {
+	for _, migration := range dataMigrations {
+		if err := RunDataMigration(tx, migration.id, migration.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDataMigration runs the data migration id unless it has already run. API
+// instances starting together wait for each other. Migrations needing more
+// than the database, such as the keyring, are run with it once it is set up.
+func RunDataMigration(tx *gorm.DB, id string, run func(tx *gorm.DB) error) error {
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE data_migrations IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var ran int64
+		if err := tx.Model(&DataMigration{}).Where("id = ?", id).Count(&ran).Error; err != nil {
+			return err
+		}
+		if ran > 0 {
+			return nil
+		}
+		if err := run(tx); err != nil {
+			return err
+		}
+		return tx.Create(&DataMigration{ID: id, RanAt: time.Now()}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", id, err)
+	}
+	return nil
+}
+
+// migrateOrganizationProjects hands the projects created in an organization
+// before projects had a single owner over to the organization. Their creator
+// is kept as an admin of the organization so nobody loses access.
+func migrateOrganizationProjects(tx *gorm.DB) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO organization_members (created_at, updated_at, organization_id, user_id, role)
+			SELECT DISTINCT ON (organization_id, user_id) NOW(), NOW(), organization_id, user_id, 'admin'
+			FROM projects
+			WHERE organization_id IS NOT NULL AND user_id IS NOT NULL AND deleted_at IS NULL
+			ON CONFLICT (organization_id, user_id) DO NOTHING`).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE projects SET user_id = NULL WHERE organization_id IS NOT NULL AND user_id IS NOT NULL").Error
+	})
+}
+
+// migrateEmailVerified marks the users registered before email verification
+// as verified, registration used to verify their email automatically. Their
+// email_verified column was added empty, users created since then have it
+// set.
+func migrateEmailVerified(tx *gorm.DB) error {
+	return tx.Exec("UPDATE users SET email_verified = TRUE WHERE email_verified IS NULL").Error
+}
+
+// migrateValuePreviews drops the last characters of the values that previews
+// used to keep
+func migrateValuePreviews(tx *gorm.DB) error {
+	return tx.Exec("UPDATE envs SET value_preview = ? WHERE value_preview <> ? AND value_preview <> ''", MaskedValue, MaskedValue).Error
+}
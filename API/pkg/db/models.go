@@ -1,6 +1,8 @@
 package db
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -8,39 +10,155 @@ import (
 type User struct {
 	gorm.Model
 	KeycloakID         string    `gorm:"uniqueIndex" json:"keycloak_id"`
-	Email              string    `gorm:"uniqueIndex" json:"email"`
+	Email              string    `gorm:"uniqueIndex:idx_users_email_set,where:email <> ''" json:"email"` // empty when Keycloak has none
 	Username           string    `json:"username"`
-	GithubAccessToken  string    `json:"github_access_token"`
-	GithubRefreshToken string    `json:"github_refresh_token"`
+	EmailVerified      bool      `json:"email_verified"`
+	AvatarURL          string    `json:"avatar_url,omitempty"`
+	GithubAccessToken  string    `json:"-"` // encrypted with the keyring, see pkg/secrets
+	GithubRefreshToken string    `json:"-"` // encrypted with the keyring, see pkg/secrets
+	GithubTokenKEKID   string    `json:"-"` // empty for tokens stored before encryption
 	Projects           []Project `gorm:"foreignKey:UserID" json:"projects"`
 
+	// Expiry of the GitHub tokens, nil when GitHub did not set one
+	GithubTokenExpiresAt        *time.Time `json:"-"`
+	GithubRefreshTokenExpiresAt *time.Time `json:"-"`
+
+	// Preferences are nil until the user changes one, see
+	// User.EffectivePreferences
+	Preferences *UserPreferences `gorm:"serializer:json" json:"-"`
+
 	GithubInstallation *GithubInstallation `gorm:"foreignKey:UserID"`
 }
 
-// Project model
+// AccessToken model - personal access token for scripts and CI, acting as
+// its user within its scopes. Only the hash of the token is stored.
+type AccessToken struct {
+	gorm.Model
+	UserID     uint       `gorm:"index" json:"user_id"`
+	User       *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // first characters of the token, to recognize it
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// EmailToken model - single-use token emailed to a user to reset their
+// password or verify their email address. Only the hash of the token is
+// stored.
+type EmailToken struct {
+	gorm.Model
+	UserID    uint       `gorm:"index" json:"user_id"`
+	User      *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	Purpose   string     `gorm:"index" json:"purpose"` // password_reset or email_verification
+	Email     string     `json:"email"`                // address the token was sent to
+	TokenHash string     `gorm:"uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// AccountDeletion model - a user's request to delete their account, carried
+// out once the grace period is over. Kept after the user is gone as the audit
+// trail of what was deleted, so it holds no personal data.
+type AccountDeletion struct {
+	gorm.Model
+	UserID       uint       `gorm:"index" json:"user_id"` // no foreign key, the user is deleted
+	KeycloakID   string     `json:"keycloak_id"`
+	ScheduledFor time.Time  `gorm:"index" json:"scheduled_for"`
+	CancelledAt  *time.Time `json:"cancelled_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	Steps        []string   `gorm:"serializer:json" json:"steps"` // what was deleted, in order
+	LastError    string     `json:"last_error,omitempty"`         // failure of the last attempt, retried
+}
+
+// LoginSession model - the device a Keycloak session was opened from.
+// Keycloak only knows the API's address for the sessions it opens, so the
+// client's address and user agent are recorded at login.
+type LoginSession struct {
+	gorm.Model
+	SessionID  string `gorm:"uniqueIndex" json:"session_id"`
+	KeycloakID string `gorm:"index" json:"-"`
+	UserAgent  string `json:"user_agent"`
+	IPAddress  string `json:"ip_address"`
+}
+
+// Project model - owned by a user, or by an organization when
+// OrganizationID is set (UserID is then empty)
 type Project struct {
 	gorm.Model
 	Name           string  `json:"name"`
 	GitRepo        string  `json:"git_repo"`
 	BuildFolder    string  `json:"build_folder"`
 	FlutterVersion string  `json:"flutter_version"`
-	UserID         uint    `json:"user_id"`
-	User           User    `json:"user"`
+	Analyze        bool    `json:"analyze"` // run flutter analyze before building
+	UserID         *uint   `gorm:"index" json:"user_id,omitempty"`
+	User           *User   `json:"user,omitempty"`
+	OrganizationID *uint   `gorm:"index" json:"organization_id,omitempty"`
 	Builds         []Build `gorm:"foreignKey:ProjectID" json:"builds"`
 	Envs           []Env   `gorm:"foreignKey:ProjectID" json:"envs"`
+
+	Environments []Environment `gorm:"foreignKey:ProjectID" json:"environments,omitempty"`
+
+	Organization *Organization `gorm:"foreignKey:OrganizationID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"organization,omitempty"`
 }
 
 // Build model
 type Build struct {
 	gorm.Model
-	ProjectID   uint    `json:"project_id"`
-	Project     Project `json:"project"`
-	Status      string  `json:"status"`       // pending, running, success, failed
-	Platform    string  `json:"platform"`     // e.g., android, ios
-	ContainerID string  `json:"container_id"` // Kubernetes container ID
-	Duration    int64   `json:"duration"`     // build duration in seconds
-	APKURL      string  `json:"apk_url"`
-	Logs        []Log   `gorm:"foreignKey:BuildID" json:"logs"`
+	ProjectID   uint        `json:"project_id"`
+	Project     Project     `json:"project"`
+	Status      string      `json:"status"`       // pending, running, success, failed
+	Platform    string      `json:"platform"`     // e.g., android, ios
+	Environment string      `json:"environment"`  // name of the environment whose envs were used
+	EnvRevision uint        `json:"env_revision"` // env revision number the build was started with
+	ContainerID string      `json:"container_id"` // Kubernetes container ID
+	Duration    int64       `json:"duration"`     // build duration in seconds
+	APKURL      string      `json:"apk_url"`
+	Logs        []Log       `gorm:"foreignKey:BuildID" json:"logs"`
+	Steps       []BuildStep `gorm:"foreignKey:BuildID" json:"steps"`
+
+	// Once a build is done its log rows are compressed into a single object
+	// in the artifact store and removed from the logs table
+	LogArchiveKey string `json:"log_archive_key,omitempty"`
+	LogArchivedAt int64  `json:"log_archived_at,omitempty"` // Unix timestamp
+	LogsPurged    bool   `json:"logs_purged"`               // archive deleted by retention
+
+	// A single API instance ingests the log of a running build, it holds the
+	// lease until this Unix timestamp and keeps renewing it
+	LogLeaseUntil int64 `json:"-"`
+
+	// The build pod uploads its output with a single-use token
+	ArtifactKey     string `json:"artifact_key,omitempty"`
+	UploadTokenHash string `json:"-"`
+
+	FailureReason *FailureReason `gorm:"serializer:json" json:"failure_reason,omitempty"`
+}
+
+// FailureReason is the known error signature found in a failed build's log
+type FailureReason struct {
+	RuleID     string `json:"rule_id"`
+	Category   string `json:"category"`
+	Reason     string `json:"reason"`
+	Suggestion string `json:"suggestion"`
+	Line       int    `json:"line"`  // 1-based line in the build output
+	Match      string `json:"match"` // the offending log line
+}
+
+// BuildStep model - one phase of a build (clone, pub get, build...) parsed
+// from the step markers emitted by the build script
+type BuildStep struct {
+	gorm.Model
+	BuildID    uint   `gorm:"uniqueIndex:idx_build_step" json:"build_id"`
+	Name       string `gorm:"uniqueIndex:idx_build_step" json:"name"`
+	Position   int    `json:"position"`
+	Status     string `json:"status"`      // running, success, failed
+	StartedAt  int64  `json:"started_at"`  // Unix timestamp
+	FinishedAt int64  `json:"finished_at"` // Unix timestamp, 0 while running
+	Duration   int64  `json:"duration"`    // step duration in seconds
+	FirstLine  int    `json:"first_line"`  // first log line number of the step
+	LastLine   int    `json:"last_line"`   // last log line number of the step
 }
 
 // Log model - stores build logs line by line
@@ -59,18 +177,151 @@ type Env struct {
 	ProjectID uint    `json:"project_id"`
 	Project   Project `json:"project"`
 	Key       string  `json:"key"`
-	Value     string  `json:"value"`
+	Value     string  `json:"-"` // encrypted with the project data key, see pkg/secrets
+	DataKeyID uint    `json:"-"` // 0 for values stored before encryption
+
+	// Secret values are write-only: the API only ever returns their preview
+	IsSecret         bool      `json:"is_secret"`
+	PlainValue       string    `gorm:"-" json:"value,omitempty"` // decrypted value, only set for non-secret envs
+	ValuePreview     string    `json:"value_preview"`
+	ValueUpdatedAt   time.Time `json:"value_updated_at"`
+	ValueUpdatedByID *uint     `json:"value_updated_by_id,omitempty"`
+	ValueUpdatedBy   *User     `gorm:"foreignKey:ValueUpdatedByID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+
+	// Environments the env applies to, an env without environments applies
+	// to all of them
+	Environments []Environment `gorm:"many2many:env_environments;" json:"environments"`
+}
+
+// EnvRevision model - one change to a project's envs (single edit, bulk
+// import or restore), numbered per project
+type EnvRevision struct {
+	gorm.Model
+	ProjectID    uint        `gorm:"uniqueIndex:idx_project_env_revision" json:"project_id"`
+	Number       uint        `gorm:"uniqueIndex:idx_project_env_revision" json:"number"`
+	Source       string      `json:"source"` // baseline, api, import, restore
+	RestoredFrom *uint       `json:"restored_from,omitempty"`
+	UserID       *uint       `json:"user_id,omitempty"`
+	User         *User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+	Username     string      `json:"username,omitempty"` // kept when the user is deleted
+	Changes      []EnvChange `gorm:"foreignKey:RevisionID" json:"changes"`
+}
+
+// EnvChange model - the state of one env after a revision. The value is kept
+// encrypted so the env set can be restored; only hashes are exposed.
+type EnvChange struct {
+	gorm.Model
+	RevisionID     uint   `gorm:"index" json:"revision_id"`
+	EnvID          uint   `gorm:"index" json:"env_id"`
+	Key            string `json:"key"`
+	Action         string `json:"action"` // created, updated, deleted
+	OldHash        string `json:"old_hash,omitempty"`
+	NewHash        string `json:"new_hash,omitempty"`
+	IsSecret       bool   `json:"is_secret"`
+	EnvironmentIDs []uint `gorm:"serializer:json" json:"environment_ids"`
+	Value          string `json:"-"` // encrypted value after the change, empty when deleted
+	DataKeyID      uint   `json:"-"`
+}
+
+// OrganizationEnv model - env inherited by every project of an organization.
+// A project env with the same key overrides it.
+type OrganizationEnv struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"index" json:"organization_id"`
+	Key            string `json:"key"`
+	Value          string `json:"-"` // encrypted with the organization data key, see pkg/secrets
+	DataKeyID      uint   `json:"-"`
+
+	IsSecret         bool      `json:"is_secret"`
+	PlainValue       string    `gorm:"-" json:"value,omitempty"` // decrypted value, only set for non-secret envs
+	ValuePreview     string    `json:"value_preview"`
+	ValueUpdatedAt   time.Time `json:"value_updated_at"`
+	ValueUpdatedByID *uint     `json:"value_updated_by_id,omitempty"`
+	ValueUpdatedBy   *User     `gorm:"foreignKey:ValueUpdatedByID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+}
+
+// SecretFile model - a whole file (Firebase config, signing key...) written
+// into the checked out repository before a build. Its content is write-only.
+type SecretFile struct {
+	gorm.Model
+	ProjectID    uint   `gorm:"index" json:"project_id"`
+	Path         string `json:"path"` // relative to the repository root
+	Content      string `json:"-"`    // encrypted with the project data key, see pkg/secrets
+	DataKeyID    uint   `json:"-"`
+	Size         int    `json:"size"`
+	UploadedByID *uint  `json:"uploaded_by_id,omitempty"`
+	UploadedBy   *User  `gorm:"foreignKey:UploadedByID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+
+	// Environments the file is written in, a file without environments is
+	// written in all of them
+	Environments []Environment `gorm:"many2many:secret_file_environments;" json:"environments"`
+}
+
+// Environment model - a named stage of a project (development, staging,
+// production) selecting which envs a build receives
+type Environment struct {
+	gorm.Model
+	ProjectID uint   `gorm:"uniqueIndex:idx_project_environment" json:"project_id"`
+	Name      string `gorm:"uniqueIndex:idx_project_environment" json:"name"`
+	IsDefault bool   `json:"is_default"`
+}
+
+// DataKey model - per-project (or per-organization) data encryption key,
+// stored wrapped by a key-encryption key of the keyring
+type DataKey struct {
+	gorm.Model
+	ProjectID      uint   `gorm:"index" json:"project_id"`
+	OrganizationID uint   `gorm:"not null;default:0;index" json:"organization_id"` // set instead of ProjectID for organization keys
+	KEKID          string `json:"kek_id"`
+	WrappedKey     []byte `json:"-"`
+	// Empty for encryption keys; "hash" for the key fingerprinting the env
+	// values of a project, which is kept across rotations so fingerprints
+	// stay comparable
+	Purpose string `gorm:"not null;default:''" json:"purpose,omitempty"`
 }
 
 type Organization struct {
 	gorm.Model
-	Name                   string `json:"name" gorm:"not null;uniqueIndex"`
-	KeycloakOrganizationID int64  `json:"keycloak_organization_id" gorm:"not null;uniqueIndex"`
-	Description            string `json:"description,omitempty"`
+	Name                   string  `json:"name" gorm:"not null;uniqueIndex"`
+	KeycloakOrganizationID *string `json:"keycloak_organization_id,omitempty" gorm:"uniqueIndex"` // organization mirrored in the Keycloak realm
+	Description            string  `json:"description,omitempty"`
+	LogRetentionDays       int     `json:"log_retention_days"` // 0 uses LOG_RETENTION_DAYS
 
 	GithubInstallation *GithubInstallation `gorm:"foreignKey:OrganizationID"`
 }
 
+// OrganizationMember model - role of a user in an organization, also held
+// on the organization's projects. Removed members are hard deleted.
+type OrganizationMember struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"uniqueIndex:idx_organization_member" json:"organization_id"`
+	UserID         uint   `gorm:"uniqueIndex:idx_organization_member;index" json:"user_id"`
+	Role           string `gorm:"not null" json:"role"` // owner, admin, developer, viewer
+
+	Organization *Organization `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	User         *User         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// Invitation model - invitation to join an organization sent to an email
+// address. Links carry a token signed with the invitation's nonce, which
+// changes when it is resent.
+type Invitation struct {
+	gorm.Model
+	OrganizationID uint       `gorm:"index" json:"organization_id"`
+	Email          string     `gorm:"index" json:"email"` // lowercased
+	Role           string     `json:"role"`
+	InvitedByID    *uint      `json:"invited_by_id,omitempty"`
+	Nonce          string     `json:"-"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	SentAt         time.Time  `json:"sent_at"`
+	AcceptedAt     *time.Time `json:"accepted_at,omitempty"`
+	AcceptedByID   *uint      `json:"accepted_by_id,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+
+	Organization *Organization `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"organization,omitempty"`
+	InvitedBy    *User         `gorm:"foreignKey:InvitedByID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"-"`
+}
+
 type GithubInstallation struct {
 	gorm.Model
 
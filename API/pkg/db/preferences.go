@@ -0,0 +1,31 @@
+package db
+
+// UserPreferences model - settings of a user, stored as JSON on the user
+type UserPreferences struct {
+	Locale        string               `json:"locale"` // BCP 47 tag of the UI and email language
+	Notifications NotificationSettings `json:"notifications"`
+}
+
+// NotificationSettings are the emails a user wants to receive
+type NotificationSettings struct {
+	BuildFailed    bool `json:"build_failed"`
+	BuildSucceeded bool `json:"build_succeeded"`
+	ProductUpdates bool `json:"product_updates"`
+}
+
+// DefaultPreferences apply to the users who never changed their preferences
+var DefaultPreferences = UserPreferences{
+	Locale: "en",
+	Notifications: NotificationSettings{
+		BuildFailed: true,
+	},
+}
+
+// EffectivePreferences returns the preferences of the user, the defaults
+// when they never changed them
+func (u User) EffectivePreferences() UserPreferences {
+	if u.Preferences == nil {
+		return DefaultPreferences
+	}
+	return *u.Preferences
+}
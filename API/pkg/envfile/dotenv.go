@@ -0,0 +1,128 @@
+package envfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseDotenv decodes a .env file. Values are taken literally: unquoted and
+// single-quoted values as written, double-quoted values with their \n, \r
+// and \t escapes decoded and a backslash escaping any other character. $ is
+// never expanded.
+//
+//	# comment
+//	export KEY=value # comment
+//	KEY='literal $value'
+//	KEY="line\nline"
+func parseDotenv(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	src := strings.ReplaceAll(string(data), "\r\n", "\n")
+
+	for lineNumber := 1; src != ""; lineNumber++ {
+		var line string
+		line, src, _ = strings.Cut(src, "\n")
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		switch {
+		case strings.HasPrefix(rest, "'"), strings.HasPrefix(rest, `"`):
+			// Quoted values can span lines
+			quote := rest[0]
+			start := lineNumber
+			var tail string
+			var err error
+			value, tail, src, lineNumber, err = quoted(quote, rest[1:], src, lineNumber)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", start, err)
+			}
+			if tail = strings.TrimSpace(tail); tail != "" && !strings.HasPrefix(tail, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after the value of %s", lineNumber, tail, key)
+			}
+		default:
+			value = rest
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			value = strings.TrimSpace(value)
+		}
+
+		values[key] = value
+	}
+	return values, nil
+}
+
+// quoted reads a value up to its closing quote, continuing on the following
+// lines of src when needed. It returns the value, the rest of the line after
+// the closing quote, the remaining source and the current line number.
+func quoted(quote byte, line, src string, lineNumber int) (value, tail, rest string, n int, err error) {
+	var b strings.Builder
+	for {
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case c == quote:
+				return b.String(), line[i+1:], src, lineNumber, nil
+			case c == '\\' && quote == '"' && i+1 < len(line):
+				i++
+				switch line[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(line[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		if src == "" {
+			return "", "", "", lineNumber, fmt.Errorf("missing closing quote")
+		}
+		b.WriteByte('\n')
+		line, src, _ = strings.Cut(src, "\n")
+		lineNumber++
+	}
+}
+
+// dotenvEscaper escapes a value for a double-quoted .env value. $ is escaped
+// too so that parsers expanding variables keep it literal.
+var dotenvEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	`$`, `\$`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+)
+
+// formatDotenv encodes values as a .env file, one KEY="value" line per
+// variable sorted by name. Every value is quoted so that it is read back as
+// written: unquoted, 007 or +5 would be taken as numbers by some parsers.
+func formatDotenv(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", key, dotenvEscaper.Replace(values[key]))
+	}
+	return b.String()
+}
@@ -0,0 +1,153 @@
+// Package envfile reads and writes sets of env variables in the .env, JSON
+// and YAML formats used for bulk import and export.
+package envfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatDotenv = "dotenv"
+	FormatJSON   = "json"
+	FormatYAML   = "yaml"
+)
+
+// keyRegexp matches POSIX portable environment variable names
+var keyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidKey reports whether key is a valid environment variable name
+func ValidKey(key string) bool {
+	return keyRegexp.MatchString(key)
+}
+
+// FormatFromContentType maps a request Content-Type to a format, defaulting
+// to dotenv
+func FormatFromContentType(contentType string) string {
+	switch {
+	case strings.Contains(contentType, "json"):
+		return FormatJSON
+	case strings.Contains(contentType, "yaml"):
+		return FormatYAML
+	default:
+		return FormatDotenv
+	}
+}
+
+// Parse decodes a set of variables. JSON and YAML documents must be a flat
+// object of scalar values. Values are taken literally, references to other
+// variables such as $HOME are not expanded.
+func Parse(format string, data []byte) (map[string]string, error) {
+	values := map[string]string{}
+
+	switch format {
+	case FormatDotenv:
+		parsed, err := parseDotenv(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid .env file: %v", err)
+		}
+		values = parsed
+
+	case FormatJSON:
+		// Numbers are kept as written, float64 would turn large integers
+		// into 1e+21
+		var raw map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("invalid %s document: %v", format, err)
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("invalid %s document: unexpected data after the object", format)
+		}
+		for key, value := range raw {
+			switch v := value.(type) {
+			case nil:
+				values[key] = ""
+			case string:
+				values[key] = v
+			case json.Number:
+				values[key] = v.String()
+			case bool:
+				values[key] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("value of %q must be a string, number or boolean", key)
+			}
+		}
+
+	case FormatYAML:
+		// Scalars are read as written for the same reason
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid %s document: %v", format, err)
+		}
+		if len(doc.Content) == 0 {
+			break
+		}
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("invalid %s document: expected a mapping", format)
+		}
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, node := root.Content[i].Value, root.Content[i+1]
+			switch {
+			case node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null":
+				values[key] = ""
+			case node.Kind == yaml.ScalarNode:
+				values[key] = node.Value
+			default:
+				return nil, fmt.Errorf("value of %q must be a string, number or boolean", key)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	var invalid []string
+	for key := range values {
+		if !ValidKey(key) {
+			invalid = append(invalid, key)
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("invalid variable names: %s", strings.Join(invalid, ", "))
+	}
+
+	return values, nil
+}
+
+// Format encodes a set of variables. Secret variables are never written with
+// their value: the .env output lists them as comments and the JSON and YAML
+// outputs leave them out.
+func Format(format string, values map[string]string, secrets []string) ([]byte, error) {
+	sort.Strings(secrets)
+
+	switch format {
+	case FormatDotenv:
+		var b strings.Builder
+		b.WriteString(formatDotenv(values))
+		for _, key := range secrets {
+			fmt.Fprintf(&b, "# %s is a secret, its value is not exported\n", key)
+		}
+		return []byte(b.String()), nil
+
+	case FormatJSON:
+		return json.MarshalIndent(values, "", "  ")
+
+	case FormatYAML:
+		return yaml.Marshal(values)
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -0,0 +1,142 @@
+package envfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDotenvDoesNotExpand(t *testing.T) {
+	t.Setenv("HOME", "/root")
+
+	data := []byte(`# comment
+UNQUOTED=$HOME/bin
+BRACES=${HOME}
+SINGLE='$HOME and \n stay'
+DOUBLE="$HOME\n\"x\" \$y"
+export EXPORTED=value # comment
+HASH=a#b
+EMPTY=
+MULTI="first
+second"
+`)
+	got, err := Parse(FormatDotenv, data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := map[string]string{
+		"UNQUOTED": "$HOME/bin",
+		"BRACES":   "${HOME}",
+		"SINGLE":   `$HOME and \n stay`,
+		"DOUBLE":   "$HOME\n\"x\" $y",
+		"EXPORTED": "value",
+		"HASH":     "a#b",
+		"EMPTY":    "",
+		"MULTI":    "first\nsecond",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse = %#v, want %#v", got, want)
+	}
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"no separator":  "KEY\n",
+		"unclosed":      "KEY=\"value\n",
+		"after quote":   "KEY='value' extra\n",
+		"invalid name":  "1KEY=value\n",
+		"invalid name2": "MY-KEY=value\n",
+	} {
+		if _, err := Parse(FormatDotenv, []byte(data)); err == nil {
+			t.Errorf("%s: Parse(%q) succeeded", name, data)
+		}
+	}
+}
+
+func TestParseKeepsNumbers(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{FormatJSON, `{"BIG": 1000000000000000000000, "FLOAT": 1.50, "BOOL": true, "NULL": null, "STR": "x"}`},
+		{FormatYAML, "BIG: 1000000000000000000000\nFLOAT: 1.50\nBOOL: true\nNULL: null\nSTR: x\n"},
+	}
+	want := map[string]string{
+		"BIG":   "1000000000000000000000",
+		"FLOAT": "1.50",
+		"BOOL":  "true",
+		"NULL":  "",
+		"STR":   "x",
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.format, []byte(tt.data))
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", tt.format, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Parse = %#v, want %#v", tt.format, got, want)
+		}
+	}
+}
+
+func TestParseRejectsNested(t *testing.T) {
+	tests := map[string]string{
+		FormatJSON: `{"KEY": {"nested": 1}}`,
+		FormatYAML: "KEY:\n  - a\n",
+	}
+	for format, data := range tests {
+		if _, err := Parse(format, []byte(data)); err == nil {
+			t.Errorf("%s: Parse(%q) succeeded", format, data)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"DOLLAR":  "pa$$word ${X}",
+		"QUOTES":  `say "hi" 'there'`,
+		"NEWLINE": "a\nb",
+		"NUMBER":  "42",
+		"HASH":    "a #b",
+		"ZEROS":   "007",
+		"PLUS":    "+5",
+		"HEX":     "0x1F",
+		"COMMENT": "#not a comment",
+		"EQUALS":  "a=b==",
+		"SINGLE":  "it's",
+		"ESCAPES": `C:\new\table \"x\" \$HOME`,
+		"MULTI":   "first\n\tsecond\r\nthird\n",
+		"SPACES":  "  padded  ",
+		"EMPTY":   "",
+	}
+
+	for _, format := range []string{FormatDotenv, FormatJSON, FormatYAML} {
+		data, err := Format(format, values, nil)
+		if err != nil {
+			t.Fatalf("%s: Format: %v", format, err)
+		}
+		got, err := Parse(format, data)
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("%s: round trip = %#v, want %#v", format, got, values)
+		}
+	}
+}
+
+func TestFormatDotenvQuotes(t *testing.T) {
+	data, err := Format(FormatDotenv, map[string]string{"PIN": "007", "N": "+5", "A": `"$x"`}, []string{"TOKEN"})
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	want := `A="\"\$x\""
+N="+5"
+PIN="007"
+# TOKEN is a secret, its value is not exported
+`
+	if string(data) != want {
+		t.Errorf("Format =\n%s\nwant\n%s", data, want)
+	}
+}
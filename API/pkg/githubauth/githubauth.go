@@ -0,0 +1,254 @@
+// Package githubauth handles the GitHub OAuth tokens of users: exchanging
+// the authorization code, refreshing expiring tokens and revoking the grant
+// when the user disconnects GitHub.
+package githubauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// refreshMargin is how long before expiry an access token is refreshed
+const refreshMargin = 5 * time.Minute
+
+const (
+	tokenURL = "https://github.com/login/oauth/access_token"
+	apiURL   = "https://api.github.com"
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+var (
+	ErrNotConfigured = errors.New("GitHub client not configured")
+	ErrNotConnected  = errors.New("GitHub not connected")
+	// ErrReconnect is returned when the authorization can no longer be
+	// refreshed, the user has to connect GitHub again
+	ErrReconnect = errors.New("GitHub authorization expired")
+)
+
+// Token is the response of the GitHub token endpoint. The expiries are only
+// set for GitHub Apps with expiring user tokens.
+type Token struct {
+	AccessToken           string `json:"access_token"`
+	TokenType             string `json:"token_type"`
+	Scope                 string `json:"scope"`
+	ExpiresIn             int64  `json:"expires_in"`
+	RefreshToken          string `json:"refresh_token"`
+	RefreshTokenExpiresIn int64  `json:"refresh_token_expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func credentials() (clientID, clientSecret string, err error) {
+	clientID = os.Getenv("GITHUB_CLIENT_ID")
+	clientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		return "", "", ErrNotConfigured
+	}
+	return clientID, clientSecret, nil
+}
+
+// Exchange trades the code of the OAuth callback for tokens
+func Exchange(ctx context.Context, code string) (Token, error) {
+	return requestToken(ctx, url.Values{"code": {code}})
+}
+
+// Refresh trades a refresh token for new tokens. GitHub refresh tokens are
+// single-use.
+func Refresh(ctx context.Context, refreshToken string) (Token, error) {
+	return requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func requestToken(ctx context.Context, form url.Values) (Token, error) {
+	var token Token
+	clientID, clientSecret, err := credentials()
+	if err != nil {
+		return token, err
+	}
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return token, fmt.Errorf("failed to request GitHub token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("GitHub token endpoint returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return token, fmt.Errorf("failed to parse GitHub token: %v", err)
+	}
+	// Errors come with a 200 status
+	switch token.Error {
+	case "":
+	case "bad_verification_code", "bad_refresh_token":
+		return token, ErrReconnect
+	default:
+		return token, fmt.Errorf("GitHub token error %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return token, fmt.Errorf("GitHub token response has no access token")
+	}
+	return token, nil
+}
+
+// Store saves the tokens encrypted on the user
+func Store(tx *gorm.DB, user *db.User, token Token) error {
+	if err := secrets.EncryptGithubTokens(user, token.AccessToken, token.RefreshToken); err != nil {
+		return err
+	}
+	user.GithubTokenExpiresAt = expiry(token.ExpiresIn)
+	user.GithubRefreshTokenExpiresAt = expiry(token.RefreshTokenExpiresIn)
+
+	return tx.Model(user).Select("github_access_token", "github_refresh_token", "github_token_kek_id",
+		"github_token_expires_at", "github_refresh_token_expires_at").Updates(user).Error
+}
+
+// Clear forgets the tokens of the user
+func Clear(tx *gorm.DB, user *db.User) error {
+	user.GithubAccessToken = ""
+	user.GithubRefreshToken = ""
+	user.GithubTokenKEKID = ""
+	user.GithubTokenExpiresAt = nil
+	user.GithubRefreshTokenExpiresAt = nil
+
+	return tx.Model(user).Select("github_access_token", "github_refresh_token", "github_token_kek_id",
+		"github_token_expires_at", "github_refresh_token_expires_at").Updates(user).Error
+}
+
+// AccessToken returns a usable GitHub access token of the user, refreshing
+// it first when it expires soon. When the refresh token is rejected or
+// expired the tokens are cleared and ErrReconnect is returned.
+func AccessToken(ctx context.Context, userID uint) (string, error) {
+	var user db.User
+	if err := db.DB.First(&user, userID).Error; err != nil {
+		return "", err
+	}
+	if user.GithubAccessToken == "" {
+		return "", ErrNotConnected
+	}
+	if !expiresSoon(user.GithubTokenExpiresAt) {
+		accessToken, _, err := secrets.GithubTokens(user)
+		return accessToken, err
+	}
+
+	// Refresh tokens are single-use, concurrent requests wait for the one
+	// refreshing and use its token
+	var accessToken string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+		current, refreshToken, err := secrets.GithubTokens(user)
+		if err != nil {
+			return err
+		}
+		if user.GithubAccessToken == "" {
+			return ErrNotConnected
+		}
+		if !expiresSoon(user.GithubTokenExpiresAt) {
+			accessToken = current
+			return nil
+		}
+		if refreshToken == "" || user.GithubRefreshTokenExpiresAt != nil && time.Now().After(*user.GithubRefreshTokenExpiresAt) {
+			return ErrReconnect
+		}
+
+		token, err := Refresh(ctx, refreshToken)
+		if err != nil {
+			return err
+		}
+		accessToken = token.AccessToken
+		return Store(tx, &user, token)
+	})
+	if errors.Is(err, ErrReconnect) {
+		if clearErr := Clear(db.DB, &user); clearErr != nil {
+			return "", clearErr
+		}
+	}
+	return accessToken, err
+}
+
+// Revoke deletes the authorization of the app for the user at GitHub, which
+// invalidates all of its tokens. A grant already revoked is not an error.
+func Revoke(ctx context.Context, accessToken string) error {
+	clientID, clientSecret, err := credentials()
+	if err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]string{"access_token": accessToken})
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, apiURL+"/applications/"+url.PathEscape(clientID)+"/grant", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(clientID, clientSecret)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to revoke GitHub grant: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("GitHub returned %s revoking the grant", resp.Status)
+	}
+}
+
+// Disconnect revokes the grant of the user at GitHub and forgets their
+// tokens. Tokens that cannot be decrypted anymore are only forgotten.
+func Disconnect(ctx context.Context, user *db.User) error {
+	accessToken, _, err := secrets.GithubTokens(*user)
+	if err != nil {
+		log.Printf("Forgetting the GitHub tokens of user %d without revoking them: %v", user.ID, err)
+	} else if accessToken != "" {
+		if err := Revoke(ctx, accessToken); err != nil {
+			return err
+		}
+	}
+	return Clear(db.DB, user)
+}
+
+func expiry(seconds int64) *time.Time {
+	if seconds <= 0 {
+		return nil
+	}
+	t := time.Now().Add(time.Duration(seconds) * time.Second)
+	return &t
+}
+
+func expiresSoon(t *time.Time) bool {
+	return t != nil && time.Now().Add(refreshMargin).After(*t)
+}
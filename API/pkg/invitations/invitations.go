@@ -0,0 +1,150 @@
+// Package invitations signs the links of organization invitations and emails
+// them.
+package invitations
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// Lifetime is how long an invitation link stays valid after being sent
+const Lifetime = 7 * 24 * time.Hour
+
+var (
+	// ErrInvalidToken is returned for malformed, forged, replaced (by a
+	// resend), revoked or already accepted invitation tokens
+	ErrInvalidToken = errors.New("invalid invitation token")
+	ErrExpired      = errors.New("invitation expired")
+)
+
+// signingKey signs the invitation tokens, set up by InitSigningKey
+var signingKey []byte
+
+// InitSigningKey reads the key signing invitation links from
+// INVITATION_SECRET. Without it a random key is used, and the links sent
+// stop working when the API restarts.
+func InitSigningKey() {
+	if secret := os.Getenv("INVITATION_SECRET"); secret != "" {
+		signingKey = []byte(secret)
+		return
+	}
+
+	signingKey = make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		log.Fatalf("Failed to generate invitation signing key: %v", err)
+	}
+	log.Println("INVITATION_SECRET is not set, invitation links will not survive a restart")
+}
+
+// Renew gives the invitation a new nonce and expiry, invalidating the links
+// sent before
+func Renew(invitation *db.Invitation) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	now := time.Now()
+	invitation.Nonce = hex.EncodeToString(b)
+	invitation.ExpiresAt = now.Add(Lifetime)
+	invitation.SentAt = now
+	return nil
+}
+
+// Token returns the token of the invitation link
+func Token(invitation db.Invitation) string {
+	payload := fmt.Sprintf("%d.%d", invitation.ID, invitation.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(payload, invitation.Nonce))
+}
+
+// Find returns the pending invitation a token was issued for, with its
+// organization
+func Find(tx *gorm.DB, token string) (db.Invitation, error) {
+	var invitation db.Invitation
+
+	encodedPayload, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return invitation, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return invitation, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return invitation, ErrInvalidToken
+	}
+	id, expiresAt, found := strings.Cut(string(payload), ".")
+	if !found {
+		return invitation, ErrInvalidToken
+	}
+	invitationID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return invitation, ErrInvalidToken
+	}
+
+	if err := tx.Preload("Organization").Where("id = ?", invitationID).Limit(1).Find(&invitation).Error; err != nil {
+		return invitation, err
+	}
+	if invitation.ID == 0 || !hmac.Equal(signature, sign(string(payload), invitation.Nonce)) ||
+		strconv.FormatInt(invitation.ExpiresAt.Unix(), 10) != expiresAt {
+		return invitation, ErrInvalidToken
+	}
+	if invitation.RevokedAt != nil || invitation.AcceptedAt != nil || invitation.Organization == nil {
+		return invitation, ErrInvalidToken
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return invitation, ErrExpired
+	}
+	return invitation, nil
+}
+
+// Send emails the invitation link to the invited address
+func Send(ctx context.Context, m mailer.Mailer, invitation db.Invitation, organization db.Organization, inviter string) error {
+	link := utils.FrontendURL() + "/invitations/accept?token=" + url.QueryEscape(Token(invitation))
+
+	invitedBy := ""
+	if inviter != "" {
+		invitedBy = " by " + inviter
+	}
+	text := fmt.Sprintf(`Hello,
+
+You have been invited%s to join the %s organization on Flotio as %s.
+
+Accept the invitation: %s
+
+If you do not have an account yet, sign up with this email address and you
+will join the organization once you verify it.
+
+This invitation expires on %s.
+`, invitedBy, organization.Name, invitation.Role, link, invitation.ExpiresAt.UTC().Format("January 2, 2006 15:04 MST"))
+
+	return m.Send(ctx, mailer.Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("Join %s on Flotio", organization.Name),
+		Text:    text,
+	})
+}
+
+func sign(payload, nonce string) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(payload + "." + nonce))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,199 @@
+package invitations
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+	"github.com/flotio-dev/api/pkg/mailer"
+	"gorm.io/gorm"
+)
+
+func useSigningKey(t *testing.T, key string) {
+	t.Helper()
+	previous := signingKey
+	signingKey = []byte(key)
+	t.Cleanup(func() { signingKey = previous })
+}
+
+// createInvitation stores a pending invitation to a new organization
+func createInvitation(t *testing.T, tx *gorm.DB) db.Invitation {
+	t.Helper()
+	suffix := time.Now().UnixNano()
+	organization := db.Organization{Name: fmt.Sprintf("invitations-test-%d", suffix)}
+	if err := tx.Create(&organization).Error; err != nil {
+		t.Fatalf("Create organization: %v", err)
+	}
+	invitation := db.Invitation{
+		OrganizationID: organization.ID,
+		Email:          fmt.Sprintf("invited-%d@example.com", suffix),
+		Role:           "developer",
+	}
+	if err := Renew(&invitation); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if err := tx.Create(&invitation).Error; err != nil {
+		t.Fatalf("Create invitation: %v", err)
+	}
+	return invitation
+}
+
+func TestFindMalformed(t *testing.T) {
+	useSigningKey(t, "test-secret")
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	// Rejected before looking the invitation up
+	for _, token := range []string{
+		"",
+		"no-separator",
+		"!!!." + encode("signature"),
+		encode("1.123") + ".!!!",
+		encode("1") + "." + encode("signature"),
+		encode("abc.123") + "." + encode("signature"),
+	} {
+		if _, err := Find(nil, token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Find(%q) error = %v, want ErrInvalidToken", token, err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	tx := dbtest.Open(t)
+	useSigningKey(t, "test-secret")
+
+	invitation := createInvitation(t, tx)
+	found, err := Find(tx, Token(invitation))
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if found.ID != invitation.ID || found.Organization == nil {
+		t.Errorf("Find returned invitation %d with organization %v, want %d", found.ID, found.Organization, invitation.ID)
+	}
+}
+
+func TestFindForged(t *testing.T) {
+	tx := dbtest.Open(t)
+	useSigningKey(t, "test-secret")
+
+	invitation := createInvitation(t, tx)
+	other := createInvitation(t, tx)
+	token := Token(invitation)
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// Signed with another key
+	signingKey = []byte("another-secret")
+	otherKey := Token(invitation)
+	signingKey = []byte("test-secret")
+
+	// Later expiry, signature of the original payload
+	extended := invitation
+	extended.ExpiresAt = invitation.ExpiresAt.Add(24 * time.Hour)
+	extendedPayload, _, _ := strings.Cut(Token(extended), ".")
+
+	// Another invitation, signature of the first one
+	otherPayload, _, _ := strings.Cut(Token(other), ".")
+
+	tests := map[string]string{
+		"other key":       otherKey,
+		"extended expiry": extendedPayload + "." + signature,
+		"other id":        otherPayload + "." + signature,
+		"no signature":    payload + ".",
+		"unknown id":      base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", other.ID+1000000, invitation.ExpiresAt.Unix()))) + "." + signature,
+	}
+	for name, token := range tests {
+		if _, err := Find(tx, token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Find error = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestFindExpired(t *testing.T) {
+	tx := dbtest.Open(t)
+	useSigningKey(t, "test-secret")
+
+	invitation := createInvitation(t, tx)
+	invitation.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := tx.Model(&invitation).Update("expires_at", invitation.ExpiresAt).Error; err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	if _, err := Find(tx, Token(invitation)); !errors.Is(err, ErrExpired) {
+		t.Errorf("Find error = %v, want ErrExpired", err)
+	}
+}
+
+func TestFindReplaced(t *testing.T) {
+	tx := dbtest.Open(t)
+	useSigningKey(t, "test-secret")
+
+	invitation := createInvitation(t, tx)
+	old := Token(invitation)
+
+	// A resend renews the invitation
+	if err := Renew(&invitation); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if err := tx.Save(&invitation).Error; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if _, err := Find(tx, old); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Find(old token) error = %v, want ErrInvalidToken", err)
+	}
+	if _, err := Find(tx, Token(invitation)); err != nil {
+		t.Errorf("Find(new token): %v", err)
+	}
+}
+
+func TestFindNotPending(t *testing.T) {
+	tx := dbtest.Open(t)
+	useSigningKey(t, "test-secret")
+
+	for _, column := range []string{"revoked_at", "accepted_at"} {
+		invitation := createInvitation(t, tx)
+		if err := tx.Model(&invitation).Update(column, time.Now()).Error; err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if _, err := Find(tx, Token(invitation)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Find error = %v, want ErrInvalidToken", column, err)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	useSigningKey(t, "test-secret")
+	t.Setenv("FRONTEND_URL", "https://flotio.test")
+
+	invitation := db.Invitation{Email: "invited@example.com", Role: "viewer"}
+	invitation.ID = 42
+	if err := Renew(&invitation); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+
+	m := &mailer.Memory{}
+	if err := Send(context.Background(), m, invitation, db.Organization{Name: "acme"}, "alice"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	messages := m.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.To != invitation.Email {
+		t.Errorf("To = %q, want %q", msg.To, invitation.Email)
+	}
+	link := "https://flotio.test/invitations/accept?token=" + url.QueryEscape(Token(invitation))
+	if !strings.Contains(msg.Text, link) {
+		t.Errorf("Text does not contain the link %s:\n%s", link, msg.Text)
+	}
+	if !strings.Contains(msg.Text, "invited by alice to join the acme organization") {
+		t.Errorf("Text does not name the inviter and organization:\n%s", msg.Text)
+	}
+}
@@ -0,0 +1,152 @@
+// Package keycloak administers the users and organizations of the realm
+// through the Keycloak admin API.
+//
+// The API authenticates as the service account of a dedicated confidential
+// client (client credentials grant). Its admin token is cached and renewed
+// shortly before it expires.
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// refreshMargin is how long before its expiry the admin token is renewed
+const refreshMargin = 30 * time.Second
+
+// Config of an Admin
+type Config struct {
+	// BaseURL of the Keycloak server
+	BaseURL string
+	// Realm administered, the service account client belongs to it
+	Realm string
+	// ClientID and ClientSecret of the confidential client whose service
+	// account holds the realm-management roles (manage-users, manage-realm)
+	ClientID     string
+	ClientSecret string
+}
+
+// Admin calls the Keycloak admin API of a realm
+type Admin struct {
+	config Config
+	client *gocloak.GoCloak
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// Default is the admin client used by the API, set up by InitAdmin
+var Default *Admin
+
+func InitAdmin() {
+	admin, err := NewAdminFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure Keycloak admin client: %v", err)
+	}
+	Default = admin
+
+	log.Printf("Administering Keycloak realm %s as client %s", admin.config.Realm, admin.config.ClientID)
+}
+
+// NewAdminFromEnv configures an Admin from KEYCLOAK_BASE_URL, KEYCLOAK_REALM,
+// KEYCLOAK_ADMIN_CLIENT_ID and KEYCLOAK_ADMIN_CLIENT_SECRET
+func NewAdminFromEnv() (*Admin, error) {
+	config := Config{
+		BaseURL:      os.Getenv("KEYCLOAK_BASE_URL"),
+		Realm:        os.Getenv("KEYCLOAK_REALM"),
+		ClientID:     os.Getenv("KEYCLOAK_ADMIN_CLIENT_ID"),
+		ClientSecret: os.Getenv("KEYCLOAK_ADMIN_CLIENT_SECRET"),
+	}
+	if config.BaseURL == "" || config.Realm == "" {
+		return nil, fmt.Errorf("KEYCLOAK_BASE_URL and KEYCLOAK_REALM must be set")
+	}
+	if config.ClientID == "" || config.ClientSecret == "" {
+		return nil, fmt.Errorf("KEYCLOAK_ADMIN_CLIENT_ID and KEYCLOAK_ADMIN_CLIENT_SECRET must be set")
+	}
+	return NewAdmin(config), nil
+}
+
+func NewAdmin(config Config) *Admin {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	return &Admin{
+		config: config,
+		client: gocloak.NewClient(config.BaseURL),
+	}
+}
+
+// Token returns the cached admin token, requesting a new one when it is
+// missing or about to expire
+func (a *Admin) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Before(a.expiresAt) {
+		return a.token, nil
+	}
+
+	jwt, err := a.client.LoginClient(ctx, a.config.ClientID, a.config.ClientSecret, a.config.Realm)
+	if err != nil {
+		return "", fmt.Errorf("keycloak: service account login: %w", err)
+	}
+
+	lifetime := time.Duration(jwt.ExpiresIn) * time.Second
+	margin := refreshMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	a.token = jwt.AccessToken
+	a.expiresAt = time.Now().Add(lifetime - margin)
+	return a.token, nil
+}
+
+// invalidate drops the cached token if it is still token
+func (a *Admin) invalidate(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == token {
+		a.token = ""
+	}
+}
+
+// do runs fn with the admin token. A token rejected by Keycloak (revoked, or
+// the server restarted) is dropped and fn retried once with a new one.
+func (a *Admin) do(ctx context.Context, fn func(token string) error) error {
+	token, err := a.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(token)
+	if !isStatus(err, http.StatusUnauthorized) {
+		return err
+	}
+
+	a.invalidate(token)
+	if token, err = a.Token(ctx); err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+// adminURL returns the URL of an admin API path of the realm
+func (a *Admin) adminURL(path ...string) string {
+	parts := []string{a.config.BaseURL, "admin", "realms", a.config.Realm}
+	return strings.Join(append(parts, path...), "/")
+}
+
+// isStatus reports whether err is a Keycloak response with the HTTP status
+func isStatus(err error, status int) bool {
+	var apiErr *gocloak.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == status
+}
@@ -0,0 +1,378 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+const testRealm = "flotio"
+
+// fakeKeycloak issues service account tokens and answers the admin API of
+// testRealm with handler, for the requests bearing a token it issued
+type fakeKeycloak struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	expiresIn int
+	issued    int
+	valid     map[string]bool
+	requests  int // admin API requests, rejected ones included
+	handler   http.HandlerFunc
+}
+
+func newFakeKeycloak(t *testing.T, handler http.HandlerFunc) *fakeKeycloak {
+	t.Helper()
+	k := &fakeKeycloak{expiresIn: 300, valid: map[string]bool{}, handler: handler}
+	k.Server = httptest.NewServer(http.HandlerFunc(k.serve))
+	t.Cleanup(k.Close)
+	return k
+}
+
+func (k *fakeKeycloak) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	k.mu.Lock()
+	if r.URL.Path == "/realms/"+testRealm+"/protocol/openid-connect/token" {
+		defer k.mu.Unlock()
+		clientID, secret, ok := r.BasicAuth()
+		if !ok {
+			clientID, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+		}
+		if r.FormValue("grant_type") != "client_credentials" || clientID != "api-admin" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized_client"})
+			return
+		}
+		k.issued++
+		token := fmt.Sprintf("token-%d", k.issued)
+		k.valid[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": token,
+			"expires_in":   k.expiresIn,
+			"token_type":   "Bearer",
+		})
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/admin/realms/"+testRealm+"/") {
+		k.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	k.requests++
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	valid := k.valid[token]
+	handler := k.handler
+	k.mu.Unlock()
+
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "HTTP 401 Unauthorized"})
+		return
+	}
+	handler(w, r)
+}
+
+// revokeTokens makes the admin API reject the tokens issued so far, as after
+// a Keycloak restart
+func (k *fakeKeycloak) revokeTokens() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.valid = map[string]bool{}
+}
+
+func (k *fakeKeycloak) counts() (issued, requests int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.issued, k.requests
+}
+
+func (k *fakeKeycloak) admin() *Admin {
+	return NewAdmin(Config{BaseURL: k.URL + "/", Realm: testRealm, ClientID: "api-admin", ClientSecret: "secret"})
+}
+
+// userHandler accepts the updates of users
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/users/") {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateUser sets the username of the user id with admin
+func updateUser(admin *Admin, id string) error {
+	return admin.UpdateUser(context.Background(), gocloak.User{ID: &id, Username: gocloak.StringP("alice")})
+}
+
+func TestTokenCached(t *testing.T) {
+	k := newFakeKeycloak(t, userHandler)
+	admin := k.admin()
+	ctx := context.Background()
+
+	first, err := admin.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	second, err := admin.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if first != second {
+		t.Errorf("Token returned %q then %q, want the cached token", first, second)
+	}
+	if issued, _ := k.counts(); issued != 1 {
+		t.Errorf("issued %d tokens, want 1", issued)
+	}
+
+	// Renewed before it expires, by the refresh margin
+	if until := time.Until(admin.expiresAt); until < 260*time.Second || until > 270*time.Second {
+		t.Errorf("token cached for %v, want 270s", until)
+	}
+}
+
+func TestTokenShortLifetime(t *testing.T) {
+	k := newFakeKeycloak(t, userHandler)
+	k.expiresIn = 20
+	admin := k.admin()
+
+	if _, err := admin.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	// The margin never exceeds half of the lifetime
+	if until := time.Until(admin.expiresAt); until < 9*time.Second || until > 10*time.Second {
+		t.Errorf("token cached for %v, want 10s", until)
+	}
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	k := newFakeKeycloak(t, userHandler)
+	admin := k.admin()
+	ctx := context.Background()
+
+	first, err := admin.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	// Within the refresh margin, the token is still valid in Keycloak
+	admin.expiresAt = time.Now().Add(-time.Millisecond)
+	second, err := admin.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if second == first {
+		t.Error("Token returned the token about to expire")
+	}
+	if issued, _ := k.counts(); issued != 2 {
+		t.Errorf("issued %d tokens, want 2", issued)
+	}
+}
+
+func TestTokenLoginFailure(t *testing.T) {
+	k := newFakeKeycloak(t, userHandler)
+	admin := NewAdmin(Config{BaseURL: k.URL, Realm: testRealm, ClientID: "api-admin", ClientSecret: "wrong"})
+
+	if _, err := admin.Token(context.Background()); err == nil {
+		t.Fatal("Token succeeded with a wrong client secret")
+	}
+	if err := updateUser(admin, "u1"); err == nil {
+		t.Fatal("UpdateUser succeeded without a token")
+	}
+	if _, requests := k.counts(); requests != 0 {
+		t.Errorf("%d admin API requests without a token, want 0", requests)
+	}
+}
+
+func TestDoRetriesOnceOnUnauthorized(t *testing.T) {
+	k := newFakeKeycloak(t, userHandler)
+	admin := k.admin()
+
+	if err := updateUser(admin, "u1"); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+
+	// The cached token is rejected: dropped, and the call retried with a
+	// new one
+	k.revokeTokens()
+	if err := updateUser(admin, "u2"); err != nil {
+		t.Fatalf("UpdateUser after the tokens were revoked: %v", err)
+	}
+	if issued, requests := k.counts(); issued != 2 || requests != 3 {
+		t.Errorf("issued %d tokens for %d requests, want 2 for 3", issued, requests)
+	}
+}
+
+func TestDoGivesUpAfterOneRetry(t *testing.T) {
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		// The service account lost its roles
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "HTTP 401 Unauthorized"})
+	})
+	admin := k.admin()
+
+	err := updateUser(admin, "u1")
+	if !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("UpdateUser error = %v, want a 401 API error", err)
+	}
+	if issued, requests := k.counts(); issued != 2 || requests != 2 {
+		t.Errorf("issued %d tokens for %d requests, want 2 for 2", issued, requests)
+	}
+}
+
+func TestDoDoesNotRetryOtherErrors(t *testing.T) {
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "HTTP 403 Forbidden"})
+	})
+	admin := k.admin()
+
+	err := updateUser(admin, "u1")
+	if !isStatus(err, http.StatusForbidden) {
+		t.Fatalf("UpdateUser error = %v, want a 403 API error", err)
+	}
+	if issued, requests := k.counts(); issued != 1 || requests != 1 {
+		t.Errorf("issued %d tokens for %d requests, want 1 for 1", issued, requests)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	status := http.StatusConflict
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"errorMessage": "User exists with same username"})
+	})
+	admin := k.admin()
+	ctx := context.Background()
+
+	if _, err := admin.CreateUser(ctx, gocloak.User{Username: gocloak.StringP("alice")}); !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateUser error = %v, want ErrConflict", err)
+	}
+	if err := admin.UpdateUser(ctx, gocloak.User{ID: gocloak.StringP("u1"), Email: gocloak.StringP("taken@example.com")}); !errors.Is(err, ErrConflict) {
+		t.Errorf("UpdateUser error = %v, want ErrConflict", err)
+	}
+	if _, err := admin.CreateOrganization(ctx, Organization{Name: "acme"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateOrganization error = %v, want ErrConflict", err)
+	}
+	if err := admin.AddOrganizationMember(ctx, "o1", "u1"); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddOrganizationMember error = %v, want ErrConflict", err)
+	}
+
+	// Other errors are kept
+	status = http.StatusInternalServerError
+	if _, err := admin.CreateUser(ctx, gocloak.User{Username: gocloak.StringP("alice")}); errors.Is(err, ErrConflict) || !isStatus(err, http.StatusInternalServerError) {
+		t.Errorf("CreateUser error = %v, want a 500 API error", err)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/users") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Location", "http://"+r.Host+r.URL.Path+"/8d3c2a4e")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	id, err := k.admin().CreateUser(context.Background(), gocloak.User{Username: gocloak.StringP("alice")})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if id != "8d3c2a4e" {
+		t.Errorf("CreateUser returned %q, want 8d3c2a4e", id)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   map[string]string
+		want   string // message of the PasswordPolicyError, empty for none
+	}{
+		{"accepted", http.StatusNoContent, nil, ""},
+		{"description", http.StatusBadRequest, map[string]string{
+			"error":             "invalidPasswordMinLengthMessage",
+			"error_description": "Invalid password: minimum length 12.",
+		}, "Invalid password: minimum length 12."},
+		{"error message", http.StatusBadRequest, map[string]string{
+			"errorMessage": "Invalid password: must not be equal to the username.",
+		}, "Invalid password: must not be equal to the username."},
+		{"error only", http.StatusBadRequest, map[string]string{
+			"error": "invalidPasswordHistoryMessage",
+		}, "invalidPasswordHistoryMessage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Type      string `json:"type"`
+				Value     string `json:"value"`
+				Temporary bool   `json:"temporary"`
+			}
+			k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != "/admin/realms/"+testRealm+"/users/u1/reset-password" {
+					http.NotFound(w, r)
+					return
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.status)
+				if tt.body != nil {
+					json.NewEncoder(w).Encode(tt.body)
+				}
+			})
+
+			err := k.admin().SetPassword(context.Background(), "u1", "correct horse", true)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("SetPassword: %v", err)
+				}
+				if got.Type != "password" || got.Value != "correct horse" || !got.Temporary {
+					t.Errorf("Keycloak received %+v", got)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("SetPassword error = %v, want a PasswordPolicyError", err)
+			}
+			if policyErr.Message != tt.want {
+				t.Errorf("Message = %q, want %q", policyErr.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetPasswordOtherErrors(t *testing.T) {
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+	})
+
+	err := k.admin().SetPassword(context.Background(), "missing", "correct horse", false)
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) || !isStatus(err, http.StatusNotFound) {
+		t.Errorf("SetPassword error = %v, want a 404 API error", err)
+	}
+}
+
+func TestDeleteUserGone(t *testing.T) {
+	k := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+	})
+
+	if err := k.admin().DeleteUser(context.Background(), "gone"); err != nil {
+		t.Errorf("DeleteUser of a missing user: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/go-resty/resty/v2"
+)
+
+// Organization is the organization representation of the Keycloak admin
+// API, which gocloak does not cover
+type Organization struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// OrganizationsEnabled reports whether organizations are mirrored in the
+// Keycloak realm. KEYCLOAK_ORGANIZATIONS=false turns it off for realms
+// without the organizations feature.
+func OrganizationsEnabled() bool {
+	return os.Getenv("KEYCLOAK_ORGANIZATIONS") != "false"
+}
+
+// CreateOrganization creates the organization and returns its ID
+func (a *Admin) CreateOrganization(ctx context.Context, organization Organization) (string, error) {
+	var location string
+	err := a.do(ctx, func(token string) error {
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			SetBody(organization).
+			Post(a.adminURL("organizations"))
+		if err := checkResponse(resp, err); err != nil {
+			return err
+		}
+		// The ID is only returned in the Location header
+		location = resp.Header().Get("Location")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	id := location[strings.LastIndex(location, "/")+1:]
+	if id == "" {
+		return "", fmt.Errorf("keycloak: missing organization location")
+	}
+	return id, nil
+}
+
+func (a *Admin) UpdateOrganization(ctx context.Context, organization Organization) error {
+	return a.do(ctx, func(token string) error {
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			SetBody(organization).
+			Put(a.adminURL("organizations", organization.ID))
+		return checkResponse(resp, err)
+	})
+}
+
+// DeleteOrganization deletes the organization, an organization already gone
+// is not an error
+func (a *Admin) DeleteOrganization(ctx context.Context, id string) error {
+	return a.do(ctx, func(token string) error {
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			Delete(a.adminURL("organizations", id))
+		if err == nil && resp.StatusCode() == http.StatusNotFound {
+			return nil
+		}
+		return checkResponse(resp, err)
+	})
+}
+
+func (a *Admin) AddOrganizationMember(ctx context.Context, id, userID string) error {
+	// The body is the user ID as a JSON string
+	body, err := json.Marshal(userID)
+	if err != nil {
+		return err
+	}
+	return a.do(ctx, func(token string) error {
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			SetBody(body).
+			Post(a.adminURL("organizations", id, "members"))
+		return checkResponse(resp, err)
+	})
+}
+
+// RemoveOrganizationMember removes the user from the organization, a user
+// who is not a member is not an error
+func (a *Admin) RemoveOrganizationMember(ctx context.Context, id, userID string) error {
+	return a.do(ctx, func(token string) error {
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			Delete(a.adminURL("organizations", id, "members", userID))
+		if err == nil && resp.StatusCode() == http.StatusNotFound {
+			return nil
+		}
+		return checkResponse(resp, err)
+	})
+}
+
+// checkResponse turns the error responses of the raw admin API calls into
+// gocloak API errors, and conflicts into ErrConflict
+func checkResponse(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusConflict {
+		return ErrConflict
+	}
+	if resp.IsError() {
+		return &gocloak.APIError{
+			Code:    resp.StatusCode(),
+			Message: fmt.Sprintf("keycloak: %s: %s", resp.Status(), resp.String()),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package keycloak
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// UserSessions returns the active sessions of the user
+func (a *Admin) UserSessions(ctx context.Context, userID string) ([]*gocloak.UserSessionRepresentation, error) {
+	var sessions []*gocloak.UserSessionRepresentation
+	err := a.do(ctx, func(token string) error {
+		var err error
+		sessions, err = a.client.GetUserSessions(ctx, token, a.config.Realm, userID)
+		return err
+	})
+	return sessions, err
+}
+
+// DeleteSession ends the session, its refresh tokens stop working. A session
+// already gone is not an error.
+func (a *Admin) DeleteSession(ctx context.Context, sessionID string) error {
+	err := a.do(ctx, func(token string) error {
+		return a.client.LogoutUserSession(ctx, token, a.config.Realm, sessionID)
+	})
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// LogoutUser ends every session of the user
+func (a *Admin) LogoutUser(ctx context.Context, userID string) error {
+	return a.do(ctx, func(token string) error {
+		return a.client.LogoutAllSessions(ctx, token, a.config.Realm, userID)
+	})
+}
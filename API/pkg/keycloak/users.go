@@ -0,0 +1,95 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// ErrConflict is returned when Keycloak already has the user or organization
+// created, or the user is already a member
+var ErrConflict = errors.New("keycloak: conflict")
+
+// CreateUser creates the user and returns its ID
+func (a *Admin) CreateUser(ctx context.Context, user gocloak.User) (string, error) {
+	var id string
+	err := a.do(ctx, func(token string) error {
+		var err error
+		id, err = a.client.CreateUser(ctx, token, a.config.Realm, user)
+		return err
+	})
+	return id, conflict(err)
+}
+
+// PasswordPolicyError is returned when a password does not satisfy the
+// password policy of the realm, Message tells which rule
+type PasswordPolicyError struct {
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "keycloak: password policy: " + e.Message
+}
+
+// SetPassword sets the password of the user, a password rejected by the
+// realm's password policy returns a *PasswordPolicyError
+func (a *Admin) SetPassword(ctx context.Context, userID, password string, temporary bool) error {
+	return a.do(ctx, func(token string) error {
+		var body gocloak.HTTPErrorResponse
+		resp, err := a.client.GetRequestWithBearerAuth(ctx, token).
+			SetBody(gocloak.SetPasswordRequest{Type: gocloak.StringP("password"), Password: &password, Temporary: &temporary}).
+			SetError(&body).
+			Put(a.adminURL("users", userID, "reset-password"))
+		if err == nil && resp.StatusCode() == http.StatusBadRequest {
+			message := body.Description
+			if message == "" {
+				message = body.Message
+			}
+			if message == "" {
+				message = body.Error
+			}
+			return &PasswordPolicyError{Message: message}
+		}
+		return checkResponse(resp, err)
+	})
+}
+
+// User returns the user with the ID
+func (a *Admin) User(ctx context.Context, userID string) (*gocloak.User, error) {
+	var user *gocloak.User
+	err := a.do(ctx, func(token string) error {
+		var err error
+		user, err = a.client.GetUserByID(ctx, token, a.config.Realm, userID)
+		return err
+	})
+	return user, err
+}
+
+// UpdateUser updates the fields set on user, identified by its ID
+func (a *Admin) UpdateUser(ctx context.Context, user gocloak.User) error {
+	err := a.do(ctx, func(token string) error {
+		return a.client.UpdateUser(ctx, token, a.config.Realm, user)
+	})
+	return conflict(err)
+}
+
+// DeleteUser deletes the user, a user already gone is not an error
+func (a *Admin) DeleteUser(ctx context.Context, userID string) error {
+	err := a.do(ctx, func(token string) error {
+		return a.client.DeleteUser(ctx, token, a.config.Realm, userID)
+	})
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// conflict maps the 409 responses of Keycloak to ErrConflict
+func conflict(err error) error {
+	if isStatus(err, http.StatusConflict) {
+		return ErrConflict
+	}
+	return err
+}
@@ -2,18 +2,44 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/flotio-dev/api/pkg/buildlog"
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/flotio-dev/api/pkg/utils"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-func CreateBuildPod(buildID uint, project db.Project, platform string) error {
+// secretFilesMountPath is where the secret files of a project are mounted in
+// the build container before being copied into the repository
+const secretFilesMountPath = "/flotio/files"
+
+// Envs telling the build container where and how to upload its artifact.
+// The token is kept in the env secret like the project envs.
+const (
+	uploadURLEnv   = "FLOTIO_UPLOAD_URL"
+	uploadTokenEnv = "FLOTIO_UPLOAD_TOKEN"
+)
+
+// uploadURL is the API endpoint receiving the artifact of the build, it has
+// to be reachable from the build pods (API_URL)
+func uploadURL(buildID uint) string {
+	return fmt.Sprintf("%s/builds/%d/artifact", utils.APIURL(), buildID)
+}
+
+// CreateBuildPod starts the build pod. uploadToken authorizes the pod to
+// upload its artifact to the API.
+func CreateBuildPod(buildID uint, project db.Project, environment db.Environment, platform, uploadToken string) error {
 	config, err := getKubernetesConfig()
 	if err != nil {
 		return err
@@ -28,37 +54,63 @@ func CreateBuildPod(buildID uint, project db.Project, platform string) error {
 	podName := fmt.Sprintf("build-%d", buildID)
 	namespace := "default" // or get from env
 
-	// Commands to run in the container
-	var commands []string
-	if project.BuildFolder != "" {
-		commands = []string{
-			"sh", "-c",
-			fmt.Sprintf(`
-				git clone %s /tmp/repo &&
-				cd /tmp/repo/%s &&
-				flutter pub get &&
-				flutter build %s
-			`, project.GitRepo, project.BuildFolder, getBuildTarget(platform)),
-		}
-	} else {
-		commands = []string{
-			"sh", "-c",
-			fmt.Sprintf(`
-				git clone %s /tmp/repo &&
-				cd /tmp/repo &&
-				flutter pub get &&
-				flutter build %s
-			`, project.GitRepo, getBuildTarget(platform)),
+	// Project envs and files are decrypted only here, when the pod is created
+	values, err := secrets.ProjectEnvironment(project.ID, environment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load project envs: %v", err)
+	}
+	if values == nil {
+		values = map[string]string{}
+	}
+	values[uploadTokenEnv] = uploadToken
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Values stay in a secret owned by the pod, the pod spec only references
+	// them, so they are not readable from the pod object
+	envSecretName := fmt.Sprintf("build-%d-env", buildID)
+	env := make([]v1.EnvVar, 0, len(names))
+	envData := make(map[string][]byte, len(names))
+	for i, name := range names {
+		envData[secretEnvKey(i)] = []byte(values[name])
+		env = append(env, v1.EnvVar{
+			Name: name,
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: envSecretName},
+					Key:                  secretEnvKey(i),
+				},
+			},
+		})
+	}
+
+	files, err := secrets.ProjectFiles(project.ID, environment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load project files: %v", err)
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if !secrets.ValidFilePath(path) {
+			return fmt.Errorf("invalid secret file path %q", path)
 		}
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
+
+	// Commands to run in the container
+	commands := []string{"sh", "-c", buildScript(project, platform, paths)}
 
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: podName,
 			Labels: map[string]string{
-				"app":        "flotio-build",
-				"build-id":   strconv.Itoa(int(buildID)),
-				"project-id": strconv.Itoa(int(project.ID)),
+				"app":         "flotio-build",
+				"build-id":    strconv.Itoa(int(buildID)),
+				"project-id":  strconv.Itoa(int(project.ID)),
+				"environment": environment.Name,
 			},
 		},
 		Spec: v1.PodSpec{
@@ -68,21 +120,82 @@ func CreateBuildPod(buildID uint, project db.Project, platform string) error {
 					Name:    "build",
 					Image:   getFlutterImage(project.FlutterVersion),
 					Command: commands,
+					Env:     append(env, v1.EnvVar{Name: uploadURLEnv, Value: uploadURL(buildID)}),
 					// Add volume mounts if needed for artifacts
 				},
 			},
 		},
 	}
 
+	secretName := fmt.Sprintf("build-%d-files", buildID)
+	if len(paths) > 0 {
+		// The container waits for the secret volume, which is created once
+		// the pod exists so that it is garbage collected with the pod
+		pod.Spec.Volumes = []v1.Volume{{
+			Name: "files",
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{SecretName: secretName},
+			},
+		}}
+		pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{{
+			Name:      "files",
+			MountPath: secretFilesMountPath,
+			ReadOnly:  true,
+		}}
+	}
+
 	// Create the pod
-	_, err = clientset.CoreV1().Pods(namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	created, err := clientset.CoreV1().Pods(namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to create pod: %v", err)
 	}
 
+	// Like the files volume, the container waits for the env secret
+	if len(envData) > 0 {
+		if err := createPodSecret(clientset, namespace, created, envSecretName, buildID, envData); err != nil {
+			clientset.CoreV1().Pods(namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
+			return fmt.Errorf("failed to create env secret: %v", err)
+		}
+	}
+
+	if len(paths) > 0 {
+		data := make(map[string][]byte, len(paths))
+		for i, path := range paths {
+			data[secretFileKey(i)] = files[path]
+		}
+		if err := createPodSecret(clientset, namespace, created, secretName, buildID, data); err != nil {
+			clientset.CoreV1().Pods(namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
+			return fmt.Errorf("failed to create files secret: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// createPodSecret creates a secret owned by the build pod, so that it is
+// garbage collected with it
+func createPodSecret(clientset *kubernetes.Clientset, namespace string, owner *v1.Pod, name string, buildID uint, data map[string][]byte) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app":      "flotio-build",
+				"build-id": strconv.Itoa(int(buildID)),
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       owner.Name,
+				UID:        owner.UID,
+			}},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	return err
+}
+
 func GetPodLogs(buildID uint) ([]string, error) {
 	config, err := getKubernetesConfig()
 	if err != nil {
@@ -119,7 +232,11 @@ func GetPodLogs(buildID uint) ([]string, error) {
 	return logs, nil
 }
 
+// StreamPodLogs sends the output of the build pod to logChan from the
+// start, following it until the pod exits. logChan is closed on return.
 func StreamPodLogs(buildID uint, logChan chan<- string) error {
+	defer close(logChan)
+
 	config, err := getKubernetesConfig()
 	if err != nil {
 		return err
@@ -149,7 +266,6 @@ func StreamPodLogs(buildID uint, logChan chan<- string) error {
 			logChan <- string(buf[:n])
 		}
 		if err != nil {
-			close(logChan)
 			break
 		}
 	}
@@ -157,6 +273,55 @@ func StreamPodLogs(buildID uint, logChan chan<- string) error {
 	return nil
 }
 
+// DeleteBuildPod deletes the pod of a build, with its env and files secrets.
+// A pod that is already gone is not an error.
+func DeleteBuildPod(buildID uint) error {
+	config, err := getKubernetesConfig()
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create clientset: %v", err)
+	}
+
+	podName := fmt.Sprintf("build-%d", buildID)
+	namespace := "default"
+	err = clientset.CoreV1().Pods(namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod: %v", err)
+	}
+	return nil
+}
+
+// DeleteProjectPods deletes the build pods of a project, with their env and
+// files secrets
+func DeleteProjectPods(projectID uint) error {
+	config, err := getKubernetesConfig()
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create clientset: %v", err)
+	}
+
+	namespace := "default"
+	err = clientset.CoreV1().Pods(namespace).DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=flotio-build,project-id=%d", projectID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete pods: %v", err)
+	}
+	return nil
+}
+
+// ErrNotConfigured is returned when the API runs neither in a cluster nor
+// with KUBECTL_API and KUBECTL_TOKEN
+var ErrNotConfigured = errors.New("kubernetes is not configured")
+
 func getKubernetesConfig() (*rest.Config, error) {
 	// Try in-cluster config first
 	config, err := rest.InClusterConfig()
@@ -165,7 +330,7 @@ func getKubernetesConfig() (*rest.Config, error) {
 		apiURL := os.Getenv("KUBECTL_API")
 		token := os.Getenv("KUBECTL_TOKEN")
 		if apiURL == "" || token == "" {
-			return nil, fmt.Errorf("failed to get in-cluster config and no external config provided: %v", err)
+			return nil, fmt.Errorf("%w: no in-cluster config (%v) and no external config provided", ErrNotConfigured, err)
 		}
 
 		config = &rest.Config{
@@ -179,6 +344,91 @@ func getKubernetesConfig() (*rest.Config, error) {
 	return config, nil
 }
 
+// buildScript returns the shell script run by the build container. Each phase
+// is wrapped in step markers so the API can split the log into BuildSteps.
+// The secret files at paths are placed in the repository right after the
+// clone, before the dependencies are fetched.
+func buildScript(project db.Project, platform string, paths []string) string {
+	workdir := "/tmp/repo"
+	if project.BuildFolder != "" {
+		workdir = fmt.Sprintf("/tmp/repo/%s", project.BuildFolder)
+	}
+
+	placeFiles := ""
+	if len(paths) > 0 {
+		placeFiles = "step files place_files &&"
+	}
+
+	// Static analysis is opt-in, errors it reports fail the build
+	analyze := ""
+	if project.Analyze {
+		analyze = "step analyze flutter analyze --no-fatal-infos --no-fatal-warnings &&"
+	}
+
+	return fmt.Sprintf(`
+		step() {
+			name=$1
+			shift
+			echo "%s$name%s$(date +%%s)"
+			"$@"
+			rc=$?
+			echo "%s$name%s$rc%s$(date +%%s)"
+			return $rc
+		}
+		%s
+		%s
+		step clone git clone %s /tmp/repo &&
+		%s
+		cd %s &&
+		step pub-get flutter pub get &&
+		%s
+		step build flutter build %s &&
+		step upload upload_artifact
+	`, buildlog.StepStartMarker, buildlog.StepMarkerSeparator,
+		buildlog.StepEndMarker, buildlog.StepMarkerSeparator, buildlog.StepMarkerSeparator,
+		placeFilesFunction(paths), uploadFunction(platform), project.GitRepo, placeFiles, workdir,
+		analyze, getBuildTarget(platform))
+}
+
+// uploadFunction returns the upload_artifact shell function sending the
+// build output to the API. Directories such as the iOS app bundle are
+// uploaded as a tarball.
+func uploadFunction(platform string) string {
+	return fmt.Sprintf(`upload_artifact() {
+			artifact=%s
+			if [ -d "$artifact" ]; then
+				tar -czf /tmp/artifact.tar.gz -C "$(dirname "$artifact")" "$(basename "$artifact")" || return 1
+				artifact=/tmp/artifact.tar.gz
+			fi
+			curl -fsS -X PUT -H "Authorization: Bearer $%s" --data-binary @"$artifact" "$%s"
+		}`, getArtifactPath(platform), uploadTokenEnv, uploadURLEnv)
+}
+
+// placeFilesFunction returns the place_files shell function copying the
+// mounted secret files to their path in the repository
+func placeFilesFunction(paths []string) string {
+	var b strings.Builder
+	b.WriteString("place_files() {\n")
+	for i, path := range paths {
+		fmt.Fprintf(&b, "\t\t\tmkdir -p \"$(dirname /tmp/repo/%s)\" && cp %s/%s /tmp/repo/%s || return 1\n",
+			path, secretFilesMountPath, secretFileKey(i), path)
+	}
+	b.WriteString("\t\t\t:\n\t\t}")
+	return b.String()
+}
+
+// secretEnvKey names the i-th env in the env secret; env names are not all
+// valid secret keys
+func secretEnvKey(i int) string {
+	return fmt.Sprintf("env-%d", i)
+}
+
+// secretFileKey names the i-th secret file in the files secret; paths cannot
+// be used as secret keys
+func secretFileKey(i int) string {
+	return fmt.Sprintf("file-%d", i)
+}
+
 func getFlutterImage(version string) string {
 	if version == "" {
 		return "flutter:latest"
@@ -196,3 +446,24 @@ func getBuildTarget(platform string) string {
 		return "apk"
 	}
 }
+
+// getArtifactPath is where flutter build writes the output of the platform,
+// relative to the build folder
+func getArtifactPath(platform string) string {
+	switch platform {
+	case "ios":
+		return "build/ios/iphoneos/Runner.app"
+	default:
+		return "build/app/outputs/flutter-apk/app-release.apk"
+	}
+}
+
+// ArtifactFilename names the uploaded output of a build
+func ArtifactFilename(buildID uint, platform string) string {
+	switch platform {
+	case "ios":
+		return fmt.Sprintf("app-%d.tar.gz", buildID)
+	default:
+		return fmt.Sprintf("app-%d.apk", buildID)
+	}
+}
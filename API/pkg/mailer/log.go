@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LogMailer is the development mailer: messages are logged, or written as
+// .eml files to Dir when set
+type LogMailer struct {
+	From string
+	Dir  string
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if m.Dir == "" {
+		log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(m.Dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	if err := os.WriteFile(path, body, 0o644); err != nil {
+		return err
+	}
+	log.Printf("Email to %s written to %s", msg.To, path)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Package mailer sends the emails of the API, such as organization
+// invitations.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Default is the mailer used by the API, set up by InitMailer
+var Default Mailer
+
+func InitMailer() {
+	m, err := NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	Default = m
+
+	log.Printf("Mailer configured (%T)", m)
+}
+
+// NewFromEnv builds the Mailer selected by MAILER:
+//   - "log" (default) logs the messages, or writes them to MAILER_DIR
+//   - "smtp" sends them through SMTP_HOST:SMTP_PORT, authenticated with
+//     SMTP_USERNAME and SMTP_PASSWORD when set
+//   - "memory" keeps them in memory
+//
+// Messages are sent from MAIL_FROM.
+func NewFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Flotio <no-reply@flotio.local>"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "", "log":
+		return &LogMailer{From: from, Dir: os.Getenv("MAILER_DIR")}, nil
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+		if m.Host == "" {
+			return nil, fmt.Errorf("SMTP_HOST must be set")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		return m, nil
+	case "memory":
+		return &Memory{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", os.Getenv("MAILER"))
+	}
+}
+
+// format renders msg as an RFC 5322 message
+func format(from string, msg Message) ([]byte, error) {
+	for _, value := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid header value %q", value)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Text, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
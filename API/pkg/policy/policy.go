@@ -0,0 +1,133 @@
+// Package policy decides what a user may do on projects and organizations.
+//
+// Users hold a role on an organization through their membership, and on a
+// project as the owner of their personal projects or through the
+// organization owning it.
+// Every action requires a minimum role, see the permissions table.
+package policy
+
+// Role of a user on a project or an organization
+type Role string
+
+const (
+	// RoleViewer reads projects, builds and non-secret envs
+	RoleViewer Role = "viewer"
+	// RoleDeveloper also runs builds and edits envs and secret files
+	RoleDeveloper Role = "developer"
+	// RoleAdmin also configures projects, environments and members
+	RoleAdmin Role = "admin"
+	// RoleOwner can do anything, including deleting
+	RoleOwner Role = "owner"
+)
+
+// Roles lists the roles from the least to the most privileged
+var Roles = []Role{RoleViewer, RoleDeveloper, RoleAdmin, RoleOwner}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// AtLeast reports whether r grants every permission of other
+func (r Role) AtLeast(other Role) bool {
+	return r.Valid() && r.rank() >= other.rank()
+}
+
+// Max returns the most privileged of two roles, either may be empty
+func Max(a, b Role) Role {
+	if b.rank() > a.rank() {
+		return b
+	}
+	return a
+}
+
+// Action is an operation checked by the policy
+type Action string
+
+const (
+	ProjectRead   Action = "project:read"
+	ProjectUpdate Action = "project:update"
+	ProjectDelete Action = "project:delete"
+	// ProjectTransfer moves a project out of its current owner
+	ProjectTransfer Action = "project:transfer"
+
+	EnvironmentWrite Action = "environment:write"
+
+	BuildRead   Action = "build:read"
+	BuildCreate Action = "build:create"
+	BuildCancel Action = "build:cancel"
+
+	EnvRead    Action = "env:read"
+	EnvWrite   Action = "env:write"
+	EnvRestore Action = "env:restore"
+
+	FileRead  Action = "file:read"
+	FileWrite Action = "file:write"
+
+	OrganizationRead    Action = "organization:read"
+	OrganizationUpdate  Action = "organization:update"
+	OrganizationDelete  Action = "organization:delete"
+	OrganizationMembers Action = "organization:members"
+	// OrganizationProjectCreate creates a project in the organization
+	OrganizationProjectCreate Action = "organization:project_create"
+	// OrganizationProjectReceive transfers a project into the organization
+	OrganizationProjectReceive Action = "organization:project_receive"
+
+	OrganizationEnvRead  Action = "organization_env:read"
+	OrganizationEnvWrite Action = "organization_env:write"
+)
+
+// permissions is the minimum role of each action. Secret values are never
+// returned by the API, reading envs only shows plain values and previews.
+var permissions = map[Action]Role{
+	ProjectRead:     RoleViewer,
+	ProjectUpdate:   RoleAdmin,
+	ProjectDelete:   RoleOwner,
+	ProjectTransfer: RoleOwner,
+
+	EnvironmentWrite: RoleAdmin,
+
+	BuildRead:   RoleViewer,
+	BuildCreate: RoleDeveloper,
+	BuildCancel: RoleDeveloper,
+
+	EnvRead:    RoleViewer,
+	EnvWrite:   RoleDeveloper,
+	EnvRestore: RoleAdmin,
+
+	FileRead:  RoleViewer,
+	FileWrite: RoleDeveloper,
+
+	OrganizationRead:    RoleViewer,
+	OrganizationUpdate:  RoleAdmin,
+	OrganizationDelete:  RoleOwner,
+	OrganizationMembers: RoleAdmin,
+
+	OrganizationProjectCreate:  RoleDeveloper,
+	OrganizationProjectReceive: RoleAdmin,
+
+	OrganizationEnvRead:  RoleViewer,
+	OrganizationEnvWrite: RoleAdmin,
+}
+
+// Allows reports whether role may perform action. Unknown actions are denied.
+func Allows(role Role, action Action) bool {
+	min, ok := permissions[action]
+	return ok && role.AtLeast(min)
+}
+
+// CanManage reports whether a member with role actor may grant role to
+// someone, or change or remove a member holding it. Admins manage members up
+// to admins, only owners manage owners.
+func CanManage(actor, role Role) bool {
+	return Allows(actor, OrganizationMembers) && actor.AtLeast(role)
+}
@@ -0,0 +1,226 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// minRoles is the expected minimum role of every action, kept apart from
+// the permissions table so a change to it shows up here
+var minRoles = map[Action]Role{
+	ProjectRead:                RoleViewer,
+	ProjectUpdate:              RoleAdmin,
+	ProjectDelete:              RoleOwner,
+	ProjectTransfer:            RoleOwner,
+	EnvironmentWrite:           RoleAdmin,
+	BuildRead:                  RoleViewer,
+	BuildCreate:                RoleDeveloper,
+	BuildCancel:                RoleDeveloper,
+	EnvRead:                    RoleViewer,
+	EnvWrite:                   RoleDeveloper,
+	EnvRestore:                 RoleAdmin,
+	FileRead:                   RoleViewer,
+	FileWrite:                  RoleDeveloper,
+	OrganizationRead:           RoleViewer,
+	OrganizationUpdate:         RoleAdmin,
+	OrganizationDelete:         RoleOwner,
+	OrganizationMembers:        RoleAdmin,
+	OrganizationProjectCreate:  RoleDeveloper,
+	OrganizationProjectReceive: RoleAdmin,
+	OrganizationEnvRead:        RoleViewer,
+	OrganizationEnvWrite:       RoleAdmin,
+}
+
+// rankOf is the position of a role in Roles, 0 for no role
+func rankOf(role Role) int {
+	for i, r := range Roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func TestPermissionsCoverEveryAction(t *testing.T) {
+	if len(permissions) != len(minRoles) {
+		t.Errorf("permissions has %d actions, the test table %d", len(permissions), len(minRoles))
+	}
+	for action, want := range minRoles {
+		if got, ok := permissions[action]; !ok || got != want {
+			t.Errorf("permissions[%s] = %q, want %q", action, got, want)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	roles := append([]Role{"", "guest"}, Roles...)
+	for _, role := range roles {
+		for action, min := range minRoles {
+			want := rankOf(role) > 0 && rankOf(role) >= rankOf(min)
+			if got := Allows(role, action); got != want {
+				t.Errorf("Allows(%q, %s) = %v, want %v", role, action, got, want)
+			}
+		}
+		if Allows(role, "project:unknown") {
+			t.Errorf("Allows(%q, unknown action) = true", role)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for action, min := range minRoles {
+		for _, role := range []Role{"", "guest"} {
+			if err := check(role, action); !errors.Is(err, ErrNotFound) {
+				t.Errorf("check(%q, %s) = %v, want ErrNotFound", role, action, err)
+			}
+		}
+		for _, role := range Roles {
+			var want error
+			if rankOf(role) < rankOf(min) {
+				want = ErrForbidden
+			}
+			if err := check(role, action); err != want {
+				t.Errorf("check(%q, %s) = %v, want %v", role, action, err, want)
+			}
+		}
+	}
+}
+
+func TestCanManage(t *testing.T) {
+	tests := []struct {
+		actor Role
+		can   []Role
+	}{
+		{"", nil},
+		{RoleViewer, nil},
+		{RoleDeveloper, nil},
+		{RoleAdmin, []Role{RoleViewer, RoleDeveloper, RoleAdmin}},
+		{RoleOwner, []Role{RoleViewer, RoleDeveloper, RoleAdmin, RoleOwner}},
+	}
+	for _, tt := range tests {
+		can := map[Role]bool{}
+		for _, role := range tt.can {
+			can[role] = true
+		}
+		for _, role := range Roles {
+			if got := CanManage(tt.actor, role); got != can[role] {
+				t.Errorf("CanManage(%q, %q) = %v, want %v", tt.actor, role, got, can[role])
+			}
+		}
+	}
+}
+
+func TestProjectRole(t *testing.T) {
+	const owner, member, stranger uint = 1, 2, 3
+	organizationID := uint(10)
+	tx := openMembers(t, map[[2]int64]string{
+		{int64(organizationID), int64(member)}: string(RoleDeveloper),
+		{int64(organizationID), int64(owner)}:  string(RoleViewer),
+	})
+
+	ownerID := owner
+	personal := db.Project{UserID: &ownerID}
+	organization := db.Project{UserID: &ownerID, OrganizationID: &organizationID}
+
+	tests := []struct {
+		name    string
+		project db.Project
+		userID  uint
+		want    Role
+	}{
+		{"personal owner", personal, owner, RoleOwner},
+		{"personal other user", personal, member, ""},
+		{"personal no user", personal, 0, ""},
+		{"personal without owner", db.Project{}, 0, ""},
+		{"organization member", organization, member, RoleDeveloper},
+		// The creator of an organization project only holds their membership
+		{"organization creator", organization, owner, RoleViewer},
+		{"organization stranger", organization, stranger, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProjectRole(tx, tt.userID, tt.project)
+			if err != nil {
+				t.Fatalf("ProjectRole: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ProjectRole = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// openMembers opens a database answering the membership lookups of
+// OrganizationRole from members, keyed by organization and user ID
+func openMembers(t *testing.T, members map[[2]int64]string) *gorm.DB {
+	t.Helper()
+	conn := sql.OpenDB(membersConnector{members})
+	t.Cleanup(func() { conn.Close() })
+	tx, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	return tx
+}
+
+// membersConnector is a database/sql driver serving the role column of the
+// organization_members query, the only one OrganizationRole runs
+type membersConnector struct {
+	members map[[2]int64]string
+}
+
+func (c membersConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return membersConn(c), nil
+}
+func (c membersConnector) Driver() driver.Driver { return nil }
+
+type membersConn membersConnector
+
+func (c membersConn) Prepare(query string) (driver.Stmt, error) { return membersStmt(c), nil }
+func (c membersConn) Close() error                              { return nil }
+func (c membersConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type membersStmt membersConn
+
+func (s membersStmt) Close() error  { return nil }
+func (s membersStmt) NumInput() int { return -1 }
+func (s membersStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s membersStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &membersRows{}
+	if len(args) >= 2 {
+		organizationID, _ := args[0].(int64)
+		userID, _ := args[1].(int64)
+		if role, ok := s.members[[2]int64{organizationID, userID}]; ok {
+			rows.roles = []string{role}
+		}
+	}
+	return rows, nil
+}
+
+type membersRows struct {
+	roles []string
+}
+
+func (r *membersRows) Columns() []string { return []string{"role"} }
+func (r *membersRows) Close() error      { return nil }
+func (r *membersRows) Next(dest []driver.Value) error {
+	if len(r.roles) == 0 {
+		return io.EOF
+	}
+	dest[0], r.roles = r.roles[0], r.roles[1:]
+	return nil
+}
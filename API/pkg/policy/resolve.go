@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"errors"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotFound is returned when the resource does not exist or the user
+	// holds no role on it, so its existence is not disclosed
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the user's role does not allow the action
+	ErrForbidden = errors.New("forbidden")
+)
+
+// OrganizationRole returns the role of a user in an organization, empty when
+// they are not a member
+func OrganizationRole(tx *gorm.DB, userID, organizationID uint) (Role, error) {
+	var member db.OrganizationMember
+	err := tx.Where("organization_id = ? AND user_id = ?", organizationID, userID).Limit(1).Find(&member).Error
+	if err != nil {
+		return "", err
+	}
+	return Role(member.Role), nil
+}
+
+// ProjectRole returns the role of a user on a project: owner of their
+// personal projects, their organization role on the projects of an
+// organization. Empty when they hold none.
+func ProjectRole(tx *gorm.DB, userID uint, project db.Project) (Role, error) {
+	if project.OrganizationID != nil {
+		return OrganizationRole(tx, userID, *project.OrganizationID)
+	}
+	if userID != 0 && project.UserID != nil && *project.UserID == userID {
+		return RoleOwner, nil
+	}
+	return "", nil
+}
+
+// Project loads a project and checks that the user may perform action on it
+func Project(tx *gorm.DB, userID, projectID uint, action Action) (db.Project, error) {
+	var project db.Project
+	if err := tx.First(&project, projectID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return project, ErrNotFound
+		}
+		return project, err
+	}
+	role, err := ProjectRole(tx, userID, project)
+	if err != nil {
+		return project, err
+	}
+	return project, check(role, action)
+}
+
+// Organization loads an organization and checks that the user may perform
+// action on it
+func Organization(tx *gorm.DB, userID, organizationID uint, action Action) (db.Organization, error) {
+	var organization db.Organization
+	if err := tx.First(&organization, organizationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return organization, ErrNotFound
+		}
+		return organization, err
+	}
+	role, err := OrganizationRole(tx, userID, organization.ID)
+	if err != nil {
+		return organization, err
+	}
+	return organization, check(role, action)
+}
+
+func check(role Role, action Action) error {
+	if !role.Valid() {
+		return ErrNotFound
+	}
+	if !Allows(role, action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// VisibleProjects is a scope keeping the projects a user holds a role on
+func VisibleProjects(userID uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("(projects.organization_id IS NULL AND projects.user_id = ?) OR projects.organization_id IN (?)", userID,
+			tx.Session(&gorm.Session{NewDB: true}).Model(&db.OrganizationMember{}).Select("organization_id").Where("user_id = ?", userID))
+	}
+}
+
+// MemberOrganizations returns the IDs of the organizations a user is a
+// member of
+func MemberOrganizations(tx *gorm.DB, userID uint) ([]uint, error) {
+	ids := []uint{}
+	err := tx.Model(&db.OrganizationMember{}).Where("user_id = ?", userID).Pluck("organization_id", &ids).Error
+	return ids, err
+}
@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/db/dbtest"
+	"gorm.io/gorm"
+)
+
+func useKeyring(t *testing.T) {
+	t.Helper()
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	t.Setenv("ENV_KEYRING_FILE", "")
+	t.Setenv("ENV_ENCRYPTION_KEYS", "test:"+key)
+	t.Setenv("ENV_ENCRYPTION_PRIMARY_KEY", "")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	previous := KEKs
+	KEKs = keyring
+	t.Cleanup(func() { KEKs = previous })
+}
+
+// createPlaintextEnv stores an env the way it was stored before encryption
+func createPlaintextEnv(t *testing.T, tx *gorm.DB, value string) db.Env {
+	t.Helper()
+	project := db.Project{Name: fmt.Sprintf("secrets-test-%d", time.Now().UnixNano())}
+	if err := tx.Create(&project).Error; err != nil {
+		t.Fatalf("Create project: %v", err)
+	}
+	env := db.Env{ProjectID: project.ID, Key: "API_KEY", Value: value}
+	if err := tx.Create(&env).Error; err != nil {
+		t.Fatalf("Create env: %v", err)
+	}
+	return env
+}
+
+func TestEncryptStoredEnvs(t *testing.T) {
+	tx := dbtest.Open(t)
+	useKeyring(t)
+
+	env := createPlaintextEnv(t, tx, "legacy-secret")
+	deleted := createPlaintextEnv(t, tx, "deleted-secret")
+	if err := tx.Delete(&deleted).Error; err != nil {
+		t.Fatalf("Delete env: %v", err)
+	}
+
+	// A revision recorded while the env was still in plaintext
+	revision := db.EnvRevision{ProjectID: env.ProjectID, Number: 1, Source: "baseline", Changes: []db.EnvChange{
+		{EnvID: env.ID, Key: env.Key, Action: "created", Value: env.Value},
+	}}
+	if err := tx.Create(&revision).Error; err != nil {
+		t.Fatalf("Create revision: %v", err)
+	}
+
+	if err := EncryptStoredEnvs(tx); err != nil {
+		t.Fatalf("EncryptStoredEnvs: %v", err)
+	}
+
+	for want, id := range map[string]uint{"legacy-secret": env.ID, "deleted-secret": deleted.ID} {
+		var stored db.Env
+		if err := tx.Unscoped().First(&stored, id).Error; err != nil {
+			t.Fatalf("First: %v", err)
+		}
+		if stored.DataKeyID == 0 || stored.Value == want {
+			t.Errorf("env %d is still stored in plaintext", id)
+		}
+		value, err := DecryptEnv(tx, stored)
+		if err != nil {
+			t.Fatalf("DecryptEnv: %v", err)
+		}
+		if value != want {
+			t.Errorf("env %d decrypts to %q, want %q", id, value, want)
+		}
+	}
+
+	var change db.EnvChange
+	if err := tx.First(&change, revision.Changes[0].ID).Error; err != nil {
+		t.Fatalf("First: %v", err)
+	}
+	value, err := DecryptValue(tx, env.ProjectID, change.DataKeyID, change.Value)
+	if err != nil {
+		t.Fatalf("DecryptValue: %v", err)
+	}
+	if change.DataKeyID == 0 || value != "legacy-secret" {
+		t.Errorf("env change decrypts to %q with data key %d, want an encrypted legacy-secret", value, change.DataKeyID)
+	}
+}
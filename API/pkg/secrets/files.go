@@ -0,0 +1,81 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+)
+
+// filePathRegexp restricts secret file paths to characters that are safe to
+// use unquoted in the build script
+var filePathRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// ValidFilePath reports whether path can be used as the target of a secret
+// file: relative to the repository root, without . or .. segments and
+// outside of the .git directory
+func ValidFilePath(path string) bool {
+	if !filePathRegexp.MatchString(path) {
+		return false
+	}
+	for i, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." || (i == 0 && segment == ".git") {
+			return false
+		}
+	}
+	return true
+}
+
+// EncryptFile sets file.Content to content encrypted with the active data
+// key of the file's project. The file is not saved.
+func EncryptFile(tx *gorm.DB, file *db.SecretFile, content []byte) error {
+	dataKey, key, err := activeDataKey(tx, file.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := seal(key, content, fileAAD(file.ProjectID))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt file: %v", err)
+	}
+
+	file.Content = base64.StdEncoding.EncodeToString(ciphertext)
+	file.DataKeyID = dataKey.ID
+	file.Size = len(content)
+	return nil
+}
+
+// ProjectFiles returns the decrypted secret files of a project written in the
+// given environment, by path. Like ProjectEnvironment it is only meant for
+// build pods.
+func ProjectFiles(projectID, environmentID uint) (map[string][]byte, error) {
+	var files []db.SecretFile
+	if err := db.DB.Preload("Environments").Scopes(db.SecretFilesInEnvironment(environmentID)).
+		Where("project_id = ?", projectID).Order("id ASC").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch secret files: %v", err)
+	}
+
+	d := newDecrypter(db.DB)
+	contents := make(map[string][]byte, len(files))
+	for _, file := range db.EffectiveSecretFiles(files) {
+		content, err := d.decryptFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %v", file.Path, err)
+		}
+		contents[file.Path] = content
+	}
+	return contents, nil
+}
+
+// fileAAD binds a file ciphertext to its project, and keeps it from being
+// swapped with an env value
+func fileAAD(projectID uint) []byte {
+	return []byte(fmt.Sprintf("project:%d:file", projectID))
+}
+
+func (d *decrypter) decryptFile(file db.SecretFile) ([]byte, error) {
+	return d.open(file.DataKeyID, file.Content, fileAAD(file.ProjectID))
+}
@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+)
+
+// GitHub OAuth tokens are sealed with the primary KEK directly: they belong
+// to a user rather than a project, and are read one user at a time.
+
+// EncryptGithubTokens sets the GitHub tokens of user encrypted with the
+// primary KEK, empty tokens stay empty. The user is not saved.
+func EncryptGithubTokens(user *db.User, accessToken, refreshToken string) error {
+	access, err := sealGithubToken(user.ID, accessToken)
+	if err != nil {
+		return err
+	}
+	refresh, err := sealGithubToken(user.ID, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	user.GithubAccessToken = access
+	user.GithubRefreshToken = refresh
+	user.GithubTokenKEKID = KEKs.Primary()
+	return nil
+}
+
+// GithubTokens returns the decrypted GitHub tokens of user
+func GithubTokens(user db.User) (accessToken, refreshToken string, err error) {
+	// Tokens stored before encryption
+	if user.GithubTokenKEKID == "" {
+		return user.GithubAccessToken, user.GithubRefreshToken, nil
+	}
+
+	if accessToken, err = openGithubToken(user, user.GithubAccessToken); err != nil {
+		return "", "", fmt.Errorf("failed to decrypt GitHub access token: %v", err)
+	}
+	if refreshToken, err = openGithubToken(user, user.GithubRefreshToken); err != nil {
+		return "", "", fmt.Errorf("failed to decrypt GitHub refresh token: %v", err)
+	}
+	return accessToken, refreshToken, nil
+}
+
+// EncryptStoredGithubTokens re-encrypts with the primary KEK the GitHub
+// tokens encrypted with another key or stored before encryption, and returns
+// how many users were updated
+func EncryptStoredGithubTokens(tx *gorm.DB) (int, error) {
+	var users []db.User
+	err := tx.Unscoped().Where("(github_access_token <> '' OR github_refresh_token <> '') AND github_token_kek_id <> ?", KEKs.Primary()).
+		Find(&users).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch users: %v", err)
+	}
+
+	for i := range users {
+		accessToken, refreshToken, err := GithubTokens(users[i])
+		if err != nil {
+			return i, fmt.Errorf("user %d: %v", users[i].ID, err)
+		}
+		if err := EncryptGithubTokens(&users[i], accessToken, refreshToken); err != nil {
+			return i, fmt.Errorf("user %d: %v", users[i].ID, err)
+		}
+		err = tx.Unscoped().Model(&users[i]).Select("github_access_token", "github_refresh_token", "github_token_kek_id").
+			UpdateColumns(&users[i]).Error
+		if err != nil {
+			return i, fmt.Errorf("user %d: failed to save GitHub tokens: %v", users[i].ID, err)
+		}
+	}
+	return len(users), nil
+}
+
+// githubTokenAAD binds a ciphertext to its user so it cannot be copied to
+// another user
+func githubTokenAAD(userID uint) []byte {
+	return []byte(fmt.Sprintf("user:%d:github", userID))
+}
+
+func sealGithubToken(userID uint, token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	ciphertext, err := seal(KEKs.keys[KEKs.primary], []byte(token), githubTokenAAD(userID))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt GitHub token: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func openGithubToken(user db.User, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	kek, ok := KEKs.keys[user.GithubTokenKEKID]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", user.GithubTokenKEKID)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext: %v", err)
+	}
+	plaintext, err := open(kek, ciphertext, githubTokenAAD(user.ID))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
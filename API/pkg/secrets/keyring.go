@@ -0,0 +1,163 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Keyring holds the key-encryption keys (KEKs) used to wrap the per-project
+// data keys. New data keys are always wrapped with the primary key, older
+// keys are kept so existing data keys can still be unwrapped until they are
+// rotated.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// KEKs is the keyring used by the API, set up by InitKeyring
+var KEKs *Keyring
+
+func InitKeyring() {
+	keyring, err := LoadKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load encryption keyring: %v", err)
+	}
+	KEKs = keyring
+
+	log.Printf("Encryption keyring loaded (primary key %q)", keyring.primary)
+}
+
+// LoadKeyring reads the keyring from ENV_KEYRING_FILE, a JSON file
+//
+//	{"primary": "2025-10", "keys": {"2025-10": "<base64>", "2025-01": "<base64>"}}
+//
+// or from ENV_ENCRYPTION_KEYS ("id:<base64>,id:<base64>", the first key being
+// the primary one unless ENV_ENCRYPTION_PRIMARY_KEY says otherwise). Keys are
+// 32 random bytes.
+func LoadKeyring() (*Keyring, error) {
+	var primary string
+	encoded := map[string]string{}
+
+	if path := os.Getenv("ENV_KEYRING_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyring file: %v", err)
+		}
+		var file struct {
+			Primary string            `json:"primary"`
+			Keys    map[string]string `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse keyring file: %v", err)
+		}
+		primary = file.Primary
+		encoded = file.Keys
+	} else {
+		for _, entry := range strings.Split(os.Getenv("ENV_ENCRYPTION_KEYS"), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			id, key, ok := strings.Cut(entry, ":")
+			if !ok || id == "" {
+				return nil, fmt.Errorf("invalid key entry, expected id:base64")
+			}
+			if primary == "" {
+				primary = id
+			}
+			encoded[id] = key
+		}
+		if p := os.Getenv("ENV_ENCRYPTION_PRIMARY_KEY"); p != "" {
+			primary = p
+		}
+	}
+
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("no key configured, set ENV_ENCRYPTION_KEYS or ENV_KEYRING_FILE")
+	}
+
+	keyring := &Keyring{primary: primary, keys: map[string][]byte{}}
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		keyring.keys[id] = key
+	}
+	if _, ok := keyring.keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+
+	return keyring, nil
+}
+
+// Primary returns the ID of the key used to wrap new data keys
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Wrap encrypts a data key with the primary KEK
+func (k *Keyring) Wrap(dataKey []byte) (kekID string, wrapped []byte, err error) {
+	wrapped, err = seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", nil, err
+	}
+	return k.primary, wrapped, nil
+}
+
+// Unwrap decrypts a data key wrapped with the KEK kekID
+func (k *Keyring) Unwrap(kekID string, wrapped []byte) ([]byte, error) {
+	kek, ok := k.keys[kekID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kekID)
+	}
+	return open(kek, wrapped, []byte(kekID))
+}
+
+// seal encrypts plaintext with AES-256-GCM, prefixing the random nonce
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, data := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, data, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,107 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+)
+
+// EncryptOrganizationEnv sets env.Value to value encrypted with the active
+// data key of the env's organization. The env is not saved.
+func EncryptOrganizationEnv(tx *gorm.DB, env *db.OrganizationEnv, value string) error {
+	dataKey, key, err := activeOrganizationDataKey(tx, env.OrganizationID)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := seal(key, []byte(value), organizationAAD(env.OrganizationID))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt env: %v", err)
+	}
+
+	env.Value = base64.StdEncoding.EncodeToString(ciphertext)
+	env.DataKeyID = dataKey.ID
+	return nil
+}
+
+// DecryptOrganizationEnv returns the plaintext value of env
+func DecryptOrganizationEnv(tx *gorm.DB, env db.OrganizationEnv) (string, error) {
+	return newDecrypter(tx).decryptOrganizationEnv(env)
+}
+
+// organizationAAD binds a ciphertext to its organization
+func organizationAAD(organizationID uint) []byte {
+	return []byte(fmt.Sprintf("organization:%d", organizationID))
+}
+
+func (d *decrypter) decryptOrganizationEnv(env db.OrganizationEnv) (string, error) {
+	plaintext, err := d.open(env.DataKeyID, env.Value, organizationAAD(env.OrganizationID))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// organizationEnvironment returns the decrypted envs inherited from the
+// organization of a project, none when the project has no organization
+func (d *decrypter) organizationEnvironment(projectID uint) (map[string]string, error) {
+	var envs []db.OrganizationEnv
+	if err := d.tx.Joins("JOIN projects ON projects.organization_id = organization_envs.organization_id").
+		Where("projects.id = ?", projectID).Order("organization_envs.id ASC").Find(&envs).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch organization envs: %v", err)
+	}
+
+	values := make(map[string]string, len(envs))
+	for _, env := range envs {
+		value, err := d.decryptOrganizationEnv(env)
+		if err != nil {
+			return nil, fmt.Errorf("organization env %q: %v", env.Key, err)
+		}
+		values[env.Key] = value
+	}
+	return values, nil
+}
+
+// rotateOrganization re-encrypts the envs of an organization with a fresh
+// data key, see Rotate
+func rotateOrganization(tx *gorm.DB, organizationID uint) (int, error) {
+	var envs []db.OrganizationEnv
+	if err := tx.Unscoped().Where("organization_id = ?", organizationID).Find(&envs).Error; err != nil {
+		return 0, fmt.Errorf("failed to fetch envs: %v", err)
+	}
+
+	d := newDecrypter(tx)
+	values := make([]string, len(envs))
+	for i, env := range envs {
+		value, err := d.decryptOrganizationEnv(env)
+		if err != nil {
+			return 0, fmt.Errorf("env %d: %v", env.ID, err)
+		}
+		values[i] = value
+	}
+
+	dataKey, key, err := createDataKey(tx, db.DataKey{OrganizationID: organizationID})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range envs {
+		ciphertext, err := seal(key, []byte(values[i]), organizationAAD(organizationID))
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt env: %v", err)
+		}
+		if err := tx.Unscoped().Model(&envs[i]).Updates(map[string]interface{}{
+			"value":       base64.StdEncoding.EncodeToString(ciphertext),
+			"data_key_id": dataKey.ID,
+		}).Error; err != nil {
+			return 0, fmt.Errorf("failed to save env: %v", err)
+		}
+	}
+
+	if err := tx.Unscoped().Where("organization_id = ? AND id <> ?", organizationID, dataKey.ID).Delete(&db.DataKey{}).Error; err != nil {
+		return 0, fmt.Errorf("failed to delete old data keys: %v", err)
+	}
+	return len(envs), nil
+}
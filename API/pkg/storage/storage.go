@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrNotFound is returned by Get when the object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Store is an artifact store holding build outputs such as archived logs
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Artifacts is the store used by the API, set up by InitStore
+var Artifacts Store
+
+func InitStore() {
+	store, err := NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure artifact store: %v", err)
+	}
+	Artifacts = store
+
+	log.Println("Artifact store configured")
+}
+
+// NewFromEnv builds the Store selected by ARTIFACT_STORE ("fs" or "s3")
+func NewFromEnv() (Store, error) {
+	switch os.Getenv("ARTIFACT_STORE") {
+	case "", "fs":
+		root := os.Getenv("ARTIFACT_STORE_PATH")
+		if root == "" {
+			root = "./artifacts"
+		}
+		return NewFilesystemStore(root), nil
+	case "s3":
+		store := &S3Store{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}
+		if store.Endpoint == "" || store.Bucket == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set")
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown artifact store %q", os.Getenv("ARTIFACT_STORE"))
+	}
+}
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"os"
+	"strings"
+)
+
+// APIURL is where build pods reach the API, API_URL
+func APIURL() string {
+	if u := os.Getenv("API_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "http://localhost:8080"
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies(" 10.0.0.0/8, 192.168.1.10 ,,::1, fd00::/8")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "::1/128", "fd00::/8"}
+	if len(proxies) != len(want) {
+		t.Fatalf("parsed %v, want %v", proxies, want)
+	}
+	for i, prefix := range proxies {
+		if prefix.String() != want[i] {
+			t.Errorf("proxy %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+
+	for _, list := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/8"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", list)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "", "203.0.113.7:5123", nil, "203.0.113.7"},
+		{"forwarded without trusted proxies", "", "203.0.113.7:5123", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"forwarded by an untrusted peer", "10.0.0.0/8", "203.0.113.7:5123", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"behind a trusted proxy", "10.0.0.0/8", "10.0.0.2:5123", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forged entries", "10.0.0.0/8", "10.0.0.2:5123", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.0/8", "10.0.0.2:5123", []string{"1.2.3.4, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"several headers", "10.0.0.0/8", "10.0.0.2:5123", []string{"1.2.3.4", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.0/8", "10.0.0.2:5123", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"no header", "10.0.0.0/8", "10.0.0.2:5123", nil, "10.0.0.2"},
+		{"garbage entry", "10.0.0.0/8", "10.0.0.2:5123", []string{"198.51.100.1, not-an-ip, 10.0.0.3"}, "10.0.0.3"},
+		{"IPv6", "fd00::/8", "[fd00::2]:5123", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"IPv4-mapped proxy", "10.0.0.0/8", "[::ffff:10.0.0.2]:5123", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := parseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatalf("parseTrustedProxies: %v", err)
+			}
+			previous := trustedProxies
+			trustedProxies = proxies
+			t.Cleanup(func() { trustedProxies = previous })
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
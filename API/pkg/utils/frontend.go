@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"os"
+	"strings"
+)
+
+// FrontendURL is where the links sent by email point to, FRONTEND_URL
+func FrontendURL() string {
+	if u := os.Getenv("FRONTEND_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "http://localhost:3000"
+}